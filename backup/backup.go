@@ -0,0 +1,391 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/frontmatter"
+	"github.com/tydar/mdbssg/importer"
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/themes"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Version is written to the manifest of every archive
+const Version = 1
+
+// Backup is everything stored for one user's site. Errors lists the entries of a read
+// archive that were skipped because they could not be read
+type Backup struct {
+	Manifest  Manifest
+	Posts     []models.Post
+	Media     []models.Media
+	Site      *models.Site
+	Overrides []models.TemplateOverride
+	Errors    []string
+}
+
+// Manifest describes an archive. It is stored as manifest.json
+type Manifest struct {
+	Version    int          `json:"version"`
+	Username   string       `json:"username"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Media      []mediaEntry `json:"media"`
+}
+
+type mediaEntry struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+}
+
+// postMatter is the front matter written for each post
+type postMatter struct {
+	Title    string   `yaml:"title"`
+	Subtitle string   `yaml:"subtitle,omitempty"`
+	Author   string   `yaml:"author,omitempty"`
+	Date     string   `yaml:"date"`
+	Slug     string   `yaml:"slug"`
+	Tags     []string `yaml:"tags,omitempty"`
+	Draft    bool     `yaml:"draft,omitempty"`
+	Aliases  []string `yaml:"aliases,omitempty"`
+}
+
+// Stores are the collections a backup is read from and restored to
+type Stores struct {
+	Posts interface {
+		GetByUsername(ctx context.Context, username string) ([]models.Post, error)
+		Create(ctx context.Context, post models.Post) error
+	}
+	Media interface {
+		GetByUsername(ctx context.Context, username string) ([]models.Media, error)
+		Save(ctx context.Context, media models.Media) error
+	}
+	Sites interface {
+		GetByUsername(ctx context.Context, username string) (models.Site, error)
+		Save(ctx context.Context, site models.Site) error
+	}
+	Overrides interface {
+		GetByUsername(ctx context.Context, username string) ([]models.TemplateOverride, error)
+		Save(ctx context.Context, override models.TemplateOverride) error
+	}
+	// Themes checks the theme of restored settings and parses restored template overrides.
+	// Only Restore uses it
+	Themes *themes.Registry
+}
+
+// Export reads everything stored for username
+func Export(ctx context.Context, username string, s Stores) (Backup, error) {
+	b := Backup{Manifest: Manifest{Version: Version, Username: username, ExportedAt: time.Now().UTC()}}
+
+	var err error
+	b.Posts, err = s.Posts.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Backup{}, err
+	}
+
+	b.Media, err = s.Media.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Backup{}, err
+	}
+
+	site, err := s.Sites.GetByUsername(ctx, username)
+	if err == nil {
+		b.Site = &site
+	} else if err != mongo.ErrNoDocuments {
+		return Backup{}, err
+	}
+
+	b.Overrides, err = s.Overrides.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Backup{}, err
+	}
+	return b, nil
+}
+
+// Write writes b as a zip archive containing manifest.json, posts/*.md with front matter,
+// media/*, site.json and templates/*.html
+func Write(w io.Writer, b Backup) error {
+	zw := zip.NewWriter(w)
+
+	for _, p := range b.Posts {
+		data, err := frontmatter.Encode(postMatter{
+			Title:    p.Title,
+			Subtitle: p.Subtitle,
+			Author:   p.Author,
+			Date:     p.Pubdate.UTC().Format(time.RFC3339),
+			Slug:     p.Slug,
+			Tags:     p.Tags,
+			Draft:    p.Draft,
+			Aliases:  p.Aliases,
+		}, p.Content)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(zw, "posts/"+url.PathEscape(p.Slug)+".md", data); err != nil {
+			return err
+		}
+	}
+
+	b.Manifest.Media = make([]mediaEntry, len(b.Media))
+	for i, m := range b.Media {
+		b.Manifest.Media[i] = mediaEntry{Name: m.Name, ContentType: m.ContentType}
+		if err := writeFile(zw, path.Join("media", m.Name), m.Data); err != nil {
+			return err
+		}
+	}
+
+	if b.Site != nil {
+		if err := writeJSON(zw, "site.json", b.Site); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range b.Overrides {
+		if err := writeFile(zw, "templates/"+o.Name+".html", []byte(o.Source)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeJSON(zw, "manifest.json", b.Manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(zw, name, data)
+}
+
+// Read parses an archive written by Write. Only a missing or unsupported manifest fails the
+// whole archive; entries that cannot be read are skipped and listed in the Backup's Errors
+func Read(r io.ReaderAt, size int64) (Backup, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	var b Backup
+	var manifest *zip.File
+	for _, f := range zr.File {
+		if f.Name == "manifest.json" {
+			manifest = f
+		}
+	}
+	if manifest == nil {
+		return Backup{}, fmt.Errorf("backup: no manifest.json")
+	}
+	data, err := readFile(manifest)
+	if err != nil {
+		return Backup{}, fmt.Errorf("backup: %v", err)
+	}
+	if err := json.Unmarshal(data, &b.Manifest); err != nil {
+		return Backup{}, fmt.Errorf("manifest.json: %v", err)
+	}
+	if b.Manifest.Version != Version {
+		return Backup{}, fmt.Errorf("backup: unsupported archive version %d", b.Manifest.Version)
+	}
+
+	contentTypes := make(map[string]string, len(b.Manifest.Media))
+	for _, m := range b.Manifest.Media {
+		contentTypes[m.Name] = m.ContentType
+	}
+
+	for _, f := range zr.File {
+		if err := readEntry(&b, f, contentTypes); err != nil {
+			b.Errors = append(b.Errors, fmt.Sprintf("%q: %v", f.Name, err))
+		}
+	}
+	return b, nil
+}
+
+// readEntry adds the archive entry f to b. Entries that are not part of a backup are ignored.
+// The names of posts, media and templates are checked when they are restored
+func readEntry(b *Backup, f *zip.File, contentTypes map[string]string) error {
+	switch {
+	case strings.HasPrefix(f.Name, "posts/") && strings.HasSuffix(f.Name, ".md"):
+		data, err := readFile(f)
+		if err != nil {
+			return err
+		}
+		post, err := importer.PostFromMarkdown(data, "")
+		if err != nil {
+			return err
+		}
+		b.Posts = append(b.Posts, post)
+	case strings.HasPrefix(f.Name, "media/") && !f.FileInfo().IsDir():
+		data, err := readFile(f)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(f.Name, "media/")
+		b.Media = append(b.Media, models.Media{Name: name, ContentType: contentTypes[name], Data: data})
+	case f.Name == "site.json":
+		data, err := readFile(f)
+		if err != nil {
+			return err
+		}
+		var site models.Site
+		if err := json.Unmarshal(data, &site); err != nil {
+			return err
+		}
+		b.Site = &site
+	case strings.HasPrefix(f.Name, "templates/") && strings.HasSuffix(f.Name, ".html"):
+		data, err := readFile(f)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(f.Name, "templates/"), ".html")
+		b.Overrides = append(b.Overrides, models.TemplateOverride{Name: name, Source: string(data)})
+	}
+	return nil
+}
+
+// restoreOverrides saves each override that parses against the site's theme together with
+// the user's other overrides, as the template editor requires, and reports the rest as errors
+func restoreOverrides(ctx context.Context, username string, overrides []models.TemplateOverride, s Stores, r *Report) {
+	theme, _ := s.Themes.Get(themes.DefaultTheme)
+	site, err := s.Sites.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		r.Errors = append(r.Errors, fmt.Sprintf("templates: %v", err))
+		return
+	}
+	if t, ok := s.Themes.Get(site.Theme); ok {
+		theme = t
+	}
+
+	existing, err := s.Overrides.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		r.Errors = append(r.Errors, fmt.Sprintf("templates: %v", err))
+		return
+	}
+	sources := make(map[string]string, len(existing)+len(overrides))
+	for _, o := range existing {
+		sources[o.Name] = o.Source
+	}
+
+	for _, o := range overrides {
+		if _, ok := themes.Overridable[o.Name]; !ok {
+			r.Errors = append(r.Errors, fmt.Sprintf("template %q: not a template that can be overridden", o.Name))
+			continue
+		}
+
+		candidate := make(map[string]string, len(sources)+1)
+		for name, src := range sources {
+			candidate[name] = src
+		}
+		candidate[o.Name] = o.Source
+		if _, err := theme.Override(candidate); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("template %s: %v", o.Name, err))
+			continue
+		}
+
+		o.OwnerUsername = username
+		if err := s.Overrides.Save(ctx, o); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("template %s: %v", o.Name, err))
+			continue
+		}
+		sources[o.Name] = o.Source
+		r.Templates++
+	}
+}
+
+// readFile returns the contents of an archive entry, which may be at most models.MaxMediaSize bytes.
+// Entries are opened directly rather than by name so that names which are not valid paths can be reported
+func readFile(zf *zip.File) ([]byte, error) {
+	f, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, io.LimitReader(f, models.MaxMediaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() > models.MaxMediaSize {
+		return nil, fmt.Errorf("larger than %d bytes", models.MaxMediaSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// Report is the outcome of a restore
+type Report struct {
+	Posts     int
+	Media     int
+	Templates int
+	Site      bool
+	Errors    []string
+}
+
+// Restore recreates the contents of b for username. Posts whose slug already exists are
+// reported as errors and left unchanged; media, settings and template overrides are replaced.
+// Posts and media whose names would be published outside the user's site are reported as errors,
+// after the entries that could not be read from the archive
+func Restore(ctx context.Context, username string, b Backup, s Stores) Report {
+	r := Report{Errors: append([]string(nil), b.Errors...)}
+
+	for _, p := range b.Posts {
+		p.OwnerUsername = username
+		if !models.ValidSlug(p.Slug) {
+			r.Errors = append(r.Errors, fmt.Sprintf("post %q: invalid slug", p.Slug))
+			continue
+		}
+		if err := s.Posts.Create(ctx, p); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("post %s: %v", p.Slug, err))
+			continue
+		}
+		r.Posts++
+	}
+
+	for _, m := range b.Media {
+		m.OwnerUsername = username
+		if !models.ValidMediaName(m.Name) {
+			r.Errors = append(r.Errors, fmt.Sprintf("media %q: invalid name", m.Name))
+			continue
+		}
+		if err := s.Media.Save(ctx, m); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("media %s: %v", m.Name, err))
+			continue
+		}
+		r.Media++
+	}
+
+	if b.Site != nil {
+		site := *b.Site
+		site.OwnerUsername = username
+		if _, ok := s.Themes.Get(site.Theme); !ok {
+			r.Errors = append(r.Errors, fmt.Sprintf("site settings: unknown theme %q", site.Theme))
+		} else if err := s.Sites.Save(ctx, site); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("site settings: %v", err))
+		} else {
+			r.Site = true
+		}
+	}
+
+	if len(b.Overrides) > 0 {
+		restoreOverrides(ctx, username, b.Overrides, s, &r)
+	}
+	return r
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+)
+
+func TestReadSkipsBadEntries(t *testing.T) {
+	var good bytes.Buffer
+	err := Write(&good, Backup{
+		Manifest: Manifest{Version: Version, Username: "alice", ExportedAt: time.Now()},
+		Posts:    []models.Post{{Title: "Hello", Slug: "hello", Content: "Hi.", Pubdate: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}},
+		Media:    []models.Media{{Name: "cat.png", ContentType: "image/png", Data: []byte("png")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copy the archive and add entries that cannot be read
+	zr, err := zip.NewReader(bytes.NewReader(good.Bytes()), int64(good.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, f := range zr.File {
+		if err := zw.Copy(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		"posts/no-title.md":   "---\ndate: 2024-05-01\n---\nNo title.",
+		"posts/bad-slug.md":   "---\ntitle: Bad\nslug: a/b\n---\n",
+		"posts/../escape.md":  "---\ntitle: Escape\nslug: escape\n---\n",
+		"site.json":           "{not json",
+		"media/../../etc/x":   "x",
+		"notes/ignored.txt":   "ignored",
+		"templates/post.html": "{{ define \"body\" }}{{ end }}",
+		"media//double-slash": "y",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Read(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatalf("Read: %v, want the bad entries skipped", err)
+	}
+
+	var slugs []string
+	for _, p := range b.Posts {
+		slugs = append(slugs, p.Slug)
+	}
+	sort.Strings(slugs)
+	if strings.Join(slugs, " ") != "escape hello" {
+		t.Errorf("posts %v, want escape and hello, whatever their entry names", slugs)
+	}
+	if len(b.Media) != 3 || len(b.Overrides) != 1 || b.Site != nil {
+		t.Errorf("read %d media, %d templates and site %v; want 3 media and 1 template, with names left for Restore to check",
+			len(b.Media), len(b.Overrides), b.Site)
+	}
+
+	want := []string{`"posts/no-title.md"`, `"posts/bad-slug.md"`, `"site.json"`}
+	if len(b.Errors) != len(want) {
+		t.Fatalf("errors %q, want one for each of %v", b.Errors, want)
+	}
+	for _, name := range want {
+		found := false
+		for _, e := range b.Errors {
+			found = found || strings.HasPrefix(e, name+": ")
+		}
+		if !found {
+			t.Errorf("errors %q do not report %s", b.Errors, name)
+		}
+	}
+}
+
+func TestReadNeedsManifest(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, _ := zw.Create("posts/hello.md")
+	w.Write([]byte("---\ntitle: Hello\n---\n"))
+	zw.Close()
+
+	if _, err := Read(bytes.NewReader(archive.Bytes()), int64(archive.Len())); err == nil {
+		t.Error("an archive without a manifest was read")
+	}
+}
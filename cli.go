@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/backup"
+	"github.com/tydar/mdbssg/importer"
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/themes"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// connect opens the database named by $DATABASE_URL, defaulting to a local server
+func connect(ctx context.Context) (*mongo.Client, error) {
+	dbUrl, prs := os.LookupEnv("DATABASE_URL")
+	if !prs {
+		dbUrl = "mongodb://localhost:27017"
+	}
+	return mongo.Connect(ctx, options.Client().ApplyURI(dbUrl))
+}
+
+// runCommand runs a command line subcommand instead of the web server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import":
+		return runImport(args)
+	case "export":
+		return runExport(args)
+	case "restore":
+		return runRestore(args)
+	case "admin":
+		return runAdmin(args)
+	}
+	return fmt.Errorf("unknown command %q (available: import, export, restore, admin)", name)
+}
+
+// runImport imports a WordPress export, or a directory or .zip of Markdown, Hugo or Jekyll content, for a user:
+//
+//	mdbssg import -user USERNAME [-format markdown|hugo|jekyll|wordpress] PATH
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("user", "", "username that will own the imported posts")
+	format := flags.String("format", "markdown", "layout of PATH: "+strings.Join(importer.Formats, ", "))
+	flags.Parse(args)
+
+	if *username == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("import: -user and PATH are required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	um := models.NewUserModel(client, "mdbssg", models.DefaultPasswordConfig())
+	user, err := um.GetByUsername(ctx, *username)
+	if err != nil {
+		return fmt.Errorf("import: user %s: %v", *username, err)
+	}
+
+	items, err := readTree(flags.Arg(0), *format, user.Username)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		if items[i].Post.Author == "" {
+			items[i].Post.Author = user.DisplayName
+		}
+	}
+
+	created := importer.Save(ctx, items, models.NewPostModel(client, "mdbssg"), models.NewMediaModel(client, "mdbssg"))
+	for _, item := range items {
+		if item.Err != nil {
+			fmt.Printf("FAIL %s: %v\n", item.Path, item.Err)
+		} else if item.Skipped != "" {
+			fmt.Printf("SKIP %s: %s\n", item.Path, item.Skipped)
+		} else {
+			fmt.Printf("OK   %s -> %s\n", item.Path, item.Post.Slug)
+		}
+		for _, w := range item.Warnings {
+			fmt.Printf("     warning: %s\n", w)
+		}
+	}
+	fmt.Printf("imported %d of %d items\n", created, len(items))
+	return nil
+}
+
+// readTree imports a WordPress export file, or a directory or .zip archive in the given format
+func readTree(p, format, username string) ([]importer.Item, error) {
+	if strings.HasSuffix(strings.ToLower(p), ".xml") {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return importer.WXR(f, username, importer.HTTPFetch)
+	}
+
+	fsys, closer, err := openTree(p)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	return importer.Import(format, fsys, username)
+}
+
+// openTree opens a directory or a .zip archive as a file system
+func openTree(p string) (fs.FS, func() error, error) {
+	if strings.HasSuffix(strings.ToLower(p), ".zip") {
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.IsDir() {
+		return nil, nil, fmt.Errorf("import: %s is not a directory or .zip file", p)
+	}
+	return os.DirFS(p), func() error { return nil }, nil
+}
+
+// loadThemes returns the built-in themes and those in $THEMES_DIR
+func loadThemes() (*themes.Registry, error) {
+	registry, err := themes.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if dir, prs := os.LookupEnv("THEMES_DIR"); prs {
+		if err := registry.LoadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+func backupStores(client *mongo.Client, registry *themes.Registry) backup.Stores {
+	return backup.Stores{
+		Posts:     models.NewPostModel(client, "mdbssg"),
+		Media:     models.NewMediaModel(client, "mdbssg"),
+		Sites:     models.NewSiteModel(client, "mdbssg"),
+		Overrides: models.NewOverrideModel(client, "mdbssg"),
+		Themes:    registry,
+	}
+}
+
+// runExport writes a backup archive of a user's site:
+//
+//	mdbssg export -user USERNAME -o FILE.zip
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	username := flags.String("user", "", "username to export")
+	out := flags.String("o", "", "archive to write")
+	flags.Parse(args)
+
+	if *username == "" || *out == "" {
+		flags.Usage()
+		return errors.New("export: -user and -o are required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	b, err := backup.Export(ctx, *username, backupStores(client, nil))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = backup.Write(f, b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Printf("exported %d posts and %d media files to %s\n", len(b.Posts), len(b.Media), *out)
+	return f.Close()
+}
+
+// runRestore recreates a backup archive in a user's account:
+//
+//	mdbssg restore -user USERNAME FILE.zip
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	username := flags.String("user", "", "username to restore into")
+	flags.Parse(args)
+
+	if *username == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("restore: -user and FILE are required")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	b, err := backup.Read(f, info.Size())
+	if err != nil {
+		return err
+	}
+	registry, err := loadThemes()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	if _, err := models.NewUserModel(client, "mdbssg", models.DefaultPasswordConfig()).GetByUsername(ctx, *username); err != nil {
+		return fmt.Errorf("restore: user %s: %v", *username, err)
+	}
+
+	report := backup.Restore(ctx, *username, b, backupStores(client, registry))
+	for _, e := range report.Errors {
+		fmt.Println("FAIL", e)
+	}
+	fmt.Printf("restored %d posts, %d media files, %d templates, site settings: %v\n",
+		report.Posts, report.Media, report.Templates, report.Site)
+	return nil
+}
+
+// runAdmin grants a user admin rights, or takes them away with -revoke:
+//
+//	mdbssg admin -user USERNAME [-revoke]
+func runAdmin(args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	username := flags.String("user", "", "username to make an admin")
+	revoke := flags.Bool("revoke", false, "take admin rights away instead")
+	flags.Parse(args)
+
+	if *username == "" {
+		flags.Usage()
+		return errors.New("admin: -user is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	err = models.NewUserModel(client, "mdbssg", models.DefaultPasswordConfig()).SetAdmin(ctx, *username, !*revoke)
+	if err != nil {
+		return fmt.Errorf("admin: user %s: %v", *username, err)
+	}
+	if *revoke {
+		fmt.Printf("%s is no longer an admin\n", *username)
+	} else {
+		fmt.Printf("%s is now an admin\n", *username)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package frontmatter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Matter holds the decoded front matter of a document
+type Matter map[string]interface{}
+
+// ErrUnterminated is returned when a document opens a front matter block but never closes it
+var ErrUnterminated = errors.New("front matter: missing closing delimiter")
+
+// Parse splits a document into its front matter and body.
+// YAML front matter is delimited by "---" lines and TOML front matter by "+++" lines.
+// A document without front matter returns an empty Matter and the whole document as body
+func Parse(data []byte) (Matter, string, error) {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var delim string
+	switch {
+	case bytes.HasPrefix(data, []byte("---\n")):
+		delim = "---"
+	case bytes.HasPrefix(data, []byte("+++\n")):
+		delim = "+++"
+	default:
+		return Matter{}, string(data), nil
+	}
+
+	// find the closing delimiter on a line of its own
+	rest := string(data[len(delim)+1:])
+	var head, body string
+	if strings.HasPrefix(rest, delim+"\n") || rest == delim {
+		body = strings.TrimPrefix(rest[len(delim):], "\n")
+	} else if end := strings.Index(rest, "\n"+delim+"\n"); end != -1 {
+		head, body = rest[:end], rest[end+len(delim)+2:]
+	} else if strings.HasSuffix(rest, "\n"+delim) {
+		head = strings.TrimSuffix(rest, "\n"+delim)
+	} else {
+		return nil, "", ErrUnterminated
+	}
+
+	m := Matter{}
+	var err error
+	if delim == "---" {
+		err = yaml.Unmarshal([]byte(head), &m)
+	} else {
+		err = toml.Unmarshal([]byte(head), &m)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("front matter: %v", err)
+	}
+	return m, body, nil
+}
+
+// String returns the value of key as a string, or "" if it is missing
+func (m Matter) String(key string) string {
+	switch v := m[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format("2006-01-02")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Strings returns the value of key as a list of strings. A string value is split on commas,
+// so both `tags: [a, b]` and `tags: "a, b"` are accepted
+func (m Matter) Strings(key string) []string {
+	var list []string
+	switch v := m[key].(type) {
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			list = append(list, strings.TrimSpace(fmt.Sprint(s)))
+		}
+	case []string:
+		list = v
+	}
+	return list
+}
+
+// Bool returns the value of key as a bool and whether it was present
+func (m Matter) Bool(key string) (bool, bool) {
+	switch v := m[key].(type) {
+	case bool:
+		return v, true
+	case string:
+		return v == "true" || v == "yes", true
+	}
+	return false, false
+}
+
+// dateLayouts are tried in order when a date is given as a string
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Time returns the value of key as a time, or an error if it is missing or not a date
+func (m Matter) Time(key string) (time.Time, error) {
+	switch v := m[key].(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return ParseDate(v)
+	case nil:
+		return time.Time{}, fmt.Errorf("front matter: no %s", key)
+	}
+	return time.Time{}, fmt.Errorf("front matter: %s is not a date: %v", key, m[key])
+}
+
+// ParseDate parses the date formats commonly found in front matter and file names
+func ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("front matter: unrecognized date %q", s)
+}
+
+// Encode writes a document with v marshalled as YAML front matter followed by body
+func Encode(v interface{}, body string) ([]byte, error) {
+	head, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	b.Write(head)
+	b.WriteString("---\n\n")
+	b.WriteString(body)
+	if !strings.HasSuffix(body, "\n") {
+		b.WriteString("\n")
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// APIPrefix is the path under which version 1 of the JSON API is served
+const APIPrefix = "/api/v1"
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// --- API models
+
+// apiPost is the JSON representation of a post
+type apiPost struct {
+	Slug     string    `json:"slug"`
+	Title    string    `json:"title"`
+	Subtitle string    `json:"subtitle"`
+	Author   string    `json:"author"`
+	Content  string    `json:"content"`
+	Pubdate  time.Time `json:"pubdate"`
+	Tags     []string  `json:"tags"`
+	Draft    bool      `json:"draft"`
+	Aliases  []string  `json:"aliases"`
+}
+
+func apiPostFromModel(post models.Post) apiPost {
+	ap := apiPost{
+		Slug:     post.Slug,
+		Title:    post.Title,
+		Subtitle: post.Subtitle,
+		Author:   post.Author,
+		Content:  post.Content,
+		Pubdate:  post.Pubdate,
+		Tags:     post.Tags,
+		Draft:    post.Draft,
+		Aliases:  post.Aliases,
+	}
+	if ap.Tags == nil {
+		ap.Tags = []string{}
+	}
+	if ap.Aliases == nil {
+		ap.Aliases = []string{}
+	}
+	return ap
+}
+
+// apiPostInput is the request body for creating and updating posts
+// omitted fields keep their current value on update
+type apiPostInput struct {
+	Slug     *string   `json:"slug"`
+	Title    *string   `json:"title"`
+	Subtitle *string   `json:"subtitle"`
+	Author   *string   `json:"author"`
+	Content  *string   `json:"content"`
+	Pubdate  *string   `json:"pubdate"`
+	Tags     *[]string `json:"tags"`
+	Draft    *bool     `json:"draft"`
+	Aliases  *[]string `json:"aliases"`
+}
+
+// apply copies the fields set in the input onto post and returns the problems found,
+// keyed by field name
+func (in apiPostInput) apply(post *models.Post) map[string]string {
+	fields := map[string]string{}
+
+	if in.Title != nil {
+		post.Title = strings.TrimSpace(*in.Title)
+	}
+	if in.Subtitle != nil {
+		post.Subtitle = *in.Subtitle
+	}
+	if in.Author != nil {
+		post.Author = *in.Author
+	}
+	if in.Content != nil {
+		post.Content = strings.TrimSpace(*in.Content)
+	}
+	if in.Pubdate != nil {
+		pubdate, err := parseAPIDate(*in.Pubdate)
+		if err != nil {
+			fields["pubdate"] = "must be a date (2006-01-02) or RFC 3339 timestamp"
+		}
+		post.Pubdate = pubdate
+	}
+	if in.Tags != nil {
+		post.Tags = nil
+		for _, t := range *in.Tags {
+			if t = strings.TrimSpace(t); t != "" {
+				post.Tags = append(post.Tags, t)
+			}
+		}
+	}
+	if in.Draft != nil {
+		post.Draft = *in.Draft
+	}
+	if in.Aliases != nil {
+		post.Aliases = *in.Aliases
+	}
+
+	if post.Title == "" {
+		fields["title"] = "is required"
+	}
+	if post.Pubdate.IsZero() && fields["pubdate"] == "" {
+		fields["pubdate"] = "is required"
+	}
+	return fields
+}
+
+func parseAPIDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+type apiError struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type postList struct {
+	Posts      []apiPost `json:"posts"`
+	Page       int       `json:"page"`
+	PerPage    int       `json:"per_page"`
+	Total      int       `json:"total"`
+	TotalPages int       `json:"total_pages"`
+}
+
+type apiUser struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+	SiteURL     string    `json:"site_url"`
+}
+
+// --- helpers
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+func writeValidationError(w http.ResponseWriter, fields map[string]string) {
+	writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: "validation failed", Fields: fields})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// pagination reads the page and per_page query parameters
+func pagination(q url.Values) (page, perPage int, fields map[string]string) {
+	fields = map[string]string{}
+	page, perPage = 1, defaultPerPage
+
+	if s := q.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			fields["page"] = "must be a positive integer"
+		}
+		page = n
+	}
+	if s := q.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPerPage {
+			fields["per_page"] = fmt.Sprintf("must be an integer between 1 and %d", maxPerPage)
+		}
+		perPage = n
+	}
+	return page, perPage, fields
+}
+
+// pageLink builds the URL of another page of the current listing for the Link header
+func pageLink(r *http.Request, page, perPage int, rel string) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per_page", strconv.Itoa(perPage))
+	return fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, q.Encode(), rel)
+}
+
+// --- handlers
+
+// OpenAPI serves the OpenAPI description of the JSON API
+func (env *Env) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// APIMe returns the signed in user
+func (env *Env) APIMe(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	if !requireScope(w, au, models.ScopeReadPosts) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiUser{
+		Username:    au.user.Username,
+		DisplayName: au.user.DisplayName,
+		CreatedAt:   au.user.CreatedAt,
+		SiteURL:     "/static/" + au.user.Username + "/",
+	})
+}
+
+// APIGenerate generates the signed in user's site to the configured host
+func (env *Env) APIGenerate(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if !requireScope(w, au, models.ScopePublish) {
+		return
+	}
+
+	username := au.user.Username
+	if err := env.publishSite(r.Context(), username); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"url": "/static/" + username + "/"})
+}
+
+// APIPosts routes /api/v1/posts to the collection handlers
+// and /api/v1/posts/{slug} to the single post handlers
+func (env *Env) APIPosts(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	slug := strings.TrimPrefix(r.URL.Path, APIPrefix+"/posts")
+	slug = strings.TrimPrefix(slug, "/")
+
+	scope := models.ScopeWritePosts
+	if r.Method == "GET" {
+		scope = models.ScopeReadPosts
+	}
+	if !requireScope(w, au, scope) {
+		return
+	}
+
+	if slug == "" {
+		switch r.Method {
+		case "GET":
+			env.apiListPosts(w, r, au)
+		case "POST":
+			env.apiCreatePost(w, r, au)
+		default:
+			methodNotAllowed(w, "GET", "POST")
+		}
+		return
+	}
+
+	post, err := env.posts.GetBySlug(r.Context(), slug)
+	if err == mongo.ErrNoDocuments || (err == nil && post.OwnerUsername != au.user.Username) {
+		// other users' posts are reported as missing rather than forbidden
+		writeAPIError(w, http.StatusNotFound, "post not found")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, apiPostFromModel(post))
+	case "PUT", "PATCH":
+		env.apiUpdatePost(w, r, post)
+	case "DELETE":
+		if err := env.posts.Delete(r.Context(), slug); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET", "PUT", "PATCH", "DELETE")
+	}
+}
+
+func (env *Env) apiListPosts(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	page, perPage, fields := pagination(r.URL.Query())
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+
+	posts, err := env.posts.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.SliceStable(posts, func(i, j int) bool { return posts[i].Pubdate.After(posts[j].Pubdate) })
+
+	list := postList{
+		Posts:      []apiPost{},
+		Page:       page,
+		PerPage:    perPage,
+		Total:      len(posts),
+		TotalPages: (len(posts) + perPage - 1) / perPage,
+	}
+	start := (page - 1) * perPage
+	for i := start; i < len(posts) && i < start+perPage; i++ {
+		list.Posts = append(list.Posts, apiPostFromModel(posts[i]))
+	}
+
+	var links []string
+	if page > 1 {
+		links = append(links, pageLink(r, page-1, perPage, "prev"))
+	}
+	if page < list.TotalPages {
+		links = append(links, pageLink(r, page+1, perPage, "next"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (env *Env) apiCreatePost(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	var in apiPostInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	post := models.Post{OwnerUsername: au.user.Username}
+	fields := in.apply(&post)
+	if in.Slug != nil {
+		post.Slug = *in.Slug
+	} else if post.Title != "" && !post.Pubdate.IsZero() {
+		post.Slug = models.DefaultSlug(post.Title, post.Pubdate)
+	}
+	if _, ok := fields["title"]; !ok && !models.ValidSlug(post.Slug) {
+		fields["slug"] = "must be non-empty and must not contain /, \\, ? or #"
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+
+	err := env.posts.Create(r.Context(), post)
+	var exists *models.PostAlreadyExists
+	if errors.As(err, &exists) {
+		writeJSON(w, http.StatusConflict, apiError{
+			Error:  err.Error(),
+			Fields: map[string]string{"slug": "is already in use"},
+		})
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", APIPrefix+"/posts/"+url.PathEscape(post.Slug))
+	writeJSON(w, http.StatusCreated, apiPostFromModel(post))
+}
+
+func (env *Env) apiUpdatePost(w http.ResponseWriter, r *http.Request, post models.Post) {
+	var in apiPostInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updated := post
+	fields := in.apply(&updated)
+	if in.Slug != nil && *in.Slug != post.Slug {
+		fields["slug"] = "cannot be changed"
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+
+	// Update reports an error when nothing was modified
+	if !reflect.DeepEqual(updated, post) {
+		if err := env.posts.Update(r.Context(), updated); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, apiPostFromModel(updated))
+}
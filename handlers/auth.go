@@ -2,21 +2,35 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/tydar/mdbssg/models"
 )
 
 type AuthenticatedHandler func(w http.ResponseWriter, r *http.Request, authUser AuthUser)
 
+// AuthMW only calls its handler for signed in users and shows the sign in page otherwise.
+// Requests with an Authorization: Bearer token are accepted only when a scope was set with Scope
 type AuthMW struct {
 	handler AuthenticatedHandler
 	e       *Env
+	scope   string
 }
 
+// AuthUser is the user a request was authenticated as. token and session are the token
+// and ID of the session cookie; apiToken is set instead when the request used a personal API token
 type AuthUser struct {
-	user  models.User
-	token string
+	user     models.User
+	token    string
+	session  string
+	apiToken *models.APIToken
+}
+
+// can reports whether the request may use scope. Session cookies grant every scope
+func (au AuthUser) can(scope string) bool {
+	return au.apiToken == nil || au.apiToken.HasScope(scope)
 }
 
 func NewAuthMW(h AuthenticatedHandler, e *Env) *AuthMW {
@@ -26,58 +40,137 @@ func NewAuthMW(h AuthenticatedHandler, e *Env) *AuthMW {
 	}
 }
 
+// Scope allows API tokens granted scope to use the handler
+func (a *AuthMW) Scope(scope string) *AuthMW {
+	a.scope = scope
+	return a
+}
+
 func (a *AuthMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	user, token, err := a.e.getSignedInUser(r)
-	if err != nil {
-		td := struct {
-			Flash string
-		}{
-			Flash: "Please log in!",
+	if bearer, ok := bearerToken(r); ok {
+		au, err := a.e.getTokenUser(r, bearer)
+		if err == nil && a.scope == "" {
+			err = errors.New("this page cannot be used with an API token")
 		}
-		a.e.templates["signin"].ExecuteTemplate(w, "base", td)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !au.can(a.scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, a.scope))
+			http.Error(w, "token lacks the "+a.scope+" scope", http.StatusForbidden)
+			return
+		}
+		a.handler(w, r, au)
 		return
 	}
 
-	au := AuthUser{
-		user:  user,
-		token: token,
+	au, err := a.e.getSignedInUser(r)
+	if err != nil {
+		td := a.e.newTemplateData(r, false, "Please log in!")
+		a.e.templates["signin"].ExecuteTemplate(w, "base", td)
+		return
 	}
 
 	a.handler(w, r, au)
 }
 
-func (e *Env) getSignedInUser(r *http.Request) (models.User, string, error) {
-	username, err := r.Cookie("user")
-	if err != nil {
-		return models.User{}, "", err
+// APIAuthMW authenticates requests like AuthMW, but answers unauthenticated
+// requests with a JSON 401 instead of the sign in page.
+// API tokens are always accepted; handlers check their scopes with requireScope
+type APIAuthMW struct {
+	handler AuthenticatedHandler
+	e       *Env
+}
+
+func NewAPIAuthMW(h AuthenticatedHandler, e *Env) *APIAuthMW {
+	return &APIAuthMW{
+		handler: h,
+		e:       e,
+	}
+}
+
+func (a *APIAuthMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if bearer, ok := bearerToken(r); ok {
+		au, err := a.e.getTokenUser(r, bearer)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		a.handler(w, r, au)
+		return
 	}
 
-	token, err := r.Cookie("sessionid")
+	au, err := a.e.getSignedInUser(r)
 	if err != nil {
-		return models.User{}, "", err
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "authentication required")
+		return
 	}
 
-	if !e.users.CheckSessionValid(r.Context(), username.Value, token.Value) {
-		return models.User{}, "", errors.New("no valid session")
+	a.handler(w, r, au)
+}
+
+// requireScope writes a 403 and returns false if the request may not use scope
+func requireScope(w http.ResponseWriter, au AuthUser, scope string) bool {
+	if au.can(scope) {
+		return true
 	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+	writeAPIError(w, http.StatusForbidden, "token lacks the "+scope+" scope")
+	return false
+}
 
-	user, err := e.users.GetByUsername(r.Context(), username.Value)
-	return user, token.Value, err
+// bearerToken returns the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < len("Bearer ") || !strings.EqualFold(h[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[len("Bearer "):]), true
 }
 
-func (e *Env) checkSignedIn(r *http.Request) error {
-	username, err := r.Cookie("user")
+func (e *Env) getTokenUser(r *http.Request, bearer string) (AuthUser, error) {
+	user, token, err := e.users.GetByToken(r.Context(), bearer)
 	if err != nil {
-		return err
+		return AuthUser{}, err
 	}
+	return AuthUser{user: user, apiToken: &token}, nil
+}
 
-	token, err := r.Cookie("sessionid")
+// getSignedInUser returns the user signed in with the session cookie with the session's token and ID
+func (e *Env) getSignedInUser(r *http.Request) (AuthUser, error) {
+	s, token, err := e.checkSession(r)
 	if err != nil {
-		return err
+		return AuthUser{}, err
 	}
 
-	if !e.users.CheckSessionValid(r.Context(), username.Value, token.Value) {
-		return errors.New("no valid session")
+	user, err := e.users.GetByUsername(r.Context(), s.Username)
+	if err != nil {
+		return AuthUser{}, err
 	}
-	return nil
+	return AuthUser{user: user, token: token, session: s.ID}, nil
+}
+
+func (e *Env) checkSignedIn(r *http.Request) error {
+	_, _, err := e.checkSession(r)
+	return err
+}
+
+// checkSession returns the session of a valid, correctly signed session cookie and its token
+func (e *Env) checkSession(r *http.Request) (models.Session, string, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return models.Session{}, "", err
+	}
+
+	id, token, ok := e.parseSessionCookie(cookie.Value)
+	if !ok {
+		return models.Session{}, "", models.ErrTokenInvalid
+	}
+
+	s, err := e.sessions.Check(r.Context(), id, token)
+	return s, token, err
 }
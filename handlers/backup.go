@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tydar/mdbssg/backup"
+)
+
+// maxBackupSize limits the size of uploaded backup archives
+const maxBackupSize = 512 << 20
+
+// maxBackupMemory is how much of an upload is kept in memory; larger archives are written
+// to a temporary file, which zip reads from without loading the whole archive
+const maxBackupMemory = 1 << 20
+
+type backupData struct {
+	TemplateData
+	Report *backup.Report
+}
+
+func (env *Env) backupStores() backup.Stores {
+	return backup.Stores{
+		Posts:     env.posts,
+		Media:     env.media,
+		Sites:     env.sites,
+		Overrides: env.overrides,
+		Themes:    env.themes,
+	}
+}
+
+// Backup handles the backup pages:
+// GET /backup/ renders the download and restore forms
+// GET /backup/download streams an archive of the user's posts, media, settings and templates
+// POST /backup/ restores an uploaded archive into the signed in user's account
+func (env *Env) Backup(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.URL.Path == "/backup/download" {
+		env.downloadBackup(w, r, au)
+		return
+	}
+
+	td := backupData{TemplateData: env.newTemplateData(r, true, "")}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBackupSize)
+		report, err := env.restoreBackup(r, au)
+		if err != nil {
+			td.Flash = err.Error()
+		} else {
+			td.Report = &report
+			td.Flash = "Backup restored."
+		}
+	}
+
+	err := env.templates["backup"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (env *Env) downloadBackup(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	b, err := backup.Export(r.Context(), au.user.Username, env.backupStores())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err = backup.Write(buf, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("mdbssg-%s-%s.zip", au.user.Username, time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
+
+func (env *Env) restoreBackup(r *http.Request, au AuthUser) (backup.Report, error) {
+	if err := r.ParseMultipartForm(maxBackupMemory); err != nil {
+		return backup.Report{}, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		return backup.Report{}, err
+	}
+	defer file.Close()
+
+	b, err := backup.Read(file, header.Size)
+	if err != nil {
+		return backup.Report{}, err
+	}
+	return backup.Restore(r.Context(), au.user.Username, b, env.backupStores()), nil
+}
@@ -1,10 +1,31 @@
 package handlers
 
-import "context"
+import (
+	"context"
+	"net/http"
+)
 
+// TemplateData holds the fields every page template uses. CSRFToken must be
+// included as the csrf_token field of every form that POSTs. SSO names the
+// single sign-on provider, if there is one
 type TemplateData struct {
-	Flash    string
-	LoggedIn bool
+	Flash     string
+	LoggedIn  bool
+	CSRFToken string
+	SSO       string
+}
+
+// newTemplateData returns the TemplateData for a page rendered in response to r
+func (env *Env) newTemplateData(r *http.Request, loggedIn bool, flash string) TemplateData {
+	td := TemplateData{
+		Flash:     flash,
+		LoggedIn:  loggedIn,
+		CSRFToken: csrfToken(r),
+	}
+	if env.sso != nil {
+		td.SSO = env.sso.Name
+	}
+	return td
 }
 
 func (td *TemplateData) String() string {
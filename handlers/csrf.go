@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// CSRFFormField is the hidden form field and CSRFHeader the request header that carry the CSRF token
+const (
+	CSRFFormField = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// csrfCookie holds a random value that CSRF tokens are bound to until the visitor signs in
+const csrfCookie = "csrf"
+
+type csrfKey string
+
+const ck csrfKey = "csrf"
+
+// CSRFMW rejects state-changing requests from browsers that do not carry the CSRF token
+// for the visitor's session, and makes the token available to templates through TemplateData.
+// Requests authenticated with a bearer token and the Micropub and XML-RPC endpoints are exempt,
+// since browsers never send those credentials on their own
+type CSRFMW struct {
+	next http.Handler
+	e    *Env
+	key  []byte
+}
+
+func NewCSRFMW(next http.Handler, e *Env, key []byte) *CSRFMW {
+	return &CSRFMW{
+		next: next,
+		e:    e,
+		key:  key,
+	}
+}
+
+// NewCSRFKey returns a random key for signing CSRF tokens
+func NewCSRFKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (c *CSRFMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, err := c.token(w, r)
+	if err != nil {
+		c.e.renderError(w, r, http.StatusInternalServerError, "Server error", err.Error())
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), ck, token))
+	if strings.HasPrefix(r.URL.Path, APIPrefix+"/") {
+		// scripts using the API with a session cookie read the token from here
+		w.Header().Set(CSRFHeader, token)
+	}
+
+	if c.exempt(r) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	// the form has to be parsed to read the token, so the upload limits are applied here
+	limit := int64(maxImportSize)
+	if strings.HasPrefix(r.URL.Path, "/backup/") {
+		limit = maxBackupSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	sent := r.Header.Get(CSRFHeader)
+	if sent == "" {
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil && err != http.ErrNotMultipart {
+			c.e.renderError(w, r, http.StatusBadRequest, "Invalid form", err.Error())
+			return
+		}
+		sent = r.FormValue(CSRFFormField)
+	}
+	if !hmac.Equal([]byte(sent), []byte(token)) {
+		c.e.renderError(w, r, http.StatusForbidden, "Form expired",
+			"This form could not be verified. Go back, reload the page and try again.")
+		return
+	}
+
+	c.next.ServeHTTP(w, r)
+}
+
+// exempt reports whether r may skip the token check
+func (c *CSRFMW) exempt(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	switch r.URL.Path {
+	case MicropubPath, MicropubMediaPath, XMLRPCPath:
+		return true
+	}
+	_, ok := bearerToken(r)
+	return ok
+}
+
+// token returns the CSRF token for the visitor: an HMAC of their session cookie or,
+// before they sign in, of the csrf cookie, which is set here if missing
+func (c *CSRFMW) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	binding := ""
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		binding = "session:" + cookie.Value
+	} else if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		binding = "anon:" + cookie.Value
+	} else {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		value := hex.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: value, SameSite: http.SameSiteLaxMode, HttpOnly: true, Secure: isHTTPS(r), Path: "/"})
+		binding = "anon:" + value
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(binding))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// csrfToken returns the CSRF token that CSRFMW stored for the request
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(ck).(string)
+	return token
+}
+
+type errorData struct {
+	TemplateData
+	Title   string
+	Message string
+}
+
+// renderError writes status and the error page
+func (env *Env) renderError(w http.ResponseWriter, r *http.Request, status int, title, message string) {
+	w.WriteHeader(status)
+	td := errorData{
+		TemplateData: env.newTemplateData(r, false, ""),
+		Title:        title,
+		Message:      message,
+	}
+	err := env.templates["error"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
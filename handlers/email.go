@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mailTimeout bounds how long sending one email may take
+const mailTimeout = 30 * time.Second
+
+// errNoBaseURL is returned when a link has to be emailed but the site's address is not configured
+var errNoBaseURL = errors.New("the site's public URL is not configured")
+
+// publicURL returns the address of path p on the site, built from the configured base URL
+func (env *Env) publicURL(p string) (string, error) {
+	if env.baseURL == "" {
+		return "", errNoBaseURL
+	}
+	return env.baseURL + p, nil
+}
+
+// mailData is passed to the email templates
+type mailData struct {
+	Site     string
+	Username string
+	Link     string
+	Expires  string
+}
+
+// sendMail renders the email template name for u with link and sends it to u's address
+func (env *Env) sendMail(ctx context.Context, name string, u models.User, link string, expires time.Duration) error {
+	msg, err := env.mailTmpl.Render(name, u.Email, mailData{
+		Site:     models.TOTPIssuer,
+		Username: u.Username,
+		Link:     link,
+		Expires:  formatLifetime(expires),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	return env.mail.Send(ctx, msg)
+}
+
+// formatLifetime returns d in words, such as "1 hour" or "48 hours"
+func formatLifetime(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	if d%time.Hour == 0 {
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// sendVerification emails u a link to verify their address
+func (env *Env) sendVerification(r *http.Request, u models.User) error {
+	link, err := env.publicURL("/verify/?token=")
+	if err != nil {
+		return err
+	}
+	token, err := env.users.BeginEmailVerification(r.Context(), u.Username)
+	if err != nil {
+		return err
+	}
+	link += url.QueryEscape(token)
+	return env.sendMail(r.Context(), "verify", u, link, models.EmailVerificationLifetime)
+}
+
+// VerifyEmail handles the link sent to verify an email address
+func (env *Env) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	flash := "Your email address is confirmed."
+	_, err := env.users.VerifyEmail(r.Context(), r.URL.Query().Get("token"))
+	if err == models.ErrTokenInvalid {
+		flash = "That link has expired or was already used. Send a new one from the Account page."
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	au, err := env.getSignedInUser(r)
+	if err == nil {
+		env.renderAccount(w, r, au, flash, "")
+		return
+	}
+	err = env.templates["signin"].ExecuteTemplate(w, "base", env.newTemplateData(r, false, flash))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Email changes the user's email address after checking their password (action=change),
+// or sends a new verification link (action=resend), from the account page
+func (env *Env) Email(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/changepwd/", http.StatusFound)
+		return
+	}
+
+	flash, err := env.emailAction(r, au.user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// reload so the page shows the new address
+	user, err := env.users.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	au.user = user
+	env.renderAccount(w, r, au, flash, "")
+}
+
+// emailAction performs the POSTed action and returns the message to flash
+func (env *Env) emailAction(r *http.Request, user models.User) (string, error) {
+	switch r.FormValue("action") {
+	case "change":
+		if msg, err := env.recheckPassword(r, user.Username, r.FormValue("password")); msg != "" || err != nil {
+			return msg, err
+		}
+		err := env.users.SetEmail(r.Context(), user.Username, r.FormValue("email"))
+		if err != nil {
+			return err.Error(), nil
+		}
+		user.Email, _ = models.NormalizeEmail(r.FormValue("email"))
+	case "resend":
+		if user.Email == "" || user.EmailVerified {
+			return "There is no email address to confirm.", nil
+		}
+	default:
+		return "Unknown action.", nil
+	}
+
+	err := env.sendVerification(r, user)
+	if err != nil {
+		log.Printf("sending verification email to %s: %v", user.Username, err)
+		return "The confirmation email could not be sent. Please try again later.", nil
+	}
+	return "We sent a confirmation link to " + user.Email + ".", nil
+}
+
+// ForgotPassword shows the form to ask for a password reset link, and on POST emails
+// one if an account has the given verified address. The answer is the same either way,
+// and the email is sent in the background, so the form does not reveal which addresses exist
+func (env *Env) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	flash := ""
+	if r.Method == "POST" {
+		var err error
+		flash, err = env.sendPasswordReset(r, r.FormValue("email"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := env.templates["forgot"].ExecuteTemplate(w, "base", env.newTemplateData(r, false, flash))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sendPasswordReset starts a password reset for the account with the confirmed address email
+// and emails it the link in the background, returning the message to flash. Nothing is sent if
+// there is no such account. Requests are counted per address and per client IP, whether or not
+// the address exists, and refused once either is over its limit
+func (env *Env) sendPasswordReset(r *http.Request, email string) (string, error) {
+	const sent = "If an account has that confirmed email address, we sent it a link to reset the password."
+	ctx := r.Context()
+	link, err := env.publicURL("/reset/?token=")
+	if err != nil {
+		log.Printf("not sending a password reset link: %v", err)
+		return sent, nil
+	}
+
+	if normalized, err := models.NormalizeEmail(email); err == nil {
+		email = normalized
+	}
+	now := time.Now()
+	addressKey, ipKey := models.ResetKey(email), models.ResetIPKey(env.clientIP(r))
+	attempts, err := env.logins.GetAttempts(ctx, addressKey, ipKey)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range attempts {
+		if a.BlockedUntil.After(now) {
+			return "Too many password reset requests. Please try again later.", nil
+		}
+	}
+	if _, err := env.logins.RecordFailure(ctx, addressKey, models.ResetAddressLimit, now); err != nil {
+		return "", err
+	}
+	if _, err := env.logins.RecordFailure(ctx, ipKey, models.ResetIPLimit, now); err != nil {
+		return "", err
+	}
+
+	user, token, err := env.users.BeginPasswordReset(ctx, email)
+	if err == mongo.ErrNoDocuments {
+		return sent, nil
+	} else if err != nil {
+		return "", err
+	}
+	link += url.QueryEscape(token)
+	go func() {
+		err := env.sendMail(context.Background(), "reset", user, link, models.PasswordResetLifetime)
+		if err != nil {
+			log.Printf("sending password reset email to %s: %v", user.Username, err)
+		}
+	}()
+	return sent, nil
+}
+
+type resetData struct {
+	TemplateData
+	Token string
+}
+
+// ResetPassword shows the form to choose a new password for the token in a reset link, and
+// on POST sets it, signing the account out everywhere
+func (env *Env) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	td := resetData{
+		TemplateData: env.newTemplateData(r, false, ""),
+		Token:        r.FormValue("token"),
+	}
+
+	if r.Method == "POST" {
+		if r.FormValue("newpassword") != r.FormValue("confirmpassword") {
+			td.Flash = "New password and confirmation value do not match."
+		} else {
+			user, err := env.users.ResetPassword(r.Context(), td.Token, r.FormValue("newpassword"))
+			if err == models.ErrTokenInvalid {
+				td.Flash = "That link has expired or was already used. Ask for a new one."
+			} else if err != nil {
+				td.Flash = err.Error()
+			} else {
+				env.finishPasswordReset(w, r, user)
+				return
+			}
+		}
+	}
+
+	err := env.templates["reset"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// finishPasswordReset signs u out everywhere, lifts any lockout of their account
+// and sends them to sign in with the new password
+func (env *Env) finishPasswordReset(w http.ResponseWriter, r *http.Request, u models.User) {
+	ctx := r.Context()
+	err := env.sessions.RevokeAll(ctx, u.Username, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = env.logins.ClearFailures(ctx, models.AccountKey(u.Username))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	env.auditLog(ctx, models.AuditEntry{Event: models.AuditPasswordReset, Username: u.Username, IP: env.clientIP(r)})
+
+	clearSessionCookie(w, r)
+	td := env.newTemplateData(r, false, "Your password has been changed. Please sign in.")
+	err = env.templates["signin"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
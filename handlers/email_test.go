@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tydar/mdbssg/mailer"
+	"github.com/tydar/mdbssg/models"
+)
+
+// smtpSink is an SMTP server on a loopback address that keeps the messages it is sent
+type smtpSink struct {
+	addr     string
+	messages chan *mail.Message
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sink := &smtpSink{addr: ln.Addr().String(), messages: make(chan *mail.Message, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+// serve speaks just enough SMTP for mailer.SMTP to deliver a message
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(data))))
+			if err != nil {
+				tp.PrintfLine("554 %v", err)
+				continue
+			}
+			s.messages <- msg
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 %s not implemented", cmd)
+		}
+	}
+}
+
+// next returns the recipient of the next message delivered and the link in its body
+func (s *smtpSink) next(t *testing.T) (string, string) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := regexp.MustCompile(`https?://\S+`).FindString(string(body))
+		if link == "" {
+			t.Fatalf("no link in message:\n%s", body)
+		}
+		return msg.Header.Get("To"), link
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was delivered")
+		return "", ""
+	}
+}
+
+// linkToken returns the token in an emailed link to path
+func linkToken(t *testing.T, link, path string) string {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil || u.Path != path || u.Query().Get("token") == "" {
+		t.Fatalf("link %q is not a link to %s with a token", link, path)
+	}
+	return u.Query().Get("token")
+}
+
+type emailEnv struct {
+	*Env
+	users    *memUsers
+	sessions *memSessions
+	logins   *memLogins
+	audit    *memAudit
+	sink     *smtpSink
+}
+
+const testBaseURL = "https://blog.example"
+
+func newEmailEnv(t *testing.T, alice models.User) emailEnv {
+	mailTemplates, err := mailer.ParseTemplates("../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := emailEnv{
+		users:    newMemUsers(alice),
+		sessions: &memSessions{},
+		logins:   &memLogins{},
+		audit:    &memAudit{},
+		sink:     newSMTPSink(t),
+	}
+	e.Env = newTestEnv(EnvConfig{
+		Users:         e.users,
+		Sessions:      e.sessions,
+		Logins:        e.logins,
+		Audit:         e.audit,
+		Mail:          mailer.NewSMTP(e.sink.addr, "", "", "MDBSSG <blog@blog.example>"),
+		MailTemplates: mailTemplates,
+		Templates:     flashTemplates("changepwd", "signin", "forgot", "reset"),
+		BaseURL:       testBaseURL,
+	})
+	return e
+}
+
+// flash runs handler for r and returns the page, which the test templates make the flash message
+func flash(t *testing.T, handler http.HandlerFunc, r *http.Request) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", r.Method, r.URL, w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+func formRequest(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// sendVerificationLink asks for a verification link for alice from the account page and returns its token
+func (e emailEnv) sendVerificationLink(t *testing.T) string {
+	t.Helper()
+	email := func(w http.ResponseWriter, r *http.Request) {
+		e.Email(w, r, AuthUser{user: e.users.get("alice")})
+	}
+	got := flash(t, email, formRequest("/email/", url.Values{"action": {"resend"}}))
+	if !strings.Contains(got, "We sent a confirmation link to alice@blog.example") {
+		t.Fatalf("flash = %q, want the link to be sent", got)
+	}
+	to, link := e.sink.next(t)
+	if to != "<alice@blog.example>" {
+		t.Errorf("message sent to %q, want alice", to)
+	}
+	if !strings.HasPrefix(link, testBaseURL+"/") {
+		t.Errorf("link %q is not on %s", link, testBaseURL)
+	}
+	return linkToken(t, link, "/verify/")
+}
+
+func TestEmailVerification(t *testing.T) {
+	e := newEmailEnv(t, models.User{Username: "alice", Email: "alice@blog.example"})
+	old := e.sendVerificationLink(t)
+	token := e.sendVerificationLink(t)
+
+	got := flash(t, e.VerifyEmail, httptest.NewRequest("GET", "/verify/?token="+url.QueryEscape(old), nil))
+	if !strings.Contains(got, "That link has expired or was already used") {
+		t.Errorf("flash = %q, want the link replaced by the newer one to be refused", got)
+	}
+
+	got = flash(t, e.VerifyEmail, httptest.NewRequest("GET", "/verify/?token="+url.QueryEscape(token), nil))
+	if got != "Your email address is confirmed." {
+		t.Errorf("flash = %q, want the address confirmed", got)
+	}
+	if !e.users.get("alice").EmailVerified {
+		t.Error("alice's address was not verified")
+	}
+
+	got = flash(t, e.VerifyEmail, httptest.NewRequest("GET", "/verify/?token="+url.QueryEscape(token), nil))
+	if !strings.Contains(got, "That link has expired or was already used") {
+		t.Errorf("flash = %q, want the used link to be refused", got)
+	}
+}
+
+func TestEmailVerificationExpired(t *testing.T) {
+	e := newEmailEnv(t, models.User{Username: "alice", Email: "alice@blog.example"})
+	token := e.sendVerificationLink(t)
+	e.users.expireLinks("alice")
+
+	got := flash(t, e.VerifyEmail, httptest.NewRequest("GET", "/verify/?token="+url.QueryEscape(token), nil))
+	if !strings.Contains(got, "That link has expired or was already used") {
+		t.Errorf("flash = %q, want the expired link to be refused", got)
+	}
+	if e.users.get("alice").EmailVerified {
+		t.Error("an expired link verified the address")
+	}
+}
+
+const forgotFlash = "If an account has that confirmed email address, we sent it a link to reset the password."
+
+// sendResetLink asks for a password reset link for alice and returns its token
+func (e emailEnv) sendResetLink(t *testing.T) string {
+	t.Helper()
+	got := flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {" Alice@Blog.Example "}}))
+	if got != forgotFlash {
+		t.Fatalf("flash = %q, want %q", got, forgotFlash)
+	}
+	to, link := e.sink.next(t)
+	if to != "<alice@blog.example>" {
+		t.Errorf("message sent to %q, want alice", to)
+	}
+	return linkToken(t, link, "/reset/")
+}
+
+func verifiedAlice(t *testing.T) models.User {
+	hashed, err := models.DefaultArgon2Params().Hash("old password 4 alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.User{Username: "alice", PasswordHashed: hashed, Email: "alice@blog.example", EmailVerified: true}
+}
+
+func TestPasswordReset(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	e.sessions.Create(context.Background(), models.Session{Username: "alice"})
+	token := e.sendResetLink(t)
+
+	// a mistyped confirmation does not use up the link
+	got := flash(t, e.ResetPassword, formRequest("/reset/", url.Values{
+		"token": {token}, "newpassword": {"Quiet lantern 58 harbor"}, "confirmpassword": {"Quiet lantern 58 harbour"},
+	}))
+	if got != "New password and confirmation value do not match." {
+		t.Errorf("flash = %q, want the mismatch reported", got)
+	}
+
+	reset := url.Values{"token": {token}, "newpassword": {"Quiet lantern 58 harbor"}, "confirmpassword": {"Quiet lantern 58 harbor"}}
+	got = flash(t, e.ResetPassword, formRequest("/reset/", reset))
+	if got != "Your password has been changed. Please sign in." {
+		t.Fatalf("flash = %q, want the password changed", got)
+	}
+	alice := e.users.get("alice")
+	if !models.CheckPassword(alice, "Quiet lantern 58 harbor") || models.CheckPassword(alice, "old password 4 alice") {
+		t.Error("the password was not changed")
+	}
+	if n := len(e.sessions.started(t)); n != 0 {
+		t.Errorf("%d sessions left, want alice signed out everywhere", n)
+	}
+	if len(e.logins.cleared) != 1 || e.logins.cleared[0] != models.AccountKey("alice") {
+		t.Errorf("cleared failures for %v, want alice's account", e.logins.cleared)
+	}
+	if len(e.audit.entries) != 1 || e.audit.entries[0].Event != models.AuditPasswordReset {
+		t.Errorf("audit log = %+v, want the reset recorded", e.audit.entries)
+	}
+
+	// the link works once
+	reset.Set("newpassword", "Another lantern 91 pier")
+	reset.Set("confirmpassword", "Another lantern 91 pier")
+	got = flash(t, e.ResetPassword, formRequest("/reset/", reset))
+	if !strings.Contains(got, "That link has expired or was already used") {
+		t.Errorf("flash = %q, want the used link to be refused", got)
+	}
+	if !models.CheckPassword(e.users.get("alice"), "Quiet lantern 58 harbor") {
+		t.Error("a used link changed the password again")
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	token := e.sendResetLink(t)
+	e.users.expireLinks("alice")
+
+	got := flash(t, e.ResetPassword, formRequest("/reset/", url.Values{
+		"token": {token}, "newpassword": {"Quiet lantern 58 harbor"}, "confirmpassword": {"Quiet lantern 58 harbor"},
+	}))
+	if !strings.Contains(got, "That link has expired or was already used") {
+		t.Errorf("flash = %q, want the expired link to be refused", got)
+	}
+	if !models.CheckPassword(e.users.get("alice"), "old password 4 alice") {
+		t.Error("an expired link changed the password")
+	}
+}
+
+func TestPasswordResetUnconfirmedAddress(t *testing.T) {
+	alice := verifiedAlice(t)
+	alice.EmailVerified = false
+	e := newEmailEnv(t, alice)
+
+	for _, address := range []string{"alice@blog.example", "nobody@blog.example", "not an address"} {
+		got := flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {address}}))
+		if got != forgotFlash {
+			t.Errorf("%s: flash = %q, want %q", address, got, forgotFlash)
+		}
+	}
+	select {
+	case msg := <-e.sink.messages:
+		t.Errorf("a reset link was sent to %s", msg.Header.Get("To"))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEmailedLinksIgnoreHost(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	r := formRequest("/forgot/", url.Values{"email": {"alice@blog.example"}})
+	r.Host = "evil.example"
+	if got := flash(t, e.ForgotPassword, r); got != forgotFlash {
+		t.Fatalf("flash = %q, want %q", got, forgotFlash)
+	}
+	if _, link := e.sink.next(t); !strings.HasPrefix(link, testBaseURL+"/reset/?token=") {
+		t.Errorf("reset link %q, want it on %s whatever the Host header", link, testBaseURL)
+	}
+
+	e = newEmailEnv(t, models.User{Username: "alice", Email: "alice@blog.example"})
+	r = formRequest("/email/", url.Values{"action": {"resend"}})
+	r.Host = "evil.example"
+	flash(t, func(w http.ResponseWriter, r *http.Request) {
+		e.Email(w, r, AuthUser{user: e.users.get("alice")})
+	}, r)
+	if _, link := e.sink.next(t); !strings.HasPrefix(link, testBaseURL+"/verify/?token=") {
+		t.Errorf("verification link %q, want it on %s whatever the Host header", link, testBaseURL)
+	}
+}
+
+func TestNoLinksWithoutBaseURL(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	e.baseURL = ""
+	if got := flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {"alice@blog.example"}})); got != forgotFlash {
+		t.Errorf("flash = %q, want %q", got, forgotFlash)
+	}
+	select {
+	case msg := <-e.sink.messages:
+		t.Errorf("a reset link was sent to %s without a base URL", msg.Header.Get("To"))
+	case <-time.After(200 * time.Millisecond):
+	}
+	if e.users.get("alice").PasswordReset != nil {
+		t.Error("a reset was started without a base URL")
+	}
+}
+
+func TestPasswordResetRateLimit(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	for i := 0; i < models.ResetAddressLimit; i++ {
+		e.sendResetLink(t)
+	}
+
+	got := flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {"ALICE@blog.example"}}))
+	if !strings.Contains(got, "Too many password reset requests") {
+		t.Errorf("flash = %q, want the request refused", got)
+	}
+	// other addresses are limited per IP only
+	got = flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {"bob@blog.example"}}))
+	if got != forgotFlash {
+		t.Errorf("flash = %q, want %q", got, forgotFlash)
+	}
+	select {
+	case msg := <-e.sink.messages:
+		t.Errorf("a reset link was sent to %s over the limit", msg.Header.Get("To"))
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	for i := models.ResetAddressLimit + 1; i < models.ResetIPLimit; i++ {
+		flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {fmt.Sprintf("user%d@blog.example", i)}}))
+	}
+	got = flash(t, e.ForgotPassword, formRequest("/forgot/", url.Values{"email": {"carol@blog.example"}}))
+	if !strings.Contains(got, "Too many password reset requests") {
+		t.Errorf("flash = %q, want requests from the IP refused", got)
+	}
+}
+
+func TestEmailChangeIsThrottled(t *testing.T) {
+	e := newEmailEnv(t, verifiedAlice(t))
+	change := func(password string) string {
+		t.Helper()
+		return flash(t, func(w http.ResponseWriter, r *http.Request) {
+			e.Email(w, r, AuthUser{user: e.users.get("alice")})
+		}, formRequest("/email/", url.Values{"action": {"change"}, "email": {"mallory@evil.example"}, "password": {password}}))
+	}
+
+	for i := 0; i < models.AccountLockoutAttempts; i++ {
+		if got := change("wrong password"); got != "Current password incorrect." {
+			t.Fatalf("attempt %d: flash = %q, want the password refused", i+1, got)
+		}
+	}
+	if got := change("old password 4 alice"); !strings.HasPrefix(got, "Too many failed sign in attempts") {
+		t.Errorf("flash = %q, want the locked account refused", got)
+	}
+	if email := e.users.get("alice").Email; email != "alice@blog.example" {
+		t.Errorf("address changed to %s while the account was locked", email)
+	}
+}
@@ -3,29 +3,81 @@ package handlers
 import (
 	"context"
 	"html/template"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tydar/mdbssg/host"
+	"github.com/tydar/mdbssg/mailer"
 	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/shortcodes"
+	"github.com/tydar/mdbssg/themes"
 )
 
 // Env wraps interfaces that describe the DB actions required by http handlers
 // as well as template information.
 // following the pattern from https://www.alexedwards.net/blog/organising-database-access
 type Env struct {
-	users     Users
-	posts     Posts
-	theHost   host.Host
-	templates map[string]*template.Template
+	users      Users
+	posts      Posts
+	sites      Sites
+	overrides  Overrides
+	media      Media
+	webhooks   Webhooks
+	events     Events
+	logins     Logins
+	audit      Audit
+	ceremonies Ceremonies
+	sessions   Sessions
+	mail       mailer.Mailer
+	mailTmpl   *mailer.Templates
+	theHost    host.Host
+	themes     *themes.Registry
+	shortcodes *shortcodes.Registry
+	templates  map[string]*template.Template
+	// sessionKeys sign session cookies, the first one signing new cookies
+	sessionKeys [][]byte
+	baseURL     string
+	// webAuthnOrigin is the origin passkeys are registered for
+	webAuthnOrigin    string
+	trustProxyHeaders bool
+	sso               *OIDC
+	hashParams        models.Argon2Params
+	dummyHashOnce     sync.Once
+	dummyHash         []byte
 }
 
-// Users interface describes the set of behaviors that need to be available for user record & session management
+// Users interface describes the set of behaviors that need to be available for user record management
 type Users interface {
-	CreateUser(context context.Context, username, password, display string) error
+	CreateUser(context context.Context, username, password, display, email string) error
 	GetByUsername(context context.Context, username string) (models.User, error)
-	AppendNewSession(context context.Context, username string) (string, error)
-	CheckSessionValid(context context.Context, username, token string) bool
 	UpdatePassword(context context.Context, username, password string) error
-	InvalidateSession(context context.Context, username, token string) error
+	RehashPassword(context context.Context, user models.User, password string) error
+	CreateToken(ctx context.Context, username, name string, scopes []string, expiresAt time.Time) (string, models.APIToken, error)
+	RevokeToken(ctx context.Context, username, id string) error
+	GetByToken(ctx context.Context, token string) (models.User, models.APIToken, error)
+	BeginTOTP(ctx context.Context, username, secret string) error
+	EnableTOTP(ctx context.Context, user models.User, code string, recoveryHashes []string) error
+	DisableTOTP(ctx context.Context, username string) error
+	SetRecoveryCodes(ctx context.Context, username string, recoveryHashes []string) error
+	CheckSecondFactor(ctx context.Context, user models.User, code string) error
+	BeginMFAChallenge(ctx context.Context, username string, remember bool) (string, error)
+	GetByMFAChallenge(ctx context.Context, token string) (models.User, error)
+	EndMFAChallenge(ctx context.Context, username string) error
+	AddPasskey(ctx context.Context, username string, webauthnID []byte, pk models.Passkey) error
+	RemovePasskey(ctx context.Context, username, id string) error
+	GetByWebAuthnID(ctx context.Context, webauthnID []byte) (models.User, error)
+	UpdatePasskeyUse(ctx context.Context, username string, credentialID []byte, signCount uint32) error
+	SetEmail(ctx context.Context, username, email string) error
+	BeginEmailVerification(ctx context.Context, username string) (string, error)
+	VerifyEmail(ctx context.Context, token string) (models.User, error)
+	BeginPasswordReset(ctx context.Context, email string) (models.User, string, error)
+	ResetPassword(ctx context.Context, token, password string) (models.User, error)
+	GetByVerifiedEmail(ctx context.Context, email string) (models.User, error)
+	GetByIdentity(ctx context.Context, issuer, subject string) (models.User, error)
+	LinkIdentity(ctx context.Context, username string, id models.Identity) error
+	UnlinkIdentity(ctx context.Context, username, issuer, subject string) error
+	ProvisionUser(ctx context.Context, preferred, display, email string, id models.Identity) (models.User, error)
 }
 
 type Posts interface {
@@ -33,13 +85,148 @@ type Posts interface {
 	GetByUsername(ctx context.Context, username string) ([]models.Post, error)
 	Create(ctx context.Context, post models.Post) error
 	Update(ctx context.Context, post models.Post) error
+	Delete(ctx context.Context, slug string) error
 }
 
-func NewEnv(users Users, posts Posts, templates map[string]*template.Template, theHost host.Host) *Env {
+// Sites interface describes the behaviors needed to read and store per-user site settings
+type Sites interface {
+	GetByUsername(ctx context.Context, username string) (models.Site, error)
+	Save(ctx context.Context, site models.Site) error
+}
+
+// Overrides interface describes the behaviors needed to manage user-edited theme templates
+type Overrides interface {
+	GetByUsername(ctx context.Context, username string) ([]models.TemplateOverride, error)
+	Save(ctx context.Context, override models.TemplateOverride) error
+	Delete(ctx context.Context, username, name string) error
+}
+
+// Media interface describes the behaviors needed to store images and other files used by posts
+type Media interface {
+	Save(ctx context.Context, media models.Media) error
+	Get(ctx context.Context, username, name string) (models.Media, error)
+	GetByUsername(ctx context.Context, username string) ([]models.Media, error)
+	Delete(ctx context.Context, username, name string) error
+}
+
+// Webhooks interface describes the behaviors needed to manage webhooks and show their delivery log
+type Webhooks interface {
+	GetByUsername(ctx context.Context, username string) ([]models.Webhook, error)
+	Get(ctx context.Context, id string) (models.Webhook, error)
+	Save(ctx context.Context, hook models.Webhook) error
+	Delete(ctx context.Context, username, id string) error
+	GetDeliveries(ctx context.Context, username string, limit int) ([]models.Delivery, error)
+}
+
+// Events interface describes how handlers queue webhook notifications
+type Events interface {
+	Emit(ctx context.Context, username, event string, data interface{})
+	Enqueue(ctx context.Context, hook models.Webhook, event string, data interface{}) (models.Delivery, error)
+}
+
+// Logins interface describes the behaviors needed to throttle repeated failed sign ins and lock out accounts and IPs
+type Logins interface {
+	GetAttempts(ctx context.Context, keys ...string) ([]models.LoginAttempts, error)
+	RecordFailure(ctx context.Context, key string, lockoutAt int, now time.Time) (models.LoginAttempts, error)
+	ClearFailures(ctx context.Context, key string) error
+	GetLocked(ctx context.Context, now time.Time) ([]models.LoginAttempts, error)
+	Unlock(ctx context.Context, key string) error
+}
+
+// Audit interface describes the behaviors needed to record and review security events
+type Audit interface {
+	Record(ctx context.Context, entry models.AuditEntry) error
+	GetRecent(ctx context.Context, limit int) ([]models.AuditEntry, error)
+}
+
+// Ceremonies interface describes the behaviors needed to keep WebAuthn challenges between requests
+type Ceremonies interface {
+	Begin(ctx context.Context, c models.Ceremony) (string, error)
+	Finish(ctx context.Context, token, kind string) (models.Ceremony, error)
+}
+
+// Sessions interface describes the behaviors needed to sign browsers in and out
+type Sessions interface {
+	Create(ctx context.Context, session models.Session) (models.Session, error)
+	Check(ctx context.Context, id, token string) (models.Session, error)
+	Delete(ctx context.Context, token string) error
+	GetByUsername(ctx context.Context, username string) ([]models.Session, error)
+	Revoke(ctx context.Context, username, id string) error
+	RevokeAll(ctx context.Context, username, keepToken string) error
+}
+
+// EnvConfig holds the stores, templates and registries handlers use
+type EnvConfig struct {
+	Users      Users
+	Posts      Posts
+	Sites      Sites
+	Overrides  Overrides
+	Media      Media
+	Webhooks   Webhooks
+	Events     Events
+	Logins     Logins
+	Audit      Audit
+	Ceremonies Ceremonies
+	Sessions   Sessions
+	Mail       mailer.Mailer
+	// MailTemplates renders the messages sent with Mail
+	MailTemplates *mailer.Templates
+	Templates     map[string]*template.Template
+	Host          host.Host
+	Themes        *themes.Registry
+	Shortcodes    *shortcodes.Registry
+	// SessionKeys sign session cookies and must not be empty. The first key signs new cookies
+	// and every key is accepted, so a key can be rotated by putting a new one first and dropping
+	// the old one once the sessions signed with it have expired
+	SessionKeys [][]byte
+	// BaseURL is the address the site is reached at, such as https://blog.example.com,
+	// used for links that leave the site. Links are never built from the request's Host
+	// header, which the client controls, so no email is sent if it is empty
+	BaseURL string
+	// WebAuthnOrigin is the origin (scheme://host[:port]) passkeys are registered for,
+	// BaseURL if it is empty. Passkeys cannot be used without either
+	WebAuthnOrigin string
+	// TrustProxyHeaders makes the client IP used for sign in throttling and the audit log come
+	// from the X-Forwarded-For header; set it only when running behind a proxy that sets the header
+	TrustProxyHeaders bool
+	// SingleSignOn is the OpenID Connect provider users can sign in with, or nil if there is none
+	SingleSignOn *OIDC
+	// PasswordHashParams are the parameters the user model hashes passwords with, defaulting to
+	// models.DefaultArgon2Params. Older hashes are replaced at sign in
+	PasswordHashParams models.Argon2Params
+}
+
+// NewEnv wraps cfg.Posts so that creating, updating and deleting a post emits webhook events
+func NewEnv(cfg EnvConfig) *Env {
+	if cfg.PasswordHashParams == (models.Argon2Params{}) {
+		cfg.PasswordHashParams = models.DefaultArgon2Params()
+	}
+	if cfg.WebAuthnOrigin == "" {
+		cfg.WebAuthnOrigin = cfg.BaseURL
+	}
 	return &Env{
-		users:     users,
-		posts:     posts,
-		templates: templates,
-		theHost:   theHost,
+		users:             cfg.Users,
+		posts:             &notifyingPosts{Posts: cfg.Posts, events: cfg.Events},
+		sites:             cfg.Sites,
+		overrides:         cfg.Overrides,
+		media:             cfg.Media,
+		webhooks:          cfg.Webhooks,
+		events:            cfg.Events,
+		logins:            cfg.Logins,
+		audit:             cfg.Audit,
+		ceremonies:        cfg.Ceremonies,
+		sessions:          cfg.Sessions,
+		mail:              cfg.Mail,
+		mailTmpl:          cfg.MailTemplates,
+		templates:         cfg.Templates,
+		theHost:           cfg.Host,
+		themes:            cfg.Themes,
+		shortcodes:        cfg.Shortcodes,
+		sessionKeys:       cfg.SessionKeys,
+		baseURL:           strings.TrimSuffix(cfg.BaseURL, "/"),
+		webAuthnOrigin:    strings.TrimSuffix(cfg.WebAuthnOrigin, "/"),
+		trustProxyHeaders: cfg.TrustProxyHeaders,
+		sso:               cfg.SingleSignOn,
+		hashParams:        cfg.PasswordHashParams,
 	}
 }
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memUsers is an in-memory Users holding the accounts by username.
+// Only the methods the tests use are implemented
+type memUsers struct {
+	Users
+	mu    sync.Mutex
+	users map[string]models.User
+}
+
+func newMemUsers(users ...models.User) *memUsers {
+	m := &memUsers{users: map[string]models.User{}}
+	for _, u := range users {
+		m.users[u.Username] = u
+	}
+	return m
+}
+
+func (m *memUsers) get(username string) models.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users[username]
+}
+
+func (m *memUsers) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[username]
+	if !ok {
+		return models.User{}, mongo.ErrNoDocuments
+	}
+	return u, nil
+}
+
+func (m *memUsers) AddPasskey(ctx context.Context, username string, webauthnID []byte, pk models.Passkey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.TrimSpace(pk.Name) == "" {
+		return errors.New("passkey name is required")
+	}
+	u, ok := m.users[username]
+	if !ok || (u.WebAuthnID != nil && !bytes.Equal(u.WebAuthnID, webauthnID)) {
+		return mongo.ErrNoDocuments
+	}
+	u.WebAuthnID = webauthnID
+	u.Passkeys = append(u.Passkeys, pk)
+	m.users[username] = u
+	return nil
+}
+
+func (m *memUsers) GetByWebAuthnID(ctx context.Context, webauthnID []byte) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.WebAuthnID != nil && bytes.Equal(u.WebAuthnID, webauthnID) {
+			return u, nil
+		}
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memUsers) UpdatePasskeyUse(ctx context.Context, username string, credentialID []byte, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[username]
+	for i := range u.Passkeys {
+		if bytes.Equal(u.Passkeys[i].CredentialID, credentialID) {
+			u.Passkeys[i].SignCount = signCount
+			u.Passkeys[i].LastUsedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *memUsers) GetByIdentity(ctx context.Context, issuer, subject string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byIdentity(issuer, subject)
+}
+
+func (m *memUsers) byIdentity(issuer, subject string) (models.User, error) {
+	for _, u := range m.users {
+		for _, id := range u.Identities {
+			if id.Issuer == issuer && id.Subject == subject {
+				return u, nil
+			}
+		}
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memUsers) GetByVerifiedEmail(ctx context.Context, email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Email == email && u.EmailVerified {
+			return u, nil
+		}
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memUsers) LinkIdentity(ctx context.Context, username string, id models.Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	other, err := m.byIdentity(id.Issuer, id.Subject)
+	if err == nil && other.Username != username {
+		return models.ErrIdentityLinked
+	} else if err == nil {
+		return nil
+	}
+	u := m.users[username]
+	id.LinkedAt = time.Now()
+	u.Identities = append(u.Identities, id)
+	m.users[username] = u
+	return nil
+}
+
+// newToken returns a random token like those the models put in links
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// validToken reports whether et is unexpired and was issued for token. The fake keeps
+// the token itself where the model keeps its hash
+func validToken(et *models.EmailToken, token string) bool {
+	return et != nil && et.Hash == token && et.ExpiresAt.After(time.Now())
+}
+
+func (m *memUsers) BeginEmailVerification(ctx context.Context, username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[username]
+	token := newToken()
+	u.EmailVerification = &models.EmailToken{Hash: token, ExpiresAt: time.Now().Add(models.EmailVerificationLifetime)}
+	m.users[username] = u
+	return token, nil
+}
+
+func (m *memUsers) VerifyEmail(ctx context.Context, token string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, u := range m.users {
+		if validToken(u.EmailVerification, token) {
+			u.EmailVerified = true
+			u.EmailVerification = nil
+			m.users[name] = u
+			return u, nil
+		}
+	}
+	return models.User{}, models.ErrTokenInvalid
+}
+
+func (m *memUsers) BeginPasswordReset(ctx context.Context, email string) (models.User, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email, err := models.NormalizeEmail(email)
+	if err != nil {
+		return models.User{}, "", mongo.ErrNoDocuments
+	}
+	for name, u := range m.users {
+		if u.Email == email && u.EmailVerified {
+			token := newToken()
+			u.PasswordReset = &models.EmailToken{Hash: token, ExpiresAt: time.Now().Add(models.PasswordResetLifetime)}
+			m.users[name] = u
+			return u, token, nil
+		}
+	}
+	return models.User{}, "", mongo.ErrNoDocuments
+}
+
+func (m *memUsers) ResetPassword(ctx context.Context, token, password string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, u := range m.users {
+		if !validToken(u.PasswordReset, token) {
+			continue
+		}
+		if err := models.DefaultPasswordPolicy().Check(u.Username, password); err != nil {
+			return models.User{}, err
+		}
+		hashed, err := models.DefaultArgon2Params().Hash(password)
+		if err != nil {
+			return models.User{}, err
+		}
+		u.PasswordHashed = hashed
+		u.PasswordReset = nil
+		m.users[name] = u
+		return u, nil
+	}
+	return models.User{}, models.ErrTokenInvalid
+}
+
+func (m *memUsers) RehashPassword(ctx context.Context, user models.User, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[user.Username]
+	if !bytes.Equal(u.PasswordHashed, user.PasswordHashed) {
+		return nil
+	}
+	hashed, err := models.DefaultArgon2Params().Hash(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHashed = hashed
+	m.users[user.Username] = u
+	return nil
+}
+
+func (m *memUsers) SetRecoveryCodes(ctx context.Context, username string, recoveryHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[username]
+	u.TwoFactor.RecoveryCodes = recoveryHashes
+	m.users[username] = u
+	return nil
+}
+
+// expireLinks makes the links last sent to username out of date
+func (m *memUsers) expireLinks(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[username]
+	for _, et := range []*models.EmailToken{u.EmailVerification, u.PasswordReset} {
+		if et != nil {
+			et.ExpiresAt = time.Now().Add(-time.Second)
+		}
+	}
+}
+
+// memCeremonies is an in-memory Ceremonies where, as in the model, each ceremony can only be finished once
+type memCeremonies struct {
+	mu         sync.Mutex
+	next       int
+	ceremonies map[string]models.Ceremony
+}
+
+func (m *memCeremonies) Begin(ctx context.Context, c models.Ceremony) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ceremonies == nil {
+		m.ceremonies = map[string]models.Ceremony{}
+	}
+	m.next++
+	token := strings.Repeat("c", m.next)
+	m.ceremonies[token] = c
+	return token, nil
+}
+
+func (m *memCeremonies) Finish(ctx context.Context, token, kind string) (models.Ceremony, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.ceremonies[token]
+	if !ok || c.Kind != kind {
+		return models.Ceremony{}, models.ErrTokenInvalid
+	}
+	delete(m.ceremonies, token)
+	return c, nil
+}
+
+// memSessions is an in-memory Sessions recording the sessions started
+type memSessions struct {
+	Sessions
+	mu       sync.Mutex
+	sessions []models.Session
+}
+
+func (m *memSessions) Create(ctx context.Context, s models.Session) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.ID = strings.Repeat("s", len(m.sessions)+1)
+	s.Token = s.ID + "-token"
+	m.sessions = append(m.sessions, s)
+	return s, nil
+}
+
+func (m *memSessions) GetByUsername(ctx context.Context, username string) ([]models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []models.Session
+	for _, s := range m.sessions {
+		if s.Username == username {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *memSessions) RevokeAll(ctx context.Context, username, keepToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.sessions[:0]
+	for _, s := range m.sessions {
+		if s.Username != username || (keepToken != "" && s.Token == keepToken) {
+			kept = append(kept, s)
+		}
+	}
+	m.sessions = kept
+	return nil
+}
+
+func (m *memSessions) started(t *testing.T) []models.Session {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.Session(nil), m.sessions...)
+}
+
+// memLogins is an in-memory Logins recording which keys had their failures cleared.
+// Keys are blocked once they reach the lockout, without the delays before it
+type memLogins struct {
+	Logins
+	mu       sync.Mutex
+	cleared  []string
+	attempts map[string]models.LoginAttempts
+}
+
+func (m *memLogins) GetAttempts(ctx context.Context, keys ...string) ([]models.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var attempts []models.LoginAttempts
+	for _, k := range keys {
+		if a, ok := m.attempts[k]; ok {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+func (m *memLogins) RecordFailure(ctx context.Context, key string, lockoutAt int, now time.Time) (models.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.attempts == nil {
+		m.attempts = map[string]models.LoginAttempts{}
+	}
+	a := m.attempts[key]
+	a.Key = key
+	a.Failures++
+	a.LastFailure = now
+	if a.Failures >= lockoutAt {
+		a.BlockedUntil = now.Add(models.LockoutDuration)
+		a.Locked = true
+	}
+	m.attempts[key] = a
+	return a, nil
+}
+
+func (m *memLogins) ClearFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleared = append(m.cleared, key)
+	delete(m.attempts, key)
+	return nil
+}
+
+// failures returns the failures counted against key
+func (m *memLogins) failures(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts[key].Failures
+}
+
+// memAudit is an in-memory Audit log
+type memAudit struct {
+	Audit
+	mu      sync.Mutex
+	entries []models.AuditEntry
+}
+
+func (m *memAudit) Record(ctx context.Context, entry models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+// flashTemplates returns page templates that only show the flash message, for each of names
+func flashTemplates(names ...string) map[string]*template.Template {
+	templates := make(map[string]*template.Template)
+	for _, name := range names {
+		templates[name] = template.Must(template.New("base").Parse("{{ .Flash }}"))
+	}
+	return templates
+}
+
+// serve runs handler for a request and returns the response
+func serve(handler http.HandlerFunc, r *http.Request) *http.Response {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Result()
+}
+
+// cookie returns the value of the cookie called name set by resp
+func cookie(resp *http.Response, name string) string {
+	for _, c := range resp.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// newTestEnv returns NewEnv(cfg) with the settings every test needs filled in
+func newTestEnv(cfg EnvConfig) *Env {
+	if cfg.SessionKeys == nil {
+		cfg.SessionKeys = [][]byte{[]byte("test session key")}
+	}
+	return NewEnv(cfg)
+}
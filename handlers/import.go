@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/tydar/mdbssg/importer"
+)
+
+// maxImportSize limits the size of uploaded Markdown files and archives
+const maxImportSize = 32 << 20
+
+type importResult struct {
+	Path     string
+	Title    string
+	Slug     string
+	Error    string
+	Skipped  string
+	Warnings []string
+}
+
+type importData struct {
+	TemplateData
+	Formats []string
+	Results []importResult
+	Created int
+}
+
+// Import handles GET requests to render the import form and POST requests that create posts from
+// pasted Markdown, an uploaded .md file, a WordPress export or a .zip of Markdown files or of
+// a Hugo or Jekyll site, reporting the outcome of each file
+func (env *Env) Import(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	td := importData{TemplateData: env.newTemplateData(r, true, ""), Formats: importer.Formats}
+
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		items, err := env.readImport(r, au.user.Username)
+		if err != nil {
+			td.Flash = err.Error()
+		} else {
+			td.Results, td.Created = env.createImported(r, au, items)
+			td.Flash = fmt.Sprintf("Imported %d of %d items.", td.Created, len(items))
+		}
+	}
+
+	err := env.templates["import"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// readImport parses the uploaded file or pasted content of an import form into posts
+func (env *Env) readImport(r *http.Request, username string) ([]importer.Item, error) {
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		return nil, err
+	}
+
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		content := r.FormValue("content")
+		if strings.TrimSpace(content) == "" {
+			return nil, fmt.Errorf("choose a file or paste Markdown to import")
+		}
+		post, err := importer.PostFromMarkdown([]byte(content), username)
+		return []importer.Item{{Path: "pasted content", Post: post, Err: err}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(header.Filename)) {
+	case ".xml":
+		return importer.WXR(bytes.NewReader(data), username, importer.HTTPFetch)
+	case ".zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", header.Filename, err)
+		}
+		return importer.Import(r.FormValue("format"), zr, username)
+	}
+
+	post, err := importer.PostFromMarkdown(data, username)
+	return []importer.Item{{Path: header.Filename, Post: post, Err: err}}, nil
+}
+
+// createImported stores each successfully parsed post and its media and reports the result of every item
+func (env *Env) createImported(r *http.Request, au AuthUser, items []importer.Item) ([]importResult, int) {
+	for i := range items {
+		if items[i].Post.Author == "" {
+			items[i].Post.Author = au.user.DisplayName
+		}
+	}
+	created := importer.Save(r.Context(), items, env.posts, env.media)
+
+	results := make([]importResult, len(items))
+	for i, item := range items {
+		results[i] = importResult{
+			Path:     item.Path,
+			Title:    item.Post.Title,
+			Slug:     item.Post.Slug,
+			Skipped:  item.Skipped,
+			Warnings: item.Warnings,
+		}
+		if item.Err != nil {
+			results[i].Error = item.Err.Error()
+		}
+	}
+	return results, created
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errBadLogin is returned for both unknown usernames and wrong passwords so that
+// sign in does not reveal which accounts exist
+var errBadLogin = errors.New("Incorrect username or password.")
+
+// getDummyHash returns the hash checked against when the username does not exist, so that
+// failed sign ins take as long whether or not the account exists. It is made on first use
+// with the configured hashing parameters
+func (env *Env) getDummyHash() []byte {
+	env.dummyHashOnce.Do(func() {
+		hash, err := env.hashParams.Hash("not the password of any user")
+		if err != nil {
+			log.Printf("hashing dummy password: %v", err)
+		}
+		env.dummyHash = hash
+	})
+	return env.dummyHash
+}
+
+// loginBlockedError is returned while sign in is blocked after repeated failures
+type loginBlockedError struct {
+	until time.Time
+}
+
+func (e loginBlockedError) Error() string {
+	wait := time.Until(e.until).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("Too many failed sign in attempts. Try again in %s.", wait)
+}
+
+// clientIP returns the IP address sign in attempts are counted against
+func (env *Env) clientIP(r *http.Request) string {
+	if env.trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// proxies append the address they received the request from
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLogin checks username and password, throttling repeated failures per account and per client IP.
+// It returns errBadLogin or a loginBlockedError when sign in should be refused
+func (env *Env) checkLogin(r *http.Request, username, password string) (models.User, error) {
+	ctx := r.Context()
+	now := time.Now()
+	ip := env.clientIP(r)
+
+	if err := env.loginBlocked(ctx, username, ip, now); err != nil {
+		return models.User{}, err
+	}
+
+	user, err := env.users.GetByUsername(ctx, username)
+	if err == mongo.ErrNoDocuments {
+		models.CheckPassword(models.User{PasswordHashed: env.getDummyHash()}, password)
+	} else if err != nil {
+		return models.User{}, err
+	} else if models.CheckPassword(user, password) {
+		if env.hashParams.NeedsRehash(user.PasswordHashed) {
+			// upgrade bcrypt hashes and old parameters now that the password is known
+			if err := env.users.RehashPassword(ctx, user, password); err != nil {
+				log.Printf("rehashing password for %s: %v", username, err)
+			}
+		}
+		if user.TwoFactor.Enabled() {
+			// failures are only cleared once the second factor is checked too
+			return user, nil
+		}
+		err := env.logins.ClearFailures(ctx, models.AccountKey(username))
+		return user, err
+	}
+
+	env.recordLoginFailure(ctx, username, ip, now)
+	return models.User{}, errBadLogin
+}
+
+// recheckPassword checks the signed in user's password before a sensitive change. It is
+// throttled and counted like sign in, so that a stolen session cannot be used to guess the
+// password. It returns the message to show when the password is refused
+func (env *Env) recheckPassword(r *http.Request, username, password string) (string, error) {
+	_, err := env.checkLogin(r, username, password)
+	if err == errBadLogin {
+		return "Current password incorrect.", nil
+	} else if _, ok := err.(loginBlockedError); ok {
+		return err.Error(), nil
+	}
+	return "", err
+}
+
+// loginBlocked returns a loginBlockedError if sign in for username from ip is blocked at now
+func (env *Env) loginBlocked(ctx context.Context, username, ip string, now time.Time) error {
+	attempts, err := env.logins.GetAttempts(ctx, models.AccountKey(username), models.IPKey(ip))
+	if err != nil {
+		return err
+	}
+	for _, a := range attempts {
+		if a.BlockedUntil.After(now) {
+			return loginBlockedError{until: a.BlockedUntil}
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed sign in against the account and the IP,
+// adding an audit entry when either is locked out. Errors are logged rather than
+// returned so that the caller can still answer with the uniform message
+func (env *Env) recordLoginFailure(ctx context.Context, username, ip string, now time.Time) {
+	a, err := env.logins.RecordFailure(ctx, models.AccountKey(username), models.AccountLockoutAttempts, now)
+	if err != nil {
+		log.Printf("recording failed sign in for %s: %v", username, err)
+	} else if a.Failures == models.AccountLockoutAttempts {
+		env.auditLog(ctx, models.AuditEntry{
+			Event:    models.AuditAccountLocked,
+			Username: username,
+			IP:       ip,
+			Detail:   fmt.Sprintf("%d failed sign in attempts", a.Failures),
+		})
+	}
+
+	a, err = env.logins.RecordFailure(ctx, models.IPKey(ip), models.IPLockoutAttempts, now)
+	if err != nil {
+		log.Printf("recording failed sign in from %s: %v", ip, err)
+	} else if a.Failures == models.IPLockoutAttempts {
+		env.auditLog(ctx, models.AuditEntry{
+			Event:  models.AuditIPLocked,
+			IP:     ip,
+			Detail: fmt.Sprintf("%d failed sign in attempts, the last for %s", a.Failures, username),
+		})
+	}
+}
+
+// auditLog records entry, logging any error
+func (env *Env) auditLog(ctx context.Context, entry models.AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	log.Printf("audit: %s username=%q ip=%q actor=%q %s", entry.Event, entry.Username, entry.IP, entry.Actor, entry.Detail)
+	if err := env.audit.Record(ctx, entry); err != nil {
+		log.Printf("audit: recording %s: %v", entry.Event, err)
+	}
+}
+
+// auditLogSize is the number of recent audit entries shown on the admin page
+const auditLogSize = 100
+
+type adminData struct {
+	TemplateData
+	Locked []models.LoginAttempts
+	Audit  []models.AuditEntry
+}
+
+// Admin shows admins the locked out accounts and IPs and the audit log, and on POST
+// with action=unlock lifts the lockout of the given key
+func (env *Env) Admin(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if !au.user.Admin {
+		env.renderError(w, r, http.StatusForbidden, "Not allowed", "Only admins can see this page.")
+		return
+	}
+
+	flash := ""
+	if r.Method == "POST" && r.FormValue("action") == "unlock" {
+		key := r.FormValue("key")
+		err := env.logins.Unlock(r.Context(), key)
+		if err == mongo.ErrNoDocuments {
+			flash = "Nothing to unlock for " + key + "."
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else {
+			entry := models.AuditEntry{Event: models.AuditUnlocked, IP: env.clientIP(r), Actor: au.user.Username, Detail: key}
+			if strings.HasPrefix(key, models.AccountKey("")) {
+				entry.Username = strings.TrimPrefix(key, models.AccountKey(""))
+			}
+			env.auditLog(r.Context(), entry)
+			flash = "Unlocked " + key + "."
+		}
+	}
+
+	locked, err := env.logins.GetLocked(r.Context(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := env.audit.GetRecent(r.Context(), auditLogSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := adminData{
+		TemplateData: env.newTemplateData(r, true, flash),
+		Locked:       locked,
+		Audit:        entries,
+	}
+	err = env.templates["admin"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tydar/mdbssg/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSignInRehashesLegacyHash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Quiet lantern 58 harbor"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := newMemUsers(models.User{Username: "alice", PasswordHashed: legacy})
+	logins := &memLogins{}
+	env := newTestEnv(EnvConfig{Users: users, Logins: logins, Audit: &memAudit{}})
+	r := httptest.NewRequest("POST", "/signin/", nil)
+
+	if _, err := env.checkLogin(r, "alice", "Quiet lantern 58 harbour"); err != errBadLogin {
+		t.Fatalf("wrong password: err = %v, want %v", err, errBadLogin)
+	}
+	if string(users.get("alice").PasswordHashed) != string(legacy) {
+		t.Error("a wrong password replaced the hash")
+	}
+
+	if _, err := env.checkLogin(r, "alice", "Quiet lantern 58 harbor"); err != nil {
+		t.Fatal(err)
+	}
+	alice := users.get("alice")
+	if env.hashParams.NeedsRehash(alice.PasswordHashed) {
+		t.Errorf("hash %.10q was not replaced with an argon2id hash", alice.PasswordHashed)
+	}
+	if !models.CheckPassword(alice, "Quiet lantern 58 harbor") {
+		t.Error("the password does not match the new hash")
+	}
+	if n := logins.failures(models.AccountKey("alice")); n != 0 {
+		t.Errorf("%d failures left after signing in, want them cleared", n)
+	}
+}
+
+func TestPasswordRecheckIsThrottled(t *testing.T) {
+	hashed, err := models.DefaultArgon2Params().Hash("Quiet lantern 58 harbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := models.User{Username: "alice", PasswordHashed: hashed, TwoFactor: models.TwoFactor{Secret: "secret"}}
+	users := newMemUsers(alice)
+	logins := &memLogins{}
+	env := newTestEnv(EnvConfig{Users: users, Logins: logins, Audit: &memAudit{}})
+	recovery := func(password string) (string, []string) {
+		t.Helper()
+		msg, codes, err := env.twoFactorAction(formRequest("/2fa/", url.Values{"action": {"recovery"}, "password": {password}}), alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, codes
+	}
+
+	for i := 0; i < models.AccountLockoutAttempts; i++ {
+		if msg, _ := recovery("Quiet lantern 58 harbour"); msg != "Current password incorrect." {
+			t.Fatalf("attempt %d: flash = %q, want the password refused", i+1, msg)
+		}
+	}
+	if n := logins.failures(models.AccountKey("alice")); n != models.AccountLockoutAttempts {
+		t.Errorf("%d failures counted, want %d", n, models.AccountLockoutAttempts)
+	}
+
+	msg, codes := recovery("Quiet lantern 58 harbor")
+	if !strings.HasPrefix(msg, "Too many failed sign in attempts") || codes != nil {
+		t.Errorf("flash = %q with %d codes, want the locked account refused", msg, len(codes))
+	}
+	if users.get("alice").TwoFactor.RecoveryCodes != nil {
+		t.Error("recovery codes were replaced while the account was locked")
+	}
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Media serves the signed in user's stored files so that relative media/ references
+// in posts also resolve when previewing a post at /post/{slug}
+func (env *Env) Media(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	name := r.URL.Path[len("/post/media/"):]
+	media, err := env.media.Get(r.Context(), au.user.Username, name)
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", media.ContentType)
+	w.Write(media.Data)
+}
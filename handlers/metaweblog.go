@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/importer"
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/xmlrpc"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// XMLRPCPath is the route of the MetaWeblog / Blogger XML-RPC endpoint
+const XMLRPCPath = "/xmlrpc"
+
+// Blogging editors send the username and password with every call. The password may
+// be the account password or a personal API token, which is checked for the scope the
+// method needs. Each user has one blog, whose ID is the username, and post IDs are slugs
+
+type xmlrpcMethod func(env *Env, r *http.Request, params xmlrpc.Params) (interface{}, error)
+
+var xmlrpcMethods = map[string]xmlrpcMethod{
+	"blogger.getUsersBlogs":     (*Env).bloggerGetUsersBlogs,
+	"blogger.getUserInfo":       (*Env).bloggerGetUserInfo,
+	"blogger.deletePost":        (*Env).bloggerDeletePost,
+	"metaWeblog.getUsersBlogs":  (*Env).bloggerGetUsersBlogs,
+	"metaWeblog.newPost":        (*Env).metaWeblogNewPost,
+	"metaWeblog.editPost":       (*Env).metaWeblogEditPost,
+	"metaWeblog.getPost":        (*Env).metaWeblogGetPost,
+	"metaWeblog.getRecentPosts": (*Env).metaWeblogGetRecentPosts,
+	"metaWeblog.getCategories":  (*Env).metaWeblogGetCategories,
+	"metaWeblog.newMediaObject": (*Env).metaWeblogNewMediaObject,
+}
+
+// XMLRPC serves MetaWeblog and Blogger API calls
+func (env *Env) XMLRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "XML-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	method, params, err := xmlrpc.DecodeCall(r.Body)
+
+	var result interface{}
+	if err == nil {
+		handler, ok := xmlrpcMethods[method]
+		if method == "system.listMethods" {
+			result = xmlrpcMethodNames()
+		} else if !ok {
+			err = xmlrpc.Fault{Code: 404, String: "unknown method " + method}
+		} else {
+			result, err = handler(env, r, params)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if err != nil {
+		var fault xmlrpc.Fault
+		if !errors.As(err, &fault) {
+			fault = xmlrpc.Fault{Code: 500, String: err.Error()}
+		}
+		xmlrpc.EncodeFault(w, fault)
+		return
+	}
+	if err := xmlrpc.EncodeResponse(w, result); err != nil {
+		xmlrpc.EncodeFault(w, xmlrpc.Fault{Code: 500, String: err.Error()})
+	}
+}
+
+func xmlrpcMethodNames() []string {
+	names := []string{"system.listMethods"}
+	for name := range xmlrpcMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// xmlrpcUser checks the username and password parameters at positions i and i+1
+// and that the credentials may use scope
+func (env *Env) xmlrpcUser(r *http.Request, params xmlrpc.Params, i int, scope string) (AuthUser, error) {
+	username, err := params.String(i)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	password, err := params.String(i + 1)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	badLogin := xmlrpc.Fault{Code: 403, String: "incorrect username or password"}
+
+	if strings.HasPrefix(password, models.TokenPrefix) {
+		au, err := env.getTokenUser(r, password)
+		if err != nil || au.user.Username != username {
+			return AuthUser{}, badLogin
+		}
+		if !au.can(scope) {
+			return AuthUser{}, xmlrpc.Fault{Code: 403, String: "the token needs the " + scope + " scope"}
+		}
+		return au, nil
+	}
+
+	user, err := env.checkLogin(r, username, password)
+	if blocked, ok := err.(loginBlockedError); ok {
+		return AuthUser{}, xmlrpc.Fault{Code: 403, String: blocked.Error()}
+	} else if err == errBadLogin {
+		return AuthUser{}, badLogin
+	} else if err != nil {
+		return AuthUser{}, err
+	}
+	if user.TwoFactor.Enabled() {
+		return AuthUser{}, xmlrpc.Fault{Code: 403, String: "two-factor authentication is on: use a personal API token as the password"}
+	}
+	return AuthUser{user: user}, nil
+}
+
+// xmlrpcPost looks up one of the user's posts by its ID (slug)
+func (env *Env) xmlrpcPost(r *http.Request, au AuthUser, postID string) (models.Post, error) {
+	post, err := env.posts.GetBySlug(r.Context(), postID)
+	if err == mongo.ErrNoDocuments || (err == nil && post.OwnerUsername != au.user.Username) {
+		return models.Post{}, xmlrpc.Fault{Code: 404, String: "no post with ID " + postID}
+	}
+	return post, err
+}
+
+// metaWeblogStruct is the MetaWeblog representation of a post. The description holds
+// the Markdown source
+func metaWeblogStruct(r *http.Request, post models.Post) map[string]interface{} {
+	status := "publish"
+	if post.Draft {
+		status = "draft"
+	}
+	link := absoluteURL(r, postURL(post))
+	categories := post.Tags
+	if categories == nil {
+		categories = []string{}
+	}
+	return map[string]interface{}{
+		"postid":      post.Slug,
+		"title":       post.Title,
+		"description": post.Content,
+		"dateCreated": post.Pubdate,
+		"categories":  categories,
+		"mt_keywords": strings.Join(post.Tags, ", "),
+		"mt_excerpt":  post.Subtitle,
+		"wp_slug":     post.Slug,
+		"link":        link,
+		"permaLink":   link,
+		"post_status": status,
+		"userid":      post.OwnerUsername,
+	}
+}
+
+// applyMetaWeblogStruct copies the members set in a MetaWeblog post struct onto post.
+// HTML descriptions, as sent by rich text editors, are converted to Markdown
+func applyMetaWeblogStruct(post *models.Post, s map[string]interface{}, publish bool) error {
+	if title, ok := s["title"].(string); ok {
+		post.Title = strings.TrimSpace(title)
+	}
+	if description, ok := s["description"].(string); ok {
+		description = strings.TrimSpace(description)
+		if strings.HasPrefix(description, "<") {
+			md, err := importer.HTMLToMarkdown(description)
+			if err != nil {
+				return err
+			}
+			description = md
+		}
+		post.Content = description
+	}
+	if excerpt, ok := s["mt_excerpt"].(string); ok {
+		post.Subtitle = excerpt
+	}
+	if created, ok := s["dateCreated"].(time.Time); ok && !created.IsZero() {
+		post.Pubdate = created
+	}
+
+	var tags []string
+	_, hasCategories := s["categories"]
+	if categories, ok := s["categories"].([]interface{}); ok {
+		for _, c := range categories {
+			if c, ok := c.(string); ok {
+				tags = append(tags, c)
+			}
+		}
+	}
+	_, hasKeywords := s["mt_keywords"]
+	if keywords, ok := s["mt_keywords"].(string); ok {
+		tags = append(tags, parseTags(keywords)...)
+	}
+	if hasCategories || hasKeywords {
+		post.Tags = appendUnique(nil, tags...)
+	}
+
+	post.Draft = !publish
+	if status, ok := s["post_status"].(string); ok && status != "" {
+		post.Draft = status == "draft"
+	}
+
+	if post.Title == "" {
+		post.Title = noteTitle(post.Content)
+	}
+	if post.Title == "" {
+		return xmlrpc.Fault{Code: 400, String: "a title or description is required"}
+	}
+	return nil
+}
+
+// blogger.getUsersBlogs(appkey, username, password)
+func (env *Env) bloggerGetUsersBlogs(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeReadPosts)
+	if err != nil {
+		return nil, err
+	}
+	site, err := env.siteSettings(r.Context(), au.user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	name := site.Title
+	if name == "" {
+		name = au.user.Username
+	}
+	return []interface{}{map[string]interface{}{
+		"blogid":   au.user.Username,
+		"blogName": name,
+		"url":      absoluteURL(r, "/static/"+au.user.Username+"/"),
+		"xmlrpc":   absoluteURL(r, XMLRPCPath),
+		"isAdmin":  true,
+	}}, nil
+}
+
+// blogger.getUserInfo(appkey, username, password)
+func (env *Env) bloggerGetUserInfo(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeReadPosts)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"userid":    au.user.Username,
+		"nickname":  au.user.DisplayName,
+		"firstname": au.user.DisplayName,
+		"lastname":  "",
+		"url":       absoluteURL(r, "/static/"+au.user.Username+"/"),
+		"email":     "",
+	}, nil
+}
+
+// metaWeblog.newPost(blogid, username, password, struct, publish)
+func (env *Env) metaWeblogNewPost(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeWritePosts)
+	if err != nil {
+		return nil, err
+	}
+	s, err := params.Struct(3)
+	if err != nil {
+		return nil, err
+	}
+	publish, err := params.Bool(4, true)
+	if err != nil {
+		return nil, err
+	}
+
+	author := au.user.DisplayName
+	if author == "" {
+		author = au.user.Username
+	}
+	post := models.Post{
+		OwnerUsername: au.user.Username,
+		Author:        author,
+		Pubdate:       time.Now(),
+	}
+	if err := applyMetaWeblogStruct(&post, s, publish); err != nil {
+		return nil, err
+	}
+
+	post.Slug = models.DefaultSlug(post.Title, post.Pubdate)
+	for _, key := range []string{"wp_slug", "mt_basename"} {
+		if slug, ok := s[key].(string); ok && slug != "" {
+			post.Slug = slug
+		}
+	}
+	if !models.ValidSlug(post.Slug) {
+		return nil, xmlrpc.Fault{Code: 400, String: "invalid slug " + post.Slug}
+	}
+
+	err = env.posts.Create(r.Context(), post)
+	var exists *models.PostAlreadyExists
+	if errors.As(err, &exists) {
+		return nil, xmlrpc.Fault{Code: 409, String: err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+	return post.Slug, nil
+}
+
+// metaWeblog.editPost(postid, username, password, struct, publish)
+func (env *Env) metaWeblogEditPost(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeWritePosts)
+	if err != nil {
+		return nil, err
+	}
+	postID, err := params.String(0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := params.Struct(3)
+	if err != nil {
+		return nil, err
+	}
+	publish, err := params.Bool(4, true)
+	if err != nil {
+		return nil, err
+	}
+
+	post, err := env.xmlrpcPost(r, au, postID)
+	if err != nil {
+		return nil, err
+	}
+	updated := post
+	if err := applyMetaWeblogStruct(&updated, s, publish); err != nil {
+		return nil, err
+	}
+
+	// Update reports an error when nothing was modified
+	if !reflect.DeepEqual(post, updated) {
+		if err := env.posts.Update(r.Context(), updated); err != nil {
+			return nil, err
+		}
+	}
+	return true, nil
+}
+
+// metaWeblog.getPost(postid, username, password)
+func (env *Env) metaWeblogGetPost(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeReadPosts)
+	if err != nil {
+		return nil, err
+	}
+	postID, err := params.String(0)
+	if err != nil {
+		return nil, err
+	}
+
+	post, err := env.xmlrpcPost(r, au, postID)
+	if err != nil {
+		return nil, err
+	}
+	return metaWeblogStruct(r, post), nil
+}
+
+// metaWeblog.getRecentPosts(blogid, username, password, numberOfPosts)
+func (env *Env) metaWeblogGetRecentPosts(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeReadPosts)
+	if err != nil {
+		return nil, err
+	}
+	n := defaultPerPage
+	if len(params) > 3 {
+		if n, err = params.Int(3); err != nil {
+			return nil, err
+		}
+	}
+
+	posts, err := env.posts.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(posts, func(i, j int) bool { return posts[i].Pubdate.After(posts[j].Pubdate) })
+
+	result := []interface{}{}
+	for i := 0; i < len(posts) && i < n; i++ {
+		result = append(result, metaWeblogStruct(r, posts[i]))
+	}
+	return result, nil
+}
+
+// metaWeblog.getCategories(blogid, username, password) lists the tags used by the user's posts
+func (env *Env) metaWeblogGetCategories(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeReadPosts)
+	if err != nil {
+		return nil, err
+	}
+	posts, err := env.posts.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, p := range posts {
+		tags = appendUnique(tags, p.Tags...)
+	}
+	sort.Strings(tags)
+
+	result := []interface{}{}
+	for _, t := range tags {
+		result = append(result, map[string]interface{}{
+			"categoryId":   t,
+			"categoryName": t,
+			"title":        t,
+			"description":  t,
+			"htmlUrl":      "",
+			"rssUrl":       "",
+		})
+	}
+	return result, nil
+}
+
+// metaWeblog.newMediaObject(blogid, username, password, struct{name, type, bits})
+func (env *Env) metaWeblogNewMediaObject(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 1, models.ScopeWritePosts)
+	if err != nil {
+		return nil, err
+	}
+	s, err := params.Struct(3)
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := s["name"].(string)
+	contentType, _ := s["type"].(string)
+	bits, ok := s["bits"].([]byte)
+	if name == "" || !ok {
+		return nil, xmlrpc.Fault{Code: 400, String: "name and base64 bits are required"}
+	}
+
+	u, err := env.saveUpload(r, au, name, contentType, bits)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"url": u}, nil
+}
+
+// blogger.deletePost(appkey, postid, username, password, publish)
+func (env *Env) bloggerDeletePost(r *http.Request, params xmlrpc.Params) (interface{}, error) {
+	au, err := env.xmlrpcUser(r, params, 2, models.ScopeWritePosts)
+	if err != nil {
+		return nil, err
+	}
+	postID, err := params.String(1)
+	if err != nil {
+		return nil, err
+	}
+
+	post, err := env.xmlrpcPost(r, au, postID)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.posts.Delete(r.Context(), post.Slug); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
@@ -0,0 +1,641 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/importer"
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Micropub (https://www.w3.org/TR/micropub/) lets third-party clients create, update and
+// delete posts. Clients authenticate with a personal API token, sent either as a bearer
+// token or in an access_token form field. Posts are identified by their URL in the
+// generated site, /static/{username}/{slug}.html; /post/{slug} URLs are accepted as well
+
+// MicropubPath and MicropubMediaPath are the Micropub and media endpoint routes
+const (
+	MicropubPath      = "/micropub"
+	MicropubMediaPath = "/micropub/media"
+)
+
+// mpProperties holds the properties of an h-entry; every property is a list of values,
+// each either a string or a JSON object such as {"html": "..."}
+type mpProperties map[string][]interface{}
+
+// micropubRequest is a create, update or delete request decoded from JSON or form fields
+type micropubRequest struct {
+	Type       []string        `json:"type"`
+	Properties mpProperties    `json:"properties"`
+	Action     string          `json:"action"`
+	URL        string          `json:"url"`
+	Replace    mpProperties    `json:"replace"`
+	Add        mpProperties    `json:"add"`
+	Delete     json.RawMessage `json:"delete"`
+}
+
+type micropubError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeMicropubError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, micropubError{Error: code, Description: description})
+}
+
+// absoluteURL resolves a path against the host the request was made to
+func absoluteURL(r *http.Request, p string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + p
+}
+
+// postURL is the path of a post in the generated site
+func postURL(post models.Post) string {
+	return "/static/" + post.OwnerUsername + "/" + url.PathEscape(post.Slug) + ".html"
+}
+
+// slugFromURL returns the slug of a post given its site or editor URL
+func slugFromURL(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Path == "" {
+		return "", fmt.Errorf("invalid post URL %q", u)
+	}
+	return strings.TrimSuffix(path.Base(parsed.Path), ".html"), nil
+}
+
+// micropubUser authenticates a Micropub request by its bearer or access_token token
+func (env *Env) micropubUser(w http.ResponseWriter, r *http.Request) (AuthUser, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		token = r.FormValue("access_token")
+	}
+	if token == "" {
+		writeMicropubError(w, http.StatusUnauthorized, "unauthorized", "an API token is required")
+		return AuthUser{}, false
+	}
+
+	au, err := env.getTokenUser(r, token)
+	if err != nil {
+		writeMicropubError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return AuthUser{}, false
+	}
+	return au, true
+}
+
+// micropubScope writes an insufficient_scope error and returns false if the token lacks scope
+func micropubScope(w http.ResponseWriter, au AuthUser, scope string) bool {
+	if au.can(scope) {
+		return true
+	}
+	writeMicropubError(w, http.StatusForbidden, "insufficient_scope", "the token needs the "+scope+" scope")
+	return false
+}
+
+// Micropub handles queries (GET) and create, update and delete requests (POST)
+func (env *Env) Micropub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		writeMicropubError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, models.MaxMediaSize)
+	}
+	au, ok := env.micropubUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		if micropubScope(w, au, models.ScopeReadPosts) {
+			env.micropubQuery(w, r, au)
+		}
+		return
+	}
+
+	if !micropubScope(w, au, models.ScopeWritePosts) {
+		return
+	}
+	req, err := env.parseMicropub(r, au)
+	if err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch req.Action {
+	case "":
+		env.micropubCreate(w, r, au, req)
+	case "update":
+		env.micropubUpdate(w, r, au, req)
+	case "delete":
+		post, ok := env.micropubPost(w, r, au, req.URL)
+		if !ok {
+			return
+		}
+		if err := env.posts.Delete(r.Context(), post.Slug); err != nil {
+			writeMicropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "unsupported action "+req.Action)
+	}
+}
+
+// parseMicropub decodes a JSON, form-encoded or multipart request. Files uploaded in
+// multipart requests are saved to the media store and added as photo URLs
+func (env *Env) parseMicropub(r *http.Request, au AuthUser) (micropubRequest, error) {
+	var req micropubRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		if req.Action == "" && (len(req.Type) == 0 || req.Type[0] != "h-entry") {
+			return req, errors.New("only h-entry can be created")
+		}
+		return req, nil
+	}
+
+	if err := r.ParseMultipartForm(models.MaxMediaSize); err != nil && err != http.ErrNotMultipart {
+		return req, err
+	}
+	req.Action = r.PostForm.Get("action")
+	req.URL = r.PostForm.Get("url")
+	if req.Action != "" {
+		return req, nil
+	}
+	if h := r.PostForm.Get("h"); h != "entry" {
+		return req, errors.New("only h=entry can be created")
+	}
+
+	req.Properties = mpProperties{}
+	for key, values := range r.PostForm {
+		key = strings.TrimSuffix(key, "[]")
+		if key == "h" || key == "access_token" {
+			continue
+		}
+		for _, v := range values {
+			req.Properties[key] = append(req.Properties[key], v)
+		}
+	}
+
+	if r.MultipartForm != nil {
+		for key, files := range r.MultipartForm.File {
+			key = strings.TrimSuffix(key, "[]")
+			for _, fh := range files {
+				u, err := env.saveMicropubMedia(r, au, fh)
+				if err != nil {
+					return req, err
+				}
+				req.Properties[key] = append(req.Properties[key], u)
+			}
+		}
+	}
+	return req, nil
+}
+
+// micropubPost looks up the signed in user's post by URL, writing an error if it is missing
+func (env *Env) micropubPost(w http.ResponseWriter, r *http.Request, au AuthUser, u string) (models.Post, bool) {
+	slug, err := slugFromURL(u)
+	if err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return models.Post{}, false
+	}
+
+	post, err := env.posts.GetBySlug(r.Context(), slug)
+	if err == mongo.ErrNoDocuments || (err == nil && post.OwnerUsername != au.user.Username) {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "no post at "+u)
+		return models.Post{}, false
+	} else if err != nil {
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return models.Post{}, false
+	}
+	return post, true
+}
+
+func (env *Env) micropubCreate(w http.ResponseWriter, r *http.Request, au AuthUser, req micropubRequest) {
+	author := au.user.DisplayName
+	if author == "" {
+		author = au.user.Username
+	}
+	post := models.Post{
+		OwnerUsername: au.user.Username,
+		Author:        author,
+		Pubdate:       time.Now(),
+	}
+
+	if err := setProperties(&post, req.Properties); err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if post.Title == "" {
+		// notes have no name, so the title is taken from the start of the content
+		post.Title = noteTitle(post.Content)
+	}
+	if post.Title == "" {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "a name or content is required")
+		return
+	}
+
+	post.Slug = models.DefaultSlug(post.Title, post.Pubdate)
+	if slug := mpString(req.Properties["mp-slug"]); slug != "" {
+		post.Slug = slug
+	}
+	if !models.ValidSlug(post.Slug) {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "invalid slug "+post.Slug)
+		return
+	}
+
+	err := env.posts.Create(r.Context(), post)
+	var exists *models.PostAlreadyExists
+	if errors.As(err, &exists) {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	} else if err != nil {
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Location", absoluteURL(r, postURL(post)))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (env *Env) micropubUpdate(w http.ResponseWriter, r *http.Request, au AuthUser, req micropubRequest) {
+	post, ok := env.micropubPost(w, r, au, req.URL)
+	if !ok {
+		return
+	}
+	original := post
+
+	err := applyUpdate(&post, req)
+	if err == nil && post.Title == "" {
+		err = errors.New("the name cannot be removed")
+	}
+	if err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// Update reports an error when nothing was modified
+	if !reflect.DeepEqual(original, post) {
+		if err := env.posts.Update(r.Context(), post); err != nil {
+			writeMicropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyUpdate applies the replace, add and delete operations of an update request
+func applyUpdate(post *models.Post, req micropubRequest) error {
+	if err := setProperties(post, req.Replace); err != nil {
+		return err
+	}
+
+	for name, values := range req.Add {
+		switch name {
+		case "category":
+			post.Tags = appendUnique(post.Tags, mpStrings(values)...)
+		case "photo":
+			post.Content = appendPhotos(post.Content, values)
+		default:
+			if len(propertiesOf(*post)[name]) > 0 {
+				return fmt.Errorf("%s has a single value and cannot be added to", name)
+			}
+			if err := setProperty(post, name, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(req.Delete) == 0 {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(req.Delete, &names); err == nil {
+		for _, name := range names {
+			if err := setProperty(post, name, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var values mpProperties
+	if err := json.Unmarshal(req.Delete, &values); err != nil {
+		return errors.New("delete must be a list of property names or an object of values")
+	}
+	for name, vs := range values {
+		if name != "category" {
+			return fmt.Errorf("values can only be deleted from category")
+		}
+		remove := map[string]bool{}
+		for _, v := range mpStrings(vs) {
+			remove[v] = true
+		}
+		var tags []string
+		for _, t := range post.Tags {
+			if !remove[t] {
+				tags = append(tags, t)
+			}
+		}
+		post.Tags = tags
+	}
+	return nil
+}
+
+// setProperties sets every property on post. Photos are set last because
+// they are appended to the content
+func setProperties(post *models.Post, props mpProperties) error {
+	for name, values := range props {
+		if name == "photo" {
+			continue
+		}
+		if err := setProperty(post, name, values); err != nil {
+			return err
+		}
+	}
+	return setProperty(post, "photo", props["photo"])
+}
+
+// setProperty sets one Micropub property on post; nil values clear it.
+// Properties without a place in models.Post are ignored
+func setProperty(post *models.Post, name string, values []interface{}) error {
+	switch name {
+	case "name":
+		post.Title = strings.TrimSpace(mpString(values))
+	case "summary":
+		post.Subtitle = mpString(values)
+	case "content":
+		content, err := mpContent(values)
+		if err != nil {
+			return err
+		}
+		post.Content = content
+	case "category":
+		post.Tags = appendUnique(nil, mpStrings(values)...)
+	case "published":
+		if len(values) == 0 {
+			return errors.New("published cannot be removed")
+		}
+		pubdate, err := parseAPIDate(mpString(values))
+		if err != nil {
+			return errors.New("published must be an ISO 8601 date or timestamp")
+		}
+		post.Pubdate = pubdate
+	case "post-status":
+		post.Draft = mpString(values) == "draft"
+	case "photo":
+		post.Content = appendPhotos(post.Content, values)
+	}
+	return nil
+}
+
+// propertiesOf is the h-entry representation of a post, used by q=source
+func propertiesOf(post models.Post) mpProperties {
+	props := mpProperties{
+		"published": {post.Pubdate.Format(time.RFC3339)},
+		"url":       {postURL(post)},
+	}
+	status := "published"
+	if post.Draft {
+		status = "draft"
+	}
+	props["post-status"] = []interface{}{status}
+	if post.Title != "" {
+		props["name"] = []interface{}{post.Title}
+	}
+	if post.Subtitle != "" {
+		props["summary"] = []interface{}{post.Subtitle}
+	}
+	if post.Content != "" {
+		props["content"] = []interface{}{post.Content}
+	}
+	for _, t := range post.Tags {
+		props["category"] = append(props["category"], t)
+	}
+	return props
+}
+
+// mpString returns the first value as a string, or "" if there is none
+func mpString(values []interface{}) string {
+	s := mpStrings(values)
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+// mpStrings returns the values that are strings, or objects with a "value" member
+func mpStrings(values []interface{}) []string {
+	var s []string
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			s = append(s, v)
+		case map[string]interface{}:
+			if value, ok := v["value"].(string); ok {
+				s = append(s, value)
+			}
+		}
+	}
+	return s
+}
+
+// mpContent returns post content as Markdown, converting {"html": ...} values
+func mpContent(values []interface{}) (string, error) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	if obj, ok := values[0].(map[string]interface{}); ok {
+		if html, ok := obj["html"].(string); ok {
+			return importer.HTMLToMarkdown(html)
+		}
+	}
+	return strings.TrimSpace(mpString(values)), nil
+}
+
+// appendPhotos adds a Markdown image to content for each photo URL, with its alt text
+// when given as {"value": url, "alt": text}
+func appendPhotos(content string, values []interface{}) string {
+	for _, v := range values {
+		u, alt := "", ""
+		switch v := v.(type) {
+		case string:
+			u = v
+		case map[string]interface{}:
+			u, _ = v["value"].(string)
+			alt, _ = v["alt"].(string)
+		}
+		if u == "" {
+			continue
+		}
+		if content != "" {
+			content += "\n\n"
+		}
+		content += fmt.Sprintf("![%s](%s)", alt, u)
+	}
+	return content
+}
+
+// noteTitle builds a title for an untitled note from the first words of its content
+func noteTitle(content string) string {
+	const maxLen = 50
+	line := strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+	if len(line) <= maxLen {
+		return line
+	}
+	if i := strings.LastIndex(line[:maxLen], " "); i > 0 {
+		return line[:i] + "..."
+	}
+	return line[:maxLen] + "..."
+}
+
+func appendUnique(list []string, values ...string) []string {
+	seen := map[string]bool{}
+	for _, v := range list {
+		seen[v] = true
+	}
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" && !seen[v] {
+			seen[v] = true
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (env *Env) micropubQuery(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	switch r.URL.Query().Get("q") {
+	case "config":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"media-endpoint": absoluteURL(r, MicropubMediaPath),
+			"syndicate-to":   []string{},
+			"q":              []string{"config", "source", "syndicate-to"},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+				{"type": "photo", "name": "Photo"},
+			},
+		})
+	case "syndicate-to":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"syndicate-to": []string{}})
+	case "source":
+		post, ok := env.micropubPost(w, r, au, r.URL.Query().Get("url"))
+		if !ok {
+			return
+		}
+
+		props := propertiesOf(post)
+		props["url"] = []interface{}{absoluteURL(r, postURL(post))}
+		wanted := append(r.URL.Query()["properties[]"], r.URL.Query()["properties"]...)
+		if len(wanted) > 0 {
+			filtered := mpProperties{}
+			for _, name := range wanted {
+				if v, ok := props[name]; ok {
+					filtered[name] = v
+				}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"properties": filtered})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"type": []string{"h-entry"}, "properties": props})
+	default:
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "unsupported query")
+	}
+}
+
+// MicropubMedia is the Micropub media endpoint. It stores the uploaded "file" in the media
+// store and returns its URL in the generated site
+func (env *Env) MicropubMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeMicropubError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxMediaSize)
+	au, ok := env.micropubUser(w, r)
+	if !ok || !micropubScope(w, au, models.ScopeWritePosts) {
+		return
+	}
+
+	if err := r.ParseMultipartForm(models.MaxMediaSize); err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) != 1 {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "exactly one file must be uploaded as file")
+		return
+	}
+
+	u, err := env.saveMicropubMedia(r, au, files[0])
+	if err != nil {
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	w.Header().Set("Location", u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// saveMicropubMedia stores an uploaded file and returns its URL in the generated site
+func (env *Env) saveMicropubMedia(r *http.Request, au AuthUser, fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return env.saveUpload(r, au, fh.Filename, fh.Header.Get("Content-Type"), data)
+}
+
+// saveUpload stores a file uploaded by a client under a unique name in the media store
+// and returns its URL in the generated site
+func (env *Env) saveUpload(r *http.Request, au AuthUser, filename, contentType string, data []byte) (string, error) {
+	if len(data) > models.MaxMediaSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", filename, models.MaxMediaSize)
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(data)
+	}
+	base := strings.Map(func(c rune) rune {
+		if c == ' ' || c == '/' || c == '\\' {
+			return '-'
+		}
+		return c
+	}, path.Base(filename))
+	name := time.Now().Format("20060102-150405") + "-" + base
+
+	err := env.media.Save(r.Context(), models.Media{
+		OwnerUsername: au.user.Username,
+		Name:          name,
+		ContentType:   contentType,
+		Data:          data,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return absoluteURL(r, "/static/"+au.user.Username+"/media/"+url.PathEscape(name)), nil
+}
@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+// oidcCookie holds the signed state of a sign in in progress at the provider
+const oidcCookie = "oidc"
+
+// oidcLifetime is how long a browser has to come back from the provider
+const oidcLifetime = 10 * time.Minute
+
+// OIDCConfig configures sign in with an OpenID Connect provider. RedirectURL, the site's
+// /oidc/callback address registered with the provider, is required. When AllowedDomains is not empty, only
+// verified email addresses in those domains may sign in. Provision creates accounts for
+// people who have none; otherwise they must link the provider from the account page first
+type OIDCConfig struct {
+	Name           string
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string
+	AllowedDomains []string
+	Provision      bool
+}
+
+// OIDC signs users in with the authorization code flow and PKCE
+type OIDC struct {
+	OIDCConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDC finds the provider's endpoints and keys through OpenID Connect discovery
+func NewOIDC(ctx context.Context, cfg OIDCConfig) (*OIDC, error) {
+	if cfg.RedirectURL == "" {
+		return nil, errors.New("no redirect URL is set")
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range cfg.AllowedDomains {
+		cfg.AllowedDomains[i] = strings.ToLower(strings.TrimSpace(d))
+	}
+	if cfg.Name == "" {
+		cfg.Name = "single sign-on"
+	}
+	return &OIDC{
+		OIDCConfig: cfg,
+		provider:   provider,
+		verifier:   provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// oauth2Config returns the OAuth 2.0 client configuration
+func (o *OIDC) oauth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		Endpoint:     o.provider.Endpoint(),
+		RedirectURL:  o.RedirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// domainAllowed reports whether the verified address email may sign in
+func (o *OIDC) domainAllowed(email string) bool {
+	if len(o.AllowedDomains) == 0 {
+		return true
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, d := range o.AllowedDomains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcState is kept in the signed oidc cookie between sending the browser to the provider
+// and its return. Link is the user whose account the identity is being linked to, if any
+type oidcState struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Link     string `json:",omitempty"`
+	Remember bool   `json:",omitempty"`
+}
+
+// oidcClaims are the ID token claims used to find or create the account
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// randomString returns n random bytes encoded as base64url
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OIDCSignIn handles single sign-on:
+// GET /oidc/login[?remember=1] sends the browser to the provider to sign in
+// GET /oidc/login?link=1 does the same to link the provider to the signed in account
+// GET /oidc/callback checks the provider's answer and signs in
+func (env *Env) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	if env.sso == nil {
+		env.renderError(w, r, http.StatusNotFound, "Not found", "Single sign-on is not set up on this site.")
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/oidc/login":
+		env.beginOIDC(w, r)
+	case "/oidc/callback":
+		env.finishOIDC(w, r)
+	default:
+		env.renderError(w, r, http.StatusNotFound, "Not found", "There is no page here.")
+	}
+}
+
+// newOIDCState returns the state, nonce and PKCE verifier for a new sign in
+func newOIDCState(remember bool) (oidcState, error) {
+	st := oidcState{Remember: remember}
+	var err error
+	if st.State, err = randomString(24); err != nil {
+		return st, err
+	}
+	if st.Nonce, err = randomString(24); err != nil {
+		return st, err
+	}
+	st.Verifier, err = randomString(32)
+	return st, err
+}
+
+func (env *Env) beginOIDC(w http.ResponseWriter, r *http.Request) {
+	st, err := newOIDCState(r.URL.Query().Get("remember") != "")
+	if err != nil {
+		log.Printf("oidc: starting sign in: %v", err)
+		env.renderError(w, r, http.StatusInternalServerError, "Single sign-on failed", "The sign in could not be started. Please try again.")
+		return
+	}
+	if r.URL.Query().Get("link") != "" {
+		au, err := env.getSignedInUser(r)
+		if err != nil {
+			http.Redirect(w, r, "/signin/", http.StatusFound)
+			return
+		}
+		st.Link = au.user.Username
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    env.signValue(base64.RawURLEncoding.EncodeToString(b)),
+		Path:     "/oidc/",
+		MaxAge:   int(oidcLifetime.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+	})
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	u := env.sso.oauth2Config().AuthCodeURL(st.State,
+		oidc.Nonce(st.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// readOIDCState returns the state of the sign in this browser started, which can only be used once
+func (env *Env) readOIDCState(w http.ResponseWriter, r *http.Request) (oidcState, error) {
+	var st oidcState
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return st, err
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/oidc/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+
+	value, ok := env.verifyValue(cookie.Value)
+	if !ok {
+		return st, errors.New("bad signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+func (env *Env) finishOIDC(w http.ResponseWriter, r *http.Request) {
+	fail := func(msg string) {
+		env.renderError(w, r, http.StatusForbidden, "Single sign-on failed", msg)
+	}
+
+	st, err := env.readOIDCState(w, r)
+	if err != nil || st.State == "" || r.URL.Query().Get("state") != st.State {
+		fail("The sign in expired or did not start here. Please try again.")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail("The provider refused the sign in: " + e + " " + r.URL.Query().Get("error_description"))
+		return
+	}
+
+	ctx := r.Context()
+	token, err := env.sso.oauth2Config().Exchange(ctx, r.URL.Query().Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", st.Verifier))
+	if err != nil {
+		log.Printf("oidc: exchanging code: %v", err)
+		fail("The provider's answer could not be checked. Please try again.")
+		return
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		fail("The provider did not send an ID token.")
+		return
+	}
+	idToken, err := env.sso.verifier.Verify(ctx, rawID)
+	if err != nil {
+		log.Printf("oidc: verifying ID token: %v", err)
+		fail("The provider's ID token is not valid.")
+		return
+	}
+	if idToken.Nonce != st.Nonce {
+		fail("The provider's ID token was not issued for this sign in.")
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(env.sso.AllowedDomains) > 0 && (!claims.EmailVerified || !env.sso.domainAllowed(claims.Email)) {
+		fail("Your email address at the provider is not in a domain allowed to sign in here.")
+		return
+	}
+
+	id := models.Identity{Issuer: idToken.Issuer, Subject: idToken.Subject, Email: claims.Email}
+	if st.Link != "" {
+		env.linkIdentity(w, r, st.Link, id)
+		return
+	}
+
+	u, flash, err := env.oidcUser(r, id, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if flash != "" {
+		fail(flash)
+		return
+	}
+
+	// the provider stands in for the password only
+	if u.TwoFactor.Enabled() {
+		env.beginSecondFactor(w, r, u, st.Remember)
+		return
+	}
+	env.startSession(w, r, u, st.Remember)
+}
+
+// oidcUser returns the user to sign in as id: the user it is linked to, else the user with
+// the same confirmed email address, to whom it is then linked, else a new user if provisioning
+// is on. It returns the message to show instead if there is none
+func (env *Env) oidcUser(r *http.Request, id models.Identity, claims oidcClaims) (models.User, string, error) {
+	ctx := r.Context()
+	u, err := env.users.GetByIdentity(ctx, id.Issuer, id.Subject)
+	if err == nil {
+		return u, "", nil
+	} else if err != mongo.ErrNoDocuments {
+		return models.User{}, "", err
+	}
+
+	if claims.EmailVerified {
+		email, _ := models.NormalizeEmail(claims.Email)
+		u, err := env.users.GetByVerifiedEmail(ctx, email)
+		if err == nil {
+			err = env.users.LinkIdentity(ctx, u.Username, id)
+			if err != nil {
+				return models.User{}, "", err
+			}
+			env.auditLog(ctx, models.AuditEntry{Event: models.AuditIdentityLinked, Username: u.Username, IP: env.clientIP(r), Detail: id.Issuer})
+			return u, "", nil
+		} else if err != mongo.ErrNoDocuments {
+			return models.User{}, "", err
+		}
+	}
+
+	if !env.sso.Provision {
+		return models.User{}, "No account here is linked to your " + env.sso.Name + " account. Sign in with your password and link it from the Account page.", nil
+	}
+	if !claims.EmailVerified {
+		return models.User{}, "Your email address at the provider is not verified, so an account cannot be created for it.", nil
+	}
+	preferred := claims.PreferredUsername
+	if preferred == "" {
+		preferred = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	u, err = env.users.ProvisionUser(ctx, preferred, claims.Name, claims.Email, id)
+	if err != nil {
+		return models.User{}, "Your account could not be created: " + err.Error(), nil
+	}
+	env.auditLog(ctx, models.AuditEntry{Event: models.AuditUserProvisioned, Username: u.Username, IP: env.clientIP(r), Detail: id.Issuer})
+	return u, "", nil
+}
+
+// linkIdentity links id to username, who must still be signed in, and shows the account page
+func (env *Env) linkIdentity(w http.ResponseWriter, r *http.Request, username string, id models.Identity) {
+	au, err := env.getSignedInUser(r)
+	if err != nil || au.user.Username != username {
+		http.Redirect(w, r, "/signin/", http.StatusFound)
+		return
+	}
+
+	flash := env.sso.Name + " account linked. You can now sign in with it."
+	err = env.users.LinkIdentity(r.Context(), username, id)
+	if err == models.ErrIdentityLinked {
+		flash = err.Error()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		env.auditLog(r.Context(), models.AuditEntry{Event: models.AuditIdentityLinked, Username: username, IP: env.clientIP(r), Actor: username, Detail: id.Issuer})
+	}
+
+	au.user, err = env.users.GetByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	env.renderAccount(w, r, au, flash, "")
+}
+
+// Identities unlinks a single sign-on account (action=unlink) from the account page.
+// The last way to sign in cannot be unlinked
+func (env *Env) Identities(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/changepwd/", http.StatusFound)
+		return
+	}
+
+	flash := "Unknown action."
+	if r.FormValue("action") == "unlink" {
+		if len(au.user.PasswordHashed) == 0 && len(au.user.Identities) < 2 {
+			flash = "Your account has no password, so this is the only way to sign in. Set a password with \"Forgot your password?\" first."
+		} else {
+			err := env.users.UnlinkIdentity(r.Context(), au.user.Username, r.FormValue("issuer"), r.FormValue("subject"))
+			if err != nil {
+				flash = err.Error()
+			} else {
+				flash = "Single sign-on account unlinked."
+			}
+		}
+	}
+
+	// reload so the list reflects the change
+	user, err := env.users.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	au.user = user
+	env.renderAccount(w, r, au, flash, "")
+}
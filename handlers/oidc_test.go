@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+)
+
+// authorization is a code the mock provider issued and what it was issued for
+type authorization struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	claims      map[string]interface{}
+}
+
+// mockProvider is an OpenID Connect provider serving discovery, its signing keys and a
+// token endpoint that checks PKCE. Tests play the browser at the authorization endpoint
+type mockProvider struct {
+	t         *testing.T
+	srv       *httptest.Server
+	key       *rsa.PrivateKey
+	mu        sync.Mutex
+	codes     map[string]authorization
+	exchanges int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{t: t, key: key, codes: map[string]authorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.srv.URL,
+			"authorization_endpoint":                p.srv.URL + "/authorize",
+			"token_endpoint":                        p.srv.URL + "/token",
+			"jwks_uri":                              p.srv.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// authorize checks the authorization request the browser was sent to and returns the code
+// and state the provider sends it back with after signing in as claims
+func (p *mockProvider) authorize(location string, claims map[string]interface{}) (string, string) {
+	p.t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, p.srv.URL+"/authorize?") {
+		p.t.Fatalf("browser sent to %q, want the authorization endpoint", location)
+	}
+	q := u.Query()
+	if q.Get("client_id") != "mdbssg" || q.Get("response_type") != "code" || !strings.Contains(q.Get("scope"), "openid") {
+		p.t.Fatalf("authorization request %v is not an OpenID Connect code request for mdbssg", q)
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		p.t.Fatalf("authorization request %v has no S256 code challenge", q)
+	}
+	if q.Get("state") == "" || q.Get("nonce") == "" {
+		p.t.Fatalf("authorization request %v has no state or nonce", q)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := newToken()
+	p.codes[code] = authorization{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+		claims:      claims,
+	}
+	return code, q.Get("state")
+}
+
+// setNonce changes the nonce the ID token for code is issued with
+func (p *mockProvider) setNonce(code, nonce string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.codes[code]
+	a.nonce = nonce
+	p.codes[code] = a
+}
+
+// token exchanges a code, once, for an ID token, if the client proves it holds the PKCE verifier
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exchanges++
+
+	invalid := func(e string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": e})
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != "mdbssg" || secret != "s3cret" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		invalid("unsupported_grant_type")
+		return
+	}
+
+	a, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("redirect_uri") != a.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != a.challenge {
+		invalid("invalid_grant")
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   p.srv.URL,
+		"aud":   "mdbssg",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": a.nonce,
+	}
+	for k, v := range a.claims {
+		claims[k] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": newToken(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.sign(claims),
+	})
+}
+
+// sign returns claims as a JWT signed with RS256
+func (p *mockProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+type oidcEnv struct {
+	*Env
+	provider *mockProvider
+	users    *memUsers
+	sessions *memSessions
+	audit    *memAudit
+}
+
+// testRedirectURL is the configured callback, on a different host from the test requests
+const testRedirectURL = "https://blog.example/oidc/callback"
+
+func newOIDCEnv(t *testing.T, alice models.User) oidcEnv {
+	p := newMockProvider(t)
+	sso, err := NewOIDC(context.Background(), OIDCConfig{
+		Name: "Mock", Issuer: p.srv.URL, ClientID: "mdbssg", ClientSecret: "s3cret", RedirectURL: testRedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := oidcEnv{provider: p, users: newMemUsers(alice), sessions: &memSessions{}, audit: &memAudit{}}
+	templates := flashTemplates("changepwd")
+	templates["error"] = template.Must(template.New("base").Parse("{{ .Message }}"))
+	e.Env = newTestEnv(EnvConfig{Users: e.users, Sessions: e.sessions, Audit: e.audit, Templates: templates, SingleSignOn: sso})
+	return e
+}
+
+// begin starts a sign in, returning where the browser is sent and the oidc cookie
+func (e oidcEnv) begin(t *testing.T, query string) (string, string) {
+	t.Helper()
+	resp := serve(e.OIDCSignIn, httptest.NewRequest("GET", "/oidc/login"+query, nil))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status %d, want a redirect to the provider", resp.StatusCode)
+	}
+	state := cookie(resp, oidcCookie)
+	if state == "" {
+		t.Fatal("no oidc cookie was set")
+	}
+	return resp.Header.Get("Location"), state
+}
+
+// callback returns the browser to the site with code and state, presenting the oidc cookie
+func (e oidcEnv) callback(code, state, oidcState string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if oidcState != "" {
+		r.AddCookie(&http.Cookie{Name: oidcCookie, Value: oidcState})
+	}
+	w := httptest.NewRecorder()
+	e.OIDCSignIn(w, r)
+	return w
+}
+
+// wantSignedIn checks that w started a session for username
+func (e oidcEnv) wantSignedIn(t *testing.T, w *httptest.ResponseRecorder, username string) {
+	t.Helper()
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/changepwd/" {
+		t.Fatalf("status %d to %q: %s, want a redirect to the account page", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	if cookie(w.Result(), sessionCookie) == "" {
+		t.Error("no session cookie was set")
+	}
+	started := e.sessions.started(t)
+	if len(started) == 0 || started[len(started)-1].Username != username {
+		t.Errorf("sessions = %+v, want one for %s", started, username)
+	}
+}
+
+// wantRefused checks that w is the single sign-on error page showing msg and no session was started
+func (e oidcEnv) wantRefused(t *testing.T, w *httptest.ResponseRecorder, msg string) {
+	t.Helper()
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), msg) {
+		t.Errorf("status %d: %q, want %d with %q", w.Code, w.Body.String(), http.StatusForbidden, msg)
+	}
+	if cookie(w.Result(), sessionCookie) != "" || len(e.sessions.started(t)) != 0 {
+		t.Error("a session was started")
+	}
+}
+
+// linkAlice links alice-sub at the provider to alice
+func (e oidcEnv) linkAlice(t *testing.T) {
+	err := e.users.LinkIdentity(context.Background(), "alice", models.Identity{Issuer: e.provider.srv.URL, Subject: "alice-sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice"})
+	e.linkAlice(t)
+
+	location, oidcState := e.begin(t, "?remember=1")
+	if u, err := url.Parse(location); err != nil || u.Query().Get("redirect_uri") != testRedirectURL {
+		t.Errorf("sent to %q, want the configured redirect URL %s whatever the Host header", location, testRedirectURL)
+	}
+	code, state := e.provider.authorize(location, map[string]interface{}{"sub": "alice-sub"})
+	e.wantSignedIn(t, e.callback(code, state, oidcState), "alice")
+	if s := e.sessions.started(t); !s[0].Remember {
+		t.Error("the session was not remembered")
+	}
+
+	// the code cannot be exchanged again
+	w := e.callback(code, state, oidcState)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("replayed code: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if n := len(e.sessions.started(t)); n != 1 {
+		t.Errorf("%d sessions started, want 1", n)
+	}
+}
+
+func TestOIDCCodeForAnotherSignIn(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice"})
+	e.linkAlice(t)
+
+	// a code issued for one sign in, injected into another, fails the PKCE check
+	victimLocation, _ := e.begin(t, "")
+	code, _ := e.provider.authorize(victimLocation, map[string]interface{}{"sub": "alice-sub"})
+	location, oidcState := e.begin(t, "")
+	_, state := e.provider.authorize(location, map[string]interface{}{"sub": "alice-sub"})
+
+	e.wantRefused(t, e.callback(code, state, oidcState), "could not be checked")
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice"})
+	e.linkAlice(t)
+	location, oidcState := e.begin(t, "")
+	code, state := e.provider.authorize(location, map[string]interface{}{"sub": "alice-sub"})
+
+	e.wantRefused(t, e.callback(code, "forged", oidcState), "did not start here")
+	e.wantRefused(t, e.callback(code, state, ""), "did not start here")
+	e.wantRefused(t, e.callback(code, state, oidcState+"x"), "did not start here")
+	if e.provider.exchanges != 0 {
+		t.Errorf("%d token requests, want none", e.provider.exchanges)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice"})
+	e.linkAlice(t)
+	location, oidcState := e.begin(t, "")
+	code, state := e.provider.authorize(location, map[string]interface{}{"sub": "alice-sub"})
+	e.provider.setNonce(code, "from another sign in")
+
+	e.wantRefused(t, e.callback(code, state, oidcState), "was not issued for this sign in")
+}
+
+func TestOIDCLinkByEmail(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice", Email: "alice@blog.example", EmailVerified: true})
+	claims := map[string]interface{}{"sub": "new-sub", "email": "Alice@Blog.Example", "email_verified": true}
+
+	location, oidcState := e.begin(t, "")
+	code, state := e.provider.authorize(location, claims)
+	e.wantSignedIn(t, e.callback(code, state, oidcState), "alice")
+
+	ids := e.users.get("alice").Identities
+	if len(ids) != 1 || ids[0].Issuer != e.provider.srv.URL || ids[0].Subject != "new-sub" {
+		t.Fatalf("identities = %+v, want the provider account linked", ids)
+	}
+	if len(e.audit.entries) != 1 || e.audit.entries[0].Event != models.AuditIdentityLinked {
+		t.Errorf("audit log = %+v, want the link recorded", e.audit.entries)
+	}
+
+	// the next sign in finds alice by the linked identity
+	location, oidcState = e.begin(t, "")
+	code, state = e.provider.authorize(location, claims)
+	e.wantSignedIn(t, e.callback(code, state, oidcState), "alice")
+	if n := len(e.users.get("alice").Identities); n != 1 {
+		t.Errorf("alice has %d identities, want 1", n)
+	}
+}
+
+func TestOIDCUnverifiedEmailNotLinked(t *testing.T) {
+	e := newOIDCEnv(t, models.User{Username: "alice", Email: "alice@blog.example", EmailVerified: true})
+	location, oidcState := e.begin(t, "")
+	code, state := e.provider.authorize(location, map[string]interface{}{
+		"sub": "new-sub", "email": "alice@blog.example", "email_verified": false,
+	})
+
+	e.wantRefused(t, e.callback(code, state, oidcState), "No account here is linked")
+	if ids := e.users.get("alice").Identities; len(ids) != 0 {
+		t.Errorf("identities = %+v, want none linked for an unverified address", ids)
+	}
+}
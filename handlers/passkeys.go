@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ceremonyCookie holds the token of the WebAuthn registration or sign in in progress
+const ceremonyCookie = "webauthn"
+
+// errPasskeyFailed is shown for any passkey sign in that cannot be verified
+var errPasskeyFailed = errors.New("Passkey sign in failed. Please try again.")
+
+// webAuthn returns the WebAuthn relying party for the configured origin
+func (env *Env) webAuthn() (*webauthn.WebAuthn, error) {
+	origin := env.webAuthnOrigin
+	if origin == "" {
+		return nil, errors.New("passkeys are not configured: no WebAuthn origin is set")
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: models.TOTPIssuer,
+		RPID:          u.Hostname(),
+		RPOrigin:      origin,
+	})
+}
+
+// beginCeremony stores the session data of a WebAuthn ceremony, sets its cookie
+// and writes the options for the browser
+func (env *Env) beginCeremony(w http.ResponseWriter, r *http.Request, kind, username string, session *webauthn.SessionData, options interface{}) {
+	token, err := env.ceremonies.Begin(r.Context(), models.Ceremony{Kind: kind, Username: username, Session: *session})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(models.CeremonyLifetime.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+	})
+	writeJSON(w, http.StatusOK, options)
+}
+
+// finishCeremony returns the ceremony of kind started by this browser, which can only be finished once
+func (env *Env) finishCeremony(w http.ResponseWriter, r *http.Request, kind string) (models.Ceremony, error) {
+	cookie, err := r.Cookie(ceremonyCookie)
+	if err != nil {
+		return models.Ceremony{}, models.ErrTokenInvalid
+	}
+	http.SetCookie(w, &http.Cookie{Name: ceremonyCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+	return env.ceremonies.Finish(r.Context(), cookie.Value, kind)
+}
+
+// Passkeys handles the passkey management endpoints:
+// POST /passkeys/register/begin returns the options for navigator.credentials.create()
+// POST /passkeys/register/finish?name=NAME verifies and stores the new credential
+// POST /passkeys/ with action=delete removes a passkey and renders the account page
+func (env *Env) Passkeys(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/passkeys/register/begin":
+		env.beginPasskeyRegistration(w, r, au)
+		return
+	case "/passkeys/register/finish":
+		env.finishPasskeyRegistration(w, r, au)
+		return
+	}
+
+	flash := "Unknown action."
+	if r.FormValue("action") == "delete" {
+		err := env.users.RemovePasskey(r.Context(), au.user.Username, r.FormValue("id"))
+		if err != nil {
+			flash = err.Error()
+		} else {
+			flash = "Passkey removed."
+		}
+	}
+
+	// reload so the passkey list reflects the change
+	user, err := env.users.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	au.user = user
+	env.renderAccount(w, r, au, flash, "")
+}
+
+func (env *Env) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	wa, err := env.webAuthn()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user := models.WebAuthnUser{User: au.user}
+	if len(user.User.WebAuthnID) == 0 {
+		user.User.WebAuthnID, err = models.NewWebAuthnID()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, len(user.Passkeys))
+	for i, cred := range user.WebAuthnCredentials() {
+		exclude[i] = cred.Descriptor()
+	}
+	options, session, err := wa.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithExclusions(exclude))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	env.beginCeremony(w, r, models.CeremonyRegister, au.user.Username, session, options)
+}
+
+func (env *Env) finishPasskeyRegistration(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	ceremony, err := env.finishCeremony(w, r, models.CeremonyRegister)
+	if err != nil || ceremony.Username != au.user.Username {
+		writeAPIError(w, http.StatusBadRequest, "registration expired, please try again")
+		return
+	}
+
+	wa, err := env.webAuthn()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the handle was generated when registration began, and is kept if the user has one already
+	user := models.WebAuthnUser{User: au.user}
+	user.User.WebAuthnID = ceremony.Session.UserID
+	cred, err := wa.FinishRegistration(user, ceremony.Session, r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "the passkey could not be verified: "+err.Error())
+		return
+	}
+
+	pk := models.NewPasskey(r.URL.Query().Get("name"), *cred)
+	err = env.users.AddPasskey(r.Context(), au.user.Username, ceremony.Session.UserID, pk)
+	if err == mongo.ErrNoDocuments {
+		writeAPIError(w, http.StatusConflict, "registration expired, please try again")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": pk.ID, "name": pk.Name})
+}
+
+// SignInPasskey handles passwordless sign in with a discoverable passkey:
+// POST /signin/passkey/begin returns the options for navigator.credentials.get()
+// POST /signin/passkey/finish[?remember=1] verifies the assertion and starts the session.
+// The passkey must verify the user (with a PIN or biometrics), so it counts as two factors
+func (env *Env) SignInPasskey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	wa, err := env.webAuthn()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/signin/passkey/begin":
+		options, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		env.beginCeremony(w, r, models.CeremonyLogin, "", session, options)
+	case "/signin/passkey/finish":
+		ceremony, err := env.finishCeremony(w, r, models.CeremonyLogin)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errPasskeyFailed.Error())
+			return
+		}
+		parsed, err := protocol.ParseCredentialRequestResponse(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errPasskeyFailed.Error())
+			return
+		}
+
+		var user models.User
+		cred, err := wa.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			found, err := env.users.GetByWebAuthnID(r.Context(), userHandle)
+			user = found
+			return models.WebAuthnUser{User: found}, err
+		}, ceremony.Session, parsed)
+		if err != nil || cred.Authenticator.CloneWarning {
+			writeAPIError(w, http.StatusUnauthorized, errPasskeyFailed.Error())
+			return
+		}
+		env.finishPasskeySignIn(w, r, user, cred, r.URL.Query().Get("remember") != "")
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// secondFactorPasskey handles the passkey endpoints of the second factor step for u:
+// POST /signin/2fa/passkey/begin and POST /signin/2fa/passkey/finish
+func (env *Env) secondFactorPasskey(w http.ResponseWriter, r *http.Request, u models.User) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	wa, err := env.webAuthn()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/signin/2fa/passkey/begin":
+		options, session, err := wa.BeginLogin(models.WebAuthnUser{User: u})
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		env.beginCeremony(w, r, models.CeremonySecondFactor, u.Username, session, options)
+	case "/signin/2fa/passkey/finish":
+		ceremony, err := env.finishCeremony(w, r, models.CeremonySecondFactor)
+		if err != nil || ceremony.Username != u.Username {
+			writeAPIError(w, http.StatusBadRequest, errPasskeyFailed.Error())
+			return
+		}
+		cred, err := wa.FinishLogin(models.WebAuthnUser{User: u}, ceremony.Session, r)
+		if err != nil || cred.Authenticator.CloneWarning {
+			writeAPIError(w, http.StatusUnauthorized, errPasskeyFailed.Error())
+			return
+		}
+
+		err = env.users.EndMFAChallenge(r.Context(), u.Username)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = env.logins.ClearFailures(r.Context(), models.AccountKey(u.Username))
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: mfaCookie, Path: "/signin/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+		env.finishPasskeySignIn(w, r, u, cred, u.MFAChallenge.Remember)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// finishPasskeySignIn records the use of the passkey and starts a session for u,
+// answering with the page the browser should go to
+func (env *Env) finishPasskeySignIn(w http.ResponseWriter, r *http.Request, u models.User, cred *webauthn.Credential, remember bool) {
+	err := env.users.UpdatePasskeyUse(r.Context(), u.Username, cred.ID, cred.Authenticator.SignCount)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = env.setSession(w, r, u, remember)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/changepwd/"})
+}
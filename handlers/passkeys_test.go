@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/tydar/mdbssg/models"
+)
+
+const testOrigin = "https://blog.example"
+
+// softAuthenticator is a passkey held in memory, answering ceremonies the way a
+// browser and a platform authenticator would
+type softAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	counter    uint32
+	origin     string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{t: t, key: key, credID: credID, origin: testOrigin}
+}
+
+// authData returns the authenticator data, with the credential and its public key when attested is set
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("blog.example"))
+	flags := byte(0x01 | 0x04) // user present and verified
+	if attested {
+		flags |= 0x40
+	}
+	var data bytes.Buffer
+	data.Write(rpIDHash[:])
+	data.WriteByte(flags)
+	binary.Write(&data, binary.BigEndian, a.counter)
+	if attested {
+		data.Write(make([]byte, 16)) // AAGUID
+		binary.Write(&data, binary.BigEndian, uint16(len(a.credID)))
+		data.Write(a.credID)
+		coseKey, err := webauthncbor.Marshal(map[int]interface{}{
+			1:  2,  // kty: EC2
+			3:  -7, // alg: ES256
+			-1: 1,  // crv: P-256
+			-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+			-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+		})
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		data.Write(coseKey)
+	}
+	return data.Bytes()
+}
+
+// clientData returns the client data a browser collects for a ceremony of kind
+func (a *softAuthenticator) clientData(kind string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return b
+}
+
+// create answers navigator.credentials.create() for the options returned by the server
+func (a *softAuthenticator) create(options []byte) []byte {
+	var opts struct {
+		PublicKey struct {
+			// the challenge and user handle are sent as standard base64
+			Challenge []byte
+			User      struct{ ID []byte }
+		}
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("decoding creation options %s: %v", options, err)
+	}
+	a.userHandle = opts.PublicKey.User.ID
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(true),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", opts.PublicKey.Challenge)),
+		},
+	})
+	return body
+}
+
+// get answers navigator.credentials.get() for the options returned by the server,
+// counting the use as an authenticator does
+func (a *softAuthenticator) get(options []byte) []byte {
+	var opts struct {
+		PublicKey struct{ Challenge []byte }
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		a.t.Fatalf("decoding request options %s: %v", options, err)
+	}
+	a.counter++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", opts.PublicKey.Challenge)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.credID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+func newPasskeyEnv(t *testing.T) (*Env, *memUsers, *memSessions) {
+	users := newMemUsers(models.User{Username: "alice"})
+	sessions := &memSessions{}
+	return newTestEnv(EnvConfig{Users: users, Ceremonies: &memCeremonies{}, Sessions: sessions, WebAuthnOrigin: testOrigin}), users, sessions
+}
+
+// ceremonyRequest returns a POST to path carrying body and the ceremony cookie
+func ceremonyRequest(path string, body []byte, token string) *http.Request {
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: ceremonyCookie, Value: token})
+	}
+	return r
+}
+
+// begin starts a ceremony, returning its options and cookie
+func begin(t *testing.T, handler http.HandlerFunc, path string) ([]byte, string) {
+	t.Helper()
+	resp := serve(handler, ceremonyRequest(path, nil, ""))
+	var options bytes.Buffer
+	options.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", path, resp.StatusCode, options.String())
+	}
+	token := cookie(resp, ceremonyCookie)
+	if token == "" {
+		t.Fatalf("%s did not set the ceremony cookie", path)
+	}
+	return options.Bytes(), token
+}
+
+// registerPasskey registers auth for alice
+func registerPasskey(t *testing.T, env *Env, users *memUsers, auth *softAuthenticator) {
+	t.Helper()
+	passkeys := func(w http.ResponseWriter, r *http.Request) {
+		env.Passkeys(w, r, AuthUser{user: users.get("alice")})
+	}
+	options, token := begin(t, passkeys, "/passkeys/register/begin")
+	body := auth.create(options)
+	resp := serve(passkeys, ceremonyRequest("/passkeys/register/finish?name=Laptop", body, token))
+	if resp.StatusCode != http.StatusCreated {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		t.Fatalf("finishing registration: status %d: %s", resp.StatusCode, msg.String())
+	}
+
+	// the registration challenge cannot be answered twice
+	resp = serve(passkeys, ceremonyRequest("/passkeys/register/finish?name=Laptop", body, token))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed registration: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	env, users, _ := newPasskeyEnv(t)
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, env, users, auth)
+
+	alice := users.get("alice")
+	if len(alice.Passkeys) != 1 {
+		t.Fatalf("alice has %d passkeys, want 1", len(alice.Passkeys))
+	}
+	pk := alice.Passkeys[0]
+	if pk.Name != "Laptop" || !bytes.Equal(pk.CredentialID, auth.credID) {
+		t.Errorf("passkey = %+v, want Laptop with the authenticator's credential", pk)
+	}
+	if !bytes.Equal(alice.WebAuthnID, auth.userHandle) {
+		t.Error("the user handle given to the authenticator was not stored")
+	}
+}
+
+func TestPasskeyRegistrationWrongOrigin(t *testing.T) {
+	env, users, _ := newPasskeyEnv(t)
+	auth := newSoftAuthenticator(t)
+	auth.origin = "https://evil.example"
+	passkeys := func(w http.ResponseWriter, r *http.Request) {
+		env.Passkeys(w, r, AuthUser{user: users.get("alice")})
+	}
+	options, token := begin(t, passkeys, "/passkeys/register/begin")
+	resp := serve(passkeys, ceremonyRequest("/passkeys/register/finish?name=Laptop", auth.create(options), token))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if n := len(users.get("alice").Passkeys); n != 0 {
+		t.Errorf("alice has %d passkeys, want none", n)
+	}
+}
+
+func TestPasskeySignIn(t *testing.T) {
+	env, users, sessions := newPasskeyEnv(t)
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, env, users, auth)
+
+	options, token := begin(t, env.SignInPasskey, "/signin/passkey/begin")
+	resp := serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish?remember=1", auth.get(options), token))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if cookie(resp, sessionCookie) == "" {
+		t.Error("no session cookie was set")
+	}
+	started := sessions.started(t)
+	if len(started) != 1 || started[0].Username != "alice" || !started[0].Remember {
+		t.Errorf("sessions = %+v, want one remembered session for alice", started)
+	}
+	if pk := users.get("alice").Passkeys[0]; pk.SignCount != 1 || pk.LastUsedAt.IsZero() {
+		t.Errorf("passkey = %+v, want its use recorded with sign count 1", pk)
+	}
+}
+
+func TestPasskeySignInChallengeReplay(t *testing.T) {
+	env, users, sessions := newPasskeyEnv(t)
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, env, users, auth)
+
+	options, token := begin(t, env.SignInPasskey, "/signin/passkey/begin")
+	body := auth.get(options)
+	resp := serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish", body, token))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// the ceremony is gone once finished
+	resp = serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish", body, token))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replay with the same ceremony: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// and the assertion does not answer a new challenge
+	_, token = begin(t, env.SignInPasskey, "/signin/passkey/begin")
+	resp = serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish", body, token))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replay against a new challenge: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	if n := len(sessions.started(t)); n != 1 {
+		t.Errorf("%d sessions started, want 1", n)
+	}
+}
+
+func TestPasskeySignInCloneWarning(t *testing.T) {
+	env, users, sessions := newPasskeyEnv(t)
+	auth := newSoftAuthenticator(t)
+	registerPasskey(t, env, users, auth)
+
+	for i := 0; i < 2; i++ {
+		options, token := begin(t, env.SignInPasskey, "/signin/passkey/begin")
+		resp := serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish", auth.get(options), token))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("sign in %d: status %d, want %d", i+1, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// a copy of the key whose counter has not moved on since the last sign in
+	auth.counter = 1
+	options, token := begin(t, env.SignInPasskey, "/signin/passkey/begin")
+	resp := serve(env.SignInPasskey, ceremonyRequest("/signin/passkey/finish", auth.get(options), token))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if n := len(sessions.started(t)); n != 2 {
+		t.Errorf("%d sessions started, want 2", n)
+	}
+	if pk := users.get("alice").Passkeys[0]; pk.SignCount != 2 {
+		t.Errorf("sign count = %d, want 2", pk.SignCount)
+	}
+}
+
+func TestWebAuthnOrigin(t *testing.T) {
+	if _, err := newTestEnv(EnvConfig{}).webAuthn(); err == nil {
+		t.Error("passkeys were set up without a configured origin")
+	}
+	wa, err := newTestEnv(EnvConfig{BaseURL: testOrigin + "/"}).webAuthn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wa.Config.RPOrigin != testOrigin || wa.Config.RPID != "blog.example" {
+		t.Errorf("origin %q and ID %q, want them taken from the base URL", wa.Config.RPOrigin, wa.Config.RPID)
+	}
+}
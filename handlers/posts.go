@@ -2,40 +2,66 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"html/template"
+	"io/fs"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/tydar/mdbssg/host"
 	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/render"
+	"github.com/tydar/mdbssg/themes"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // --- response models
 
 type postResponse struct {
-	Title    string
-	Subtitle string
-	Author   string
-	Content  []string
-	Pubdate  string
+	Title       string
+	Subtitle    string
+	Author      string
+	Content     template.HTML
+	Pubdate     string
+	TOC         template.HTML
+	Headings    []render.Heading
+	WordCount   int
+	ReadingTime int
 }
 
 // creates a postResponse object from a models.Post
+// Content is left empty; use renderPost when the body is displayed
 func postResponseFromPostModel(post models.Post) postResponse {
-	tokContent := strings.Split(strings.ReplaceAll(post.Content, "\r\n", "\n"), "\n\n")
 	pd := post.Pubdate.Format("2006-01-02")
 	return postResponse{
 		Title:    post.Title,
 		Subtitle: post.Subtitle,
 		Author:   post.Author,
-		Content:  tokContent,
 		Pubdate:  pd,
 	}
 }
 
+// creates a postResponse object from a models.Post with its content rendered by rn
+func renderPost(post models.Post, rn *render.Renderer) (postResponse, error) {
+	pr := postResponseFromPostModel(post)
+	res, err := rn.Render(post.Content)
+	if err != nil {
+		return postResponse{}, err
+	}
+	pr.Content = res.HTML
+	pr.TOC = res.TOC
+	pr.Headings = res.Headings
+	pr.WordCount = res.WordCount
+	pr.ReadingTime = res.ReadingTime
+	return pr, nil
+}
+
 type listResponse struct {
 	Title string
 	Slug  string
@@ -70,22 +96,39 @@ func (env *Env) ViewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 			canEdit = true
 		}
 
+		// render with the shortcodes of the post owner's theme so the preview matches the generated page
+		site, err := env.siteSettings(r.Context(), post.OwnerUsername)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rn, err := env.renderer(env.siteTheme(site))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pr, err := renderPost(post, rn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// need to find a cleaner way to document typing for these structs
 		// actually what we want to do is create a PostResponse type
 		// and reformat the models.Post.Content -> []string split on newlines
 		// so that we can change the template to wrap each split into <p>...</p>
 		td := struct {
-			Post     postResponse
-			LoggedIn bool
-			Flash    string
-			Slug     string
-			CanEdit  bool
+			TemplateData
+			Post      postResponse
+			Slug      string
+			CanEdit   bool
+			CodeStyle string
 		}{
-			Post:     postResponseFromPostModel(post),
-			LoggedIn: false,
-			Flash:    "",
-			Slug:     slug,
-			CanEdit:  canEdit,
+			TemplateData: env.newTemplateData(r, false, ""),
+			Post:         pr,
+			Slug:         slug,
+			CanEdit:      canEdit,
+			CodeStyle:    site.CodeStyle,
 		}
 
 		err = env.templates["view_post"].ExecuteTemplate(w, "base", td)
@@ -110,11 +153,11 @@ func (env *Env) ViewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 		}
 
 		td := struct {
-			Flash string
+			TemplateData
 			Posts []listResponse
 		}{
-			Flash: "",
-			Posts: listPosts,
+			TemplateData: env.newTemplateData(r, true, ""),
+			Posts:        listPosts,
 		}
 		if err := env.templates["list_posts"].ExecuteTemplate(w, "base", td); err != nil {
 			http.Error(w, fmt.Sprintf("list view: %v", err), http.StatusInternalServerError)
@@ -139,17 +182,19 @@ func (env *Env) EditPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 	// pull out some specific fields from the models.Post
 	// because postResponse doesn't give what we need
 	td := struct {
-		Slug     string
-		Post     postResponse
-		Content  string
-		LoggedIn bool
-		Flash    string
+		TemplateData
+		Slug    string
+		Post    postResponse
+		Content string
+		Tags    string
+		Draft   bool
 	}{
-		Slug:     post.Slug,
-		Content:  post.Content,
-		Post:     postResponseFromPostModel(post),
-		LoggedIn: true,
-		Flash:    "",
+		TemplateData: env.newTemplateData(r, true, ""),
+		Slug:         post.Slug,
+		Content:      post.Content,
+		Tags:         strings.Join(post.Tags, ", "),
+		Draft:        post.Draft,
+		Post:         postResponseFromPostModel(post),
 	}
 
 	err = env.templates["edit_post"].ExecuteTemplate(w, "base", td)
@@ -169,7 +214,7 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 		author := r.FormValue("author")
 		date := r.FormValue("date")
 		username := au.user.Username
-		content := r.FormValue("content")
+		content := strings.TrimSpace(r.FormValue("content"))
 
 		dateParseString := "2006-01-02"
 		pubdate, err := time.Parse(dateParseString, date)
@@ -177,7 +222,7 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
-		slug := filepath.Clean(title + "-" + date)
+		slug := models.DefaultSlug(title, pubdate)
 
 		post := models.Post{
 			Title:         title,
@@ -187,6 +232,23 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 			OwnerUsername: username,
 			Content:       content,
 			Slug:          slug,
+			Tags:          parseTags(r.FormValue("tags")),
+			Draft:         r.FormValue("draft") == "on",
+		}
+
+		if !models.ValidSlug(slug) {
+			td := struct {
+				TemplateData
+				Post models.Post
+			}{
+				TemplateData: env.newTemplateData(r, true, "title must not contain /, \\, ? or #"),
+				Post:         post,
+			}
+			err := env.templates["new_post"].ExecuteTemplate(w, "base", td)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
 		}
 
 		_, err = env.posts.GetBySlug(r.Context(), slug)
@@ -194,13 +256,11 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 			// render the new post form with an error flash
 			// we already have a post with this slug
 			td := struct {
-				Post     models.Post
-				LoggedIn bool
-				Flash    string
+				TemplateData
+				Post models.Post
 			}{
-				Post:     post,
-				LoggedIn: true,
-				Flash:    "post with this title and publish date already exists",
+				TemplateData: env.newTemplateData(r, true, "post with this title and publish date already exists"),
+				Post:         post,
 			}
 			err := env.templates["new_post"].ExecuteTemplate(w, "base", td)
 			if err != nil {
@@ -216,13 +276,11 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 		return
 	} else if r.Method == "GET" {
 		td := struct {
-			Post     models.Post
-			LoggedIn bool
-			Flash    string
+			TemplateData
+			Post models.Post
 		}{
-			Post:     models.Post{},
-			LoggedIn: true,
-			Flash:    "",
+			TemplateData: env.newTemplateData(r, true, ""),
+			Post:         models.Post{},
 		}
 		err := env.templates["new_post"].ExecuteTemplate(w, "base", td)
 		if err != nil {
@@ -236,12 +294,16 @@ func (env *Env) NewPost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 // SavePost handles POST requests to update or create a post
 func (env *Env) SavePost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 	slug := r.URL.Path[len("/save/"):]
+	if !models.ValidSlug(slug) {
+		http.Error(w, "invalid slug: it must be non-empty and must not contain /, \\, ? or #", http.StatusBadRequest)
+		return
+	}
 	title := r.FormValue("title")
 	subtitle := r.FormValue("subtitle")
 	author := r.FormValue("author")
 	date := r.FormValue("date")
 	username := au.user.Username
-	content := r.FormValue("content")
+	content := strings.TrimSpace(r.FormValue("content"))
 
 	dateParseString := "2006-01-02"
 	pubdate, err := time.Parse(dateParseString, date)
@@ -258,6 +320,8 @@ func (env *Env) SavePost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 		OwnerUsername: username,
 		Content:       content,
 		Slug:          slug,
+		Tags:          parseTags(r.FormValue("tags")),
+		Draft:         r.FormValue("draft") == "on",
 	}
 
 	postVal, err := env.posts.GetBySlug(r.Context(), slug)
@@ -280,50 +344,236 @@ func (env *Env) SavePost(w http.ResponseWriter, r *http.Request, au AuthUser) {
 	http.Redirect(w, r, "/post/"+slug, http.StatusFound)
 }
 
-// GeneratePosts invokes functions to generate a new static site
+// GeneratePosts handles POST requests to generate a new static site
 // at the configured subdir
 func (env *Env) GeneratePosts(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	username := au.user.Username
-	posts, err := env.posts.GetByUsername(r.Context(), username)
+	err := env.publishSite(r.Context(), username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	http.Redirect(w, r, "/static/"+username+"/", http.StatusFound)
+}
+
+// --- utility functions
+
+// parseTags splits a comma separated tags form value
+func parseTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// pageData is passed to theme layouts when generating a site
+type pageData struct {
+	Site  models.Site
+	Post  postResponse
+	Posts []listResponse
+}
+
+// siteSettings returns the saved settings for a user's site, or the defaults if there are none
+func (env *Env) siteSettings(ctx context.Context, username string) (models.Site, error) {
+	site, err := env.sites.GetByUsername(ctx, username)
+	if err == mongo.ErrNoDocuments {
+		return models.Site{OwnerUsername: username, Theme: themes.DefaultTheme, CodeStyle: render.DefaultCodeStyle}, nil
+	}
+	if site.CodeStyle == "" {
+		site.CodeStyle = render.DefaultCodeStyle
+	}
+	return site, err
+}
+
+// siteTheme returns the theme selected for a site, falling back to the default theme
+// if the selected one is no longer registered
+func (env *Env) siteTheme(site models.Site) *themes.Theme {
+	if t, ok := env.themes.Get(site.Theme); ok {
+		return t
+	}
+	t, _ := env.themes.Get(themes.DefaultTheme)
+	return t
+}
+
+// renderer returns a content renderer using the built-in shortcodes and those supplied by theme
+func (env *Env) renderer(theme *themes.Theme) (*render.Renderer, error) {
+	sources, err := theme.ShortcodeSources()
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := env.shortcodes.With(sources)
+	if err != nil {
+		return nil, err
+	}
+	return render.New(sc), nil
+}
+
+// userTheme returns the site's theme with the owner's template overrides applied
+func (env *Env) userTheme(ctx context.Context, site models.Site) (*themes.Theme, error) {
+	theme := env.siteTheme(site)
+
+	overrides, err := env.overrideSources(ctx, site.OwnerUsername)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return theme, nil
+	}
+	return theme.Override(overrides)
+}
 
+// generateSite renders every post of a user plus an index page with the site's theme
+// and pushes them, along with the theme's static assets, to h
+func (env *Env) generateSite(ctx context.Context, username string, h host.Host) error {
+	site, err := env.siteSettings(ctx, username)
+	if err != nil {
+		return err
+	}
+	theme, err := env.userTheme(ctx, site)
+	if err != nil {
+		return err
+	}
+
+	posts, err := env.posts.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	rn, err := env.renderer(theme)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Pubdate.After(posts[j].Pubdate) })
+
+	listPosts := make([]listResponse, 0, len(posts))
 	for _, p := range posts {
-		pr := postResponseFromPostModel(p)
-		text, err := env.generatePost(pr)
+		if p.Draft {
+			continue
+		}
+		listPosts = append(listPosts, listResponseFromPostModel(p))
+
+		pr, err := renderPost(p, rn)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return fmt.Errorf("%s: %v", p.Slug, err)
 		}
 
-		err = env.theHost.Save(text, p.Slug, username)
+		buf := new(bytes.Buffer)
+		err = theme.Render(buf, "post", pageData{Site: site, Post: pr})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
+		}
+
+		err = h.Save(buf.String(), p.Slug, username)
+		if err != nil {
+			return err
+		}
+
+		for _, alias := range p.Aliases {
+			err := saveRedirect(h, alias, p.Slug, username)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	http.Redirect(w, r, "/static/"+username+"/", http.StatusFound)
+
+	buf := new(bytes.Buffer)
+	err = theme.Render(buf, "index", pageData{Site: site, Posts: listPosts})
+	if err != nil {
+		return err
+	}
+	err = h.Save(buf.String(), "index", username)
+	if err != nil {
+		return err
+	}
+
+	css := new(bytes.Buffer)
+	err = render.WriteCodeCSS(css, site.CodeStyle)
+	if err != nil {
+		return err
+	}
+	err = h.SaveAsset(css.Bytes(), "syntax.css", username)
+	if err != nil {
+		return err
+	}
+
+	media, err := env.media.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	for _, m := range media {
+		err := h.SaveAsset(m.Data, path.Join("media", m.Name), username)
+		if err != nil {
+			return err
+		}
+	}
+
+	return publishStatic(theme.Static(), "theme", username, h)
 }
 
-// --- utility functions
+var redirectTemplate = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>Redirecting</title>
+		<link rel="canonical" href="{{ . }}">
+		<meta http-equiv="refresh" content="0; url={{ . }}">
+	</head>
+	<body>
+		<p>This page has moved to <a href="{{ . }}">{{ . }}</a>.</p>
+	</body>
+</html>
+`))
+
+// saveRedirect saves a page at the alias path that redirects to the post with the given slug.
+// Aliases ending in "/" are saved as that directory's index.html
+func saveRedirect(h host.Host, alias, slug, username string) error {
+	name := strings.TrimPrefix(path.Clean("/"+alias), "/")
+	if strings.HasSuffix(alias, "/") || name == "" {
+		name = path.Join(name, "index")
+	} else {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if name == slug || name == "index" {
+		return nil
+	}
 
-func (env *Env) generatePost(pr postResponse) (string, error) {
-	t := env.templates["gen_post"]
+	target := strings.Repeat("../", strings.Count(name, "/")) + slug + ".html"
 	buf := new(bytes.Buffer)
-	td := struct {
-		Post    postResponse
-		CanEdit bool
-	}{
-		Post:    pr,
-		CanEdit: false,
-	}
-	err := t.ExecuteTemplate(buf, "base", td)
+	err := redirectTemplate.Execute(buf, target)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return buf.String(), nil
+	return h.Save(buf.String(), name, username)
+}
+
+// publishStatic copies every file in fsys to h under dir
+func publishStatic(fsys fs.FS, dir, username string, h host.Host) error {
+	if fsys == nil {
+		return nil
+	}
+
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		return h.SaveAsset(data, path.Join(dir, p), username)
+	})
 }
 
 func saveGeneratedPost(text, slug, dir, username string) error {
@@ -342,3 +592,45 @@ func saveGeneratedPost(text, slug, dir, username string) error {
 	f.Close()
 	return nil
 }
+
+// DownloadSite generates the user's site into a zip or tar.gz archive, chosen by the
+// "format" query parameter, and streams it back instead of publishing to the host
+func (env *Env) DownloadSite(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+
+	// generate into a temporary file so a failure can still be reported as an error page
+	f, err := os.CreateTemp("", "mdbssg-site-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	archive, err := host.NewArchiveHost(f, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = env.generateSite(r.Context(), au.user.Username, archive)
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "application/zip"
+	if format == "tar.gz" {
+		contentType = "application/gzip"
+	}
+	filename := fmt.Sprintf("%s-site-%s.%s", au.user.Username, time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, time.Now(), f)
+}
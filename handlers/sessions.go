@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/tydar/mdbssg/models"
+)
+
+// sessionCookie holds the signed in browser's session ID and token, signed with the session keys
+const sessionCookie = "session"
+
+// NewSessionKey returns a random key for signing session cookies
+func NewSessionKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// signValue returns value followed by its HMAC-SHA256 signature with the first session key
+func (env *Env) signValue(value string) string {
+	mac := hmac.New(sha256.New, env.sessionKeys[0])
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyValue returns the value of a string made by signValue with any of the session keys
+func (env *Env) verifyValue(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+	for _, key := range env.sessionKeys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// signSessionCookie returns the session cookie value for a session: id.token.signature
+func (env *Env) signSessionCookie(id, token string) string {
+	return env.signValue(id + "." + token)
+}
+
+// parseSessionCookie returns the session ID and token of a correctly signed cookie value
+func (env *Env) parseSessionCookie(value string) (string, string, bool) {
+	value, ok := env.verifyValue(value)
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// isHTTPS reports whether r reached the site over HTTPS, directly or through a proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// clearSessionCookie removes the session cookie from the browser
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, SameSite: http.SameSiteLaxMode, HttpOnly: true, Secure: isHTTPS(r), Path: "/", MaxAge: -1})
+}
+
+// Sessions signs out one of the user's sessions (action=revoke) or every session including
+// this one (action=revoke_all) from the account page
+func (env *Env) Sessions(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/changepwd/", http.StatusFound)
+		return
+	}
+
+	flash := ""
+	switch r.FormValue("action") {
+	case "revoke":
+		err := env.sessions.Revoke(r.Context(), au.user.Username, r.FormValue("id"))
+		if err != nil {
+			flash = err.Error()
+		} else if r.FormValue("id") == au.session {
+			// this browser's own session was revoked
+			clearSessionCookie(w, r)
+			http.Redirect(w, r, "/signin/", http.StatusFound)
+			return
+		} else {
+			flash = "Session signed out."
+		}
+	case "revoke_all":
+		err := env.sessions.RevokeAll(r.Context(), au.user.Username, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		env.auditLog(r.Context(), models.AuditEntry{
+			Event:    models.AuditSessionsRevoked,
+			Username: au.user.Username,
+			IP:       env.clientIP(r),
+			Actor:    au.user.Username,
+		})
+		clearSessionCookie(w, r)
+		td := env.newTemplateData(r, false, "You have been signed out everywhere.")
+		err = env.templates["signin"].ExecuteTemplate(w, "base", td)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	env.renderAccount(w, r, au, flash, "")
+}
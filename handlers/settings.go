@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/render"
+	"github.com/tydar/mdbssg/themes"
+)
+
+type settingsData struct {
+	TemplateData
+	Site       models.Site
+	Themes     []themes.Meta
+	CodeStyles []string
+}
+
+// Settings handles GET requests to render the site settings form
+// and POST requests to save the title and theme of the signed in user's site
+func (env *Env) Settings(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	site, err := env.siteSettings(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := settingsData{
+		TemplateData: env.newTemplateData(r, true, ""),
+		Site:         site,
+		Themes:       env.themes.List(),
+		CodeStyles:   render.CodeStyles(),
+	}
+
+	if r.Method == "POST" {
+		theme := r.FormValue("theme")
+		if _, ok := env.themes.Get(theme); !ok {
+			td.Flash = "Unknown theme: " + theme
+		} else {
+			site.Title = r.FormValue("title")
+			site.Theme = theme
+			site.CodeStyle = r.FormValue("codestyle")
+			err := env.sites.Save(r.Context(), site)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			td.Site = site
+			td.Flash = "Settings saved!"
+		}
+	}
+
+	err = env.templates["settings"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SyntaxCSS serves the stylesheet for the code highlighting style named in the "style" query parameter
+// so that previews match generated sites
+func (env *Env) SyntaxCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	err := render.WriteCodeCSS(w, r.URL.Query().Get("style"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
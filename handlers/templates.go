@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/themes"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type overrideListItem struct {
+	Name       string
+	Overridden bool
+	UpdatedAt  string
+}
+
+type sourceLine struct {
+	Number int
+	Text   string
+	Bad    bool
+}
+
+type templateEditorData struct {
+	TemplateData
+	Name       string
+	Source     string
+	Overridden bool
+	Error      string
+	Lines      []sourceLine
+	Preview    string
+}
+
+// samplePosts are rendered in template previews so users can check an override
+// before it is used to generate their site
+var samplePosts = []models.Post{
+	{
+		Title:    "A Sample Post",
+		Subtitle: "Previewing your template",
+		Author:   "MDBSSG",
+		Content:  "This post is only used to preview templates.\n\nIt has a couple of paragraphs so that spacing can be checked.",
+		Slug:     "a-sample-post",
+		Pubdate:  time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC),
+	},
+	{
+		Title:    "Another Sample Post",
+		Subtitle: "Shown in the index preview",
+		Author:   "MDBSSG",
+		Content:  "A second post for the index page.",
+		Slug:     "another-sample-post",
+		Pubdate:  time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+// Templates handles the template override pages:
+// GET /templates/ lists the overridable templates
+// GET /templates/{name} renders the editor for one template
+// POST /templates/{name} previews, saves or reverts an override depending on the "action" form value
+func (env *Env) Templates(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	name := r.URL.Path[len("/templates/"):]
+	if name == "" {
+		env.listTemplates(w, r, au)
+		return
+	}
+
+	if _, ok := themes.Overridable[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	site, err := env.siteSettings(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	overrides, err := env.overrideSources(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	source, overridden := overrides[name]
+	if !overridden {
+		source, err = env.siteTheme(site).Source(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	td := templateEditorData{
+		TemplateData: env.newTemplateData(r, true, ""),
+		Name:         name,
+		Source:       source,
+		Overridden:   overridden,
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "revert":
+			err := env.overrides.Delete(r.Context(), au.user.Username, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/templates/"+name, http.StatusFound)
+			return
+		case "save", "preview":
+			td.Source = strings.ReplaceAll(r.FormValue("source"), "\r\n", "\n")
+			overrides[name] = td.Source
+
+			preview, err := env.previewTheme(site, overrides, name)
+			if err != nil {
+				td.Error = err.Error()
+				td.Lines = numberLines(td.Source, name, err)
+				break
+			}
+			td.Preview = preview
+
+			if r.FormValue("action") == "save" {
+				err := env.overrides.Save(r.Context(), models.TemplateOverride{
+					OwnerUsername: au.user.Username,
+					Name:          name,
+					Source:        td.Source,
+				})
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				td.Overridden = true
+				td.Flash = "Template saved! It will be used the next time your site is generated."
+			}
+		}
+	}
+
+	err = env.templates["edit_template"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (env *Env) listTemplates(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	overrides, err := env.overrides.GetByUsername(r.Context(), au.user.Username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated := make(map[string]time.Time, len(overrides))
+	for _, o := range overrides {
+		updated[o.Name] = o.UpdatedAt
+	}
+
+	items := make([]overrideListItem, 0, len(themes.Overridable))
+	for name := range themes.Overridable {
+		item := overrideListItem{Name: name}
+		if t, ok := updated[name]; ok {
+			item.Overridden = true
+			item.UpdatedAt = t.Format("2006-01-02 15:04")
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	td := struct {
+		TemplateData
+		Templates []overrideListItem
+	}{
+		TemplateData: env.newTemplateData(r, true, ""),
+		Templates:    items,
+	}
+	err = env.templates["list_templates"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// overrideSources returns the user's saved overrides keyed by template name
+func (env *Env) overrideSources(ctx context.Context, username string) (map[string]string, error) {
+	overrides, err := env.overrides.GetByUsername(ctx, username)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	sources := make(map[string]string, len(overrides))
+	for _, o := range overrides {
+		sources[o.Name] = o.Source
+	}
+	return sources, nil
+}
+
+// previewTheme parses the site's theme with the given overrides and renders the page
+// affected by the edited template using sample posts
+func (env *Env) previewTheme(site models.Site, overrides map[string]string, name string) (string, error) {
+	theme, err := env.siteTheme(site).Override(overrides)
+	if err != nil {
+		return "", err
+	}
+
+	rn, err := env.renderer(theme)
+	if err != nil {
+		return "", err
+	}
+	pr, err := renderPost(samplePosts[0], rn)
+	if err != nil {
+		return "", err
+	}
+
+	td := pageData{Site: site, Post: pr}
+	page := "post"
+	if name == "index" {
+		page = "index"
+		td.Posts = make([]listResponse, len(samplePosts))
+		for i := range samplePosts {
+			td.Posts[i] = listResponseFromPostModel(samplePosts[i])
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = theme.Render(buf, page, td)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// numberLines splits source into numbered lines, marking the line a template error points at
+// when the error is in the edited template
+func numberLines(source, name string, err error) []sourceLine {
+	bad := 0
+	var te *themes.TemplateError
+	if errors.As(err, &te) && te.File == path.Base(themes.Overridable[name]) {
+		bad = te.Line
+	}
+
+	split := strings.Split(source, "\n")
+	lines := make([]sourceLine, len(split))
+	for i, text := range split {
+		lines[i] = sourceLine{Number: i + 1, Text: text, Bad: i+1 == bad}
+	}
+	return lines
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+)
+
+// mfaCookie holds the challenge token of a sign in waiting for its second factor
+const mfaCookie = "mfa"
+
+// beginSecondFactor starts a sign in challenge for u, whose password was correct,
+// and sends them to the second factor form
+func (env *Env) beginSecondFactor(w http.ResponseWriter, r *http.Request, u models.User, remember bool) {
+	token, err := env.users.BeginMFAChallenge(r.Context(), u.Username, remember)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaCookie,
+		Value:    token,
+		Path:     "/signin/",
+		MaxAge:   int(models.MFAChallengeLifetime.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+	})
+	http.Redirect(w, r, "/signin/2fa/", http.StatusFound)
+}
+
+// SignInSecondFactor handles GET requests to render the second factor form for a sign in
+// whose password was correct, and POST requests that check the TOTP or recovery code and
+// start the session. Wrong codes count as failed sign ins
+func (env *Env) SignInSecondFactor(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(mfaCookie)
+	if err != nil {
+		http.Redirect(w, r, "/signin/", http.StatusFound)
+		return
+	}
+	u, err := env.users.GetByMFAChallenge(r.Context(), cookie.Value)
+	if err == models.ErrTokenInvalid {
+		td := env.newTemplateData(r, false, "Your sign in expired. Please sign in again.")
+		err := env.templates["signin"].ExecuteTemplate(w, "base", td)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/signin/2fa/passkey/") {
+		env.secondFactorPasskey(w, r, u)
+		return
+	}
+
+	flash := ""
+	if r.Method == "POST" {
+		flash, err = env.checkSecondFactor(r, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if flash == "" {
+			err := env.users.EndMFAChallenge(r.Context(), u.Username)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: mfaCookie, Path: "/signin/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+			env.startSession(w, r, u, u.MFAChallenge.Remember)
+			return
+		}
+	}
+
+	td := struct {
+		TemplateData
+		Passkeys bool
+	}{
+		TemplateData: env.newTemplateData(r, false, flash),
+		Passkeys:     len(u.Passkeys) > 0,
+	}
+	err = env.templates["signin_2fa"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// checkSecondFactor checks the submitted code for u, returning the message to flash if
+// sign in should be refused
+func (env *Env) checkSecondFactor(r *http.Request, u models.User) (string, error) {
+	ctx := r.Context()
+	now := time.Now()
+	ip := env.clientIP(r)
+
+	err := env.loginBlocked(ctx, u.Username, ip, now)
+	if blocked, ok := err.(loginBlockedError); ok {
+		return blocked.Error(), nil
+	} else if err != nil {
+		return "", err
+	}
+
+	err = env.users.CheckSecondFactor(ctx, u, r.FormValue("code"))
+	if err == models.ErrCodeInvalid {
+		env.recordLoginFailure(ctx, u.Username, ip, now)
+		return "Incorrect or already used code.", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", env.logins.ClearFailures(ctx, models.AccountKey(u.Username))
+}
+
+type twoFactorData struct {
+	TemplateData
+	Enabled bool
+	// Secret and QRCode show the pending secret while enrolling
+	Secret string
+	QRCode template.URL
+	// RecoveryCodes are the codes just generated; they are only ever shown once
+	RecoveryCodes []string
+	RecoveryLeft  int
+}
+
+// TwoFactor handles the two-factor authentication page. GET shows the QR code of a new
+// secret to enroll, or the status when enabled. POST enables 2FA after checking a code
+// (action=enable), or, after checking the password, disables it (action=disable) or
+// replaces the recovery codes (action=recovery)
+func (env *Env) TwoFactor(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	flash := ""
+	var codes []string
+
+	if r.Method == "POST" {
+		var err error
+		flash, codes, err = env.twoFactorAction(r, au.user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// reload so the page reflects the change
+	user, err := env.users.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := twoFactorData{
+		TemplateData:  env.newTemplateData(r, true, flash),
+		Enabled:       user.TwoFactor.Enabled(),
+		RecoveryCodes: codes,
+		RecoveryLeft:  len(user.TwoFactor.RecoveryCodes),
+	}
+	if !td.Enabled {
+		td.Secret, td.QRCode, err = env.pendingTOTP(r, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = env.templates["twofactor"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// twoFactorAction performs the POSTed action and returns the message to flash
+// and any newly generated recovery codes
+func (env *Env) twoFactorAction(r *http.Request, user models.User) (string, []string, error) {
+	ctx := r.Context()
+
+	switch r.FormValue("action") {
+	case "enable":
+		codes, hashes, err := models.NewRecoveryCodes()
+		if err != nil {
+			return "", nil, err
+		}
+		err = env.users.EnableTOTP(ctx, user, r.FormValue("code"), hashes)
+		if err == models.ErrCodeInvalid {
+			return "That code did not match. Check the time on your device and try again.", nil, nil
+		} else if err != nil {
+			return "", nil, err
+		}
+		return "Two-factor authentication is on. Save your recovery codes now, they will not be shown again.", codes, nil
+	case "disable":
+		if msg, err := env.recheckPassword(r, user.Username, r.FormValue("password")); msg != "" || err != nil {
+			return msg, nil, err
+		}
+		return "Two-factor authentication is off.", nil, env.users.DisableTOTP(ctx, user.Username)
+	case "recovery":
+		if msg, err := env.recheckPassword(r, user.Username, r.FormValue("password")); msg != "" || err != nil {
+			return msg, nil, err
+		}
+		codes, hashes, err := models.NewRecoveryCodes()
+		if err != nil {
+			return "", nil, err
+		}
+		err = env.users.SetRecoveryCodes(ctx, user.Username, hashes)
+		if err != nil {
+			return "", nil, err
+		}
+		return "New recovery codes generated; the old ones no longer work. Save these now, they will not be shown again.", codes, nil
+	}
+	return "Unknown action.", nil, nil
+}
+
+// pendingTOTP returns the secret being enrolled, creating one if needed,
+// and its QR code as a PNG data URL
+func (env *Env) pendingTOTP(r *http.Request, user models.User) (string, template.URL, error) {
+	secret := user.TwoFactor.Pending
+	if secret == "" {
+		key, err := models.NewTOTPKey(user.Username)
+		if err != nil {
+			return "", "", err
+		}
+		secret = key.Secret()
+		err = env.users.BeginTOTP(r.Context(), user.Username, secret)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	key, err := models.TOTPKey(user.Username, secret)
+	if err != nil {
+		return "", "", err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
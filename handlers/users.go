@@ -3,10 +3,11 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/tydar/mdbssg/models"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func (env *Env) SignIn(w http.ResponseWriter, r *http.Request) {
@@ -17,7 +18,7 @@ func (env *Env) SignIn(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/changepwd/", http.StatusFound)
 			return
 		}
-		err = env.templates["signin"].ExecuteTemplate(w, "base", nil)
+		err = env.templates["signin"].ExecuteTemplate(w, "base", env.newTemplateData(r, false, ""))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -28,36 +29,63 @@ func (env *Env) SignIn(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/changepwd/", http.StatusFound)
 			return
 		}
-		u, err := env.users.GetByUsername(r.Context(), r.FormValue("username"))
-		if err == mongo.ErrNoDocuments {
-			td := TemplateData{Flash: "No user found! Try again."}
-			err = env.templates["signin"].ExecuteTemplate(w, "base", td)
-		}
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		good := models.CheckPassword(u, r.FormValue("password"))
-		if good {
-			t, err := env.users.AppendNewSession(r.Context(), u.Username)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			sessionCookie := http.Cookie{Name: "sessionid", Value: t, SameSite: 2, HttpOnly: true, Path: "/"}
-			unameCookie := http.Cookie{Name: "user", Value: u.Username, SameSite: 2, HttpOnly: true, Path: "/"}
-
-			http.SetCookie(w, &sessionCookie)
-			http.SetCookie(w, &unameCookie)
-			http.Redirect(w, r, "/changepwd/", http.StatusFound)
-		} else {
-			td := TemplateData{Flash: "Incorrect password! Please try again."}
+		u, err := env.checkLogin(r, r.FormValue("username"), r.FormValue("password"))
+		if _, blocked := err.(loginBlockedError); blocked || err == errBadLogin {
+			td := env.newTemplateData(r, false, err.Error())
 			err := env.templates["signin"].ExecuteTemplate(w, "base", td)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+
+		remember := r.FormValue("remember") != ""
+		if u.TwoFactor.Enabled() {
+			env.beginSecondFactor(w, r, u, remember)
+			return
+		}
+		env.startSession(w, r, u, remember)
+	}
+}
+
+// startSession signs u in on this browser and redirects to the account page
+func (env *Env) startSession(w http.ResponseWriter, r *http.Request, u models.User, remember bool) {
+	err := env.setSession(w, r, u, remember)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	http.Redirect(w, r, "/changepwd/", http.StatusFound)
+}
+
+// setSession creates a session for u and sets its cookies. Remembered sessions get
+// cookies that outlast the browser, otherwise they end when it is closed
+func (env *Env) setSession(w http.ResponseWriter, r *http.Request, u models.User, remember bool) error {
+	s, err := env.sessions.Create(r.Context(), models.Session{
+		Username:  u.Username,
+		Remember:  remember,
+		UserAgent: r.UserAgent(),
+		IP:        env.clientIP(r),
+	})
+	if err != nil {
+		return err
+	}
+	cookie := http.Cookie{
+		Name:     sessionCookie,
+		Value:    env.signSessionCookie(s.ID, s.Token),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		Path:     "/",
+	}
+	if remember {
+		cookie.Expires = s.AbsoluteExpiresAt
+	}
+	http.SetCookie(w, &cookie)
+	return nil
 }
 
 func (env *Env) SignUpHandler(w http.ResponseWriter, r *http.Request) {
@@ -68,7 +96,7 @@ func (env *Env) SignUpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
-		err = env.templates["signup"].ExecuteTemplate(w, "base", nil)
+		err = env.templates["signup"].ExecuteTemplate(w, "base", env.newTemplateData(r, false, ""))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -79,61 +107,179 @@ func (env *Env) SignUpHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = env.users.CreateUser(r.Context(), r.FormValue("username"), r.FormValue("password"), r.FormValue("username"))
+		err = env.users.CreateUser(r.Context(), r.FormValue("username"), r.FormValue("password"), r.FormValue("username"), r.FormValue("email"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		flash := "Account successfully created! We sent you a link to confirm your email address."
+		u, err := env.users.GetByUsername(r.Context(), r.FormValue("username"))
+		if err == nil {
+			err = env.sendVerification(r, u)
+		}
+		if err != nil {
+			log.Printf("sending verification email to %s: %v", r.FormValue("username"), err)
+			flash = "Account successfully created! The email to confirm your address could not be sent; you can send it again from the Account page."
+		}
+
 		// successfully signed up user, redirect to sign in form
-		td := TemplateData{Flash: "Account successfully created!"}
-		err := env.templates["signin"].ExecuteTemplate(w, "base", td)
+		td := env.newTemplateData(r, false, flash)
+		err = env.templates["signin"].ExecuteTemplate(w, "base", td)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
 }
 
+// SignOut handles POST requests to end the current session
 func (env *Env) SignOut(w http.ResponseWriter, r *http.Request, au AuthUser) {
-	err := env.users.InvalidateSession(r.Context(), au.user.Username, au.token)
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := env.sessions.Delete(r.Context(), au.token)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	clearSessionCookie(w, r)
 	http.Redirect(w, r, "/signin/", http.StatusFound)
 	return
 }
 
 func (env *Env) ChangePassword(w http.ResponseWriter, r *http.Request, au AuthUser) {
-	if r.Method == "GET" {
-		td := TemplateData{LoggedIn: true}
-		err := env.templates["changepwd"].ExecuteTemplate(w, "base", td)
+	flash := ""
+	if r.Method == "POST" {
+		err := env.changePassword(r, au.user)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			flash = err.Error()
+		} else {
+			// anyone who knew the old password should not stay signed in
+			err = env.sessions.RevokeAll(r.Context(), au.user.Username, au.token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			flash = "Password changed successfully! You have been signed out everywhere else."
 		}
 	}
+	env.renderAccount(w, r, au, flash, "")
+}
 
-	if r.Method == "POST" {
-		err := env.changePassword(r, au.user)
+// accountData is passed to the account page template
+type accountData struct {
+	TemplateData
+	Admin         bool
+	Email         string
+	EmailVerified bool
+	TwoFactor     bool
+	Passkeys      []models.Passkey
+	Identities    []models.Identity
+	Sessions      []models.Session
+	// CurrentSession is the ID of the session viewing the page
+	CurrentSession string
+	Tokens         []models.APIToken
+	Scopes         []struct{ Name, Description string }
+	// NewToken is the token just created; it is only ever shown once
+	NewToken string
+}
+
+func (env *Env) renderAccount(w http.ResponseWriter, r *http.Request, au AuthUser, flash, newToken string) {
+	sessions, err := env.sessions.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := accountData{
+		TemplateData:  env.newTemplateData(r, true, flash),
+		Admin:         au.user.Admin,
+		Email:         au.user.Email,
+		EmailVerified: au.user.EmailVerified,
+		TwoFactor:     au.user.TwoFactor.Enabled(),
+		Passkeys:      au.user.Passkeys,
+		Identities:    au.user.Identities,
+		Sessions:      sessions,
+		Tokens:        au.user.Tokens,
+		Scopes:        models.Scopes,
+		NewToken:      newToken,
+	}
+	for _, s := range sessions {
+		if s.HasToken(au.token) {
+			td.CurrentSession = s.ID
+		}
+	}
+
+	err = env.templates["changepwd"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// tokenLifetimes are the expiry choices offered when creating an API token
+var tokenLifetimes = map[string]time.Duration{
+	"30":  30 * 24 * time.Hour,
+	"90":  90 * 24 * time.Hour,
+	"365": 365 * 24 * time.Hour,
+}
+
+// Tokens creates (action=create) and revokes (action=revoke) the user's personal API tokens
+// from the account page
+func (env *Env) Tokens(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/changepwd/", http.StatusFound)
+		return
+	}
+
+	flash, newToken := "", ""
+	switch r.FormValue("action") {
+	case "create":
+		var expiresAt time.Time
+		if d, ok := tokenLifetimes[r.FormValue("expires")]; ok {
+			expiresAt = time.Now().Add(d)
+		}
+		r.ParseForm()
+		token, _, err := env.users.CreateToken(r.Context(), au.user.Username, r.FormValue("name"), r.Form["scopes"], expiresAt)
+		if err != nil {
+			flash = err.Error()
+		} else {
+			flash = "Token created. Copy it now, it will not be shown again."
+			newToken = token
+		}
+	case "revoke":
+		err := env.users.RevokeToken(r.Context(), au.user.Username, r.FormValue("id"))
 		if err != nil {
-			td := TemplateData{Flash: err.Error(), LoggedIn: true}
-			err = env.templates["changepwd"].ExecuteTemplate(w, "base", td)
+			flash = err.Error()
+		} else {
+			flash = "Token revoked."
 		}
-		td := TemplateData{Flash: "Password changed successfully!", LoggedIn: true}
-		err = env.templates["changepwd"].ExecuteTemplate(w, "base", td)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
 	}
-	return
+
+	// reload so the token list reflects the change
+	user, err := env.users.GetByUsername(r.Context(), au.user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	au.user = user
+	env.renderAccount(w, r, au, flash, newToken)
 }
 
 func (env *Env) changePassword(r *http.Request, user models.User) error {
-	oldPassword := r.FormValue("oldpassword")
-	good := models.CheckPassword(user, oldPassword)
-	if !good {
-		return errors.New("Current password incorrect.")
+	msg, err := env.recheckPassword(r, user.Username, r.FormValue("oldpassword"))
+	if err != nil {
+		return err
+	} else if msg != "" {
+		return errors.New(msg)
 	}
 
-	good = r.FormValue("newpassword") == r.FormValue("confirmpassword")
+	good := r.FormValue("newpassword") == r.FormValue("confirmpassword")
 	if !good {
 		return errors.New("New password and confirmation value do not match.")
 	}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/webhooks"
+)
+
+// deliveryLogSize is the number of recent deliveries shown on the webhooks page
+const deliveryLogSize = 50
+
+// notifyingPosts emits webhook events after posts are created, updated or deleted,
+// whichever handler (forms, API, Micropub, XML-RPC or import) made the change
+type notifyingPosts struct {
+	Posts
+	events Events
+}
+
+func (np *notifyingPosts) Create(ctx context.Context, post models.Post) error {
+	err := np.Posts.Create(ctx, post)
+	if err == nil {
+		np.events.Emit(ctx, post.OwnerUsername, webhooks.PostCreated, apiPostFromModel(post))
+	}
+	return err
+}
+
+func (np *notifyingPosts) Update(ctx context.Context, post models.Post) error {
+	err := np.Posts.Update(ctx, post)
+	if err == nil {
+		np.events.Emit(ctx, post.OwnerUsername, webhooks.PostUpdated, apiPostFromModel(post))
+	}
+	return err
+}
+
+func (np *notifyingPosts) Delete(ctx context.Context, slug string) error {
+	post, err := np.Posts.GetBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	err = np.Posts.Delete(ctx, slug)
+	if err == nil {
+		np.events.Emit(ctx, post.OwnerUsername, webhooks.PostDeleted, apiPostFromModel(post))
+	}
+	return err
+}
+
+// publishSite generates the user's site to the configured host, emitting the
+// generate.started event and then generate.succeeded or generate.failed
+func (env *Env) publishSite(ctx context.Context, username string) error {
+	siteURL := "/static/" + username + "/"
+	env.events.Emit(ctx, username, webhooks.GenerateStarted, map[string]string{"url": siteURL})
+
+	start := time.Now()
+	err := env.generateSite(ctx, username, env.theHost)
+	if err != nil {
+		env.events.Emit(ctx, username, webhooks.GenerateFailed, map[string]string{"url": siteURL, "error": err.Error()})
+		return err
+	}
+
+	env.events.Emit(ctx, username, webhooks.GenerateSucceeded, map[string]interface{}{
+		"url":         siteURL,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	return nil
+}
+
+type webhooksData struct {
+	TemplateData
+	Hooks      []models.Webhook
+	Deliveries []models.Delivery
+	Events     []string
+	MaxAttempt int
+}
+
+// Webhooks lists the user's webhooks and recent deliveries, and on POST creates
+// (action=create), deletes, enables or disables (action=toggle) or pings a webhook
+func (env *Env) Webhooks(w http.ResponseWriter, r *http.Request, au AuthUser) {
+	username := au.user.Username
+	flash := ""
+
+	if r.Method == "POST" {
+		var err error
+		flash, err = env.webhookAction(r, username)
+		if err != nil {
+			flash = err.Error()
+		}
+	}
+
+	hooks, err := env.webhooks.GetByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deliveries, err := env.webhooks.GetDeliveries(r.Context(), username, deliveryLogSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := webhooksData{
+		TemplateData: env.newTemplateData(r, true, flash),
+		Hooks:        hooks,
+		Deliveries:   deliveries,
+		Events:       webhooks.Events,
+		MaxAttempt:   webhooks.MaxAttempts,
+	}
+	err = env.templates["webhooks"].ExecuteTemplate(w, "base", td)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// webhookAction performs the POSTed action and returns the message to flash
+func (env *Env) webhookAction(r *http.Request, username string) (string, error) {
+	ctx := r.Context()
+
+	if r.FormValue("action") == "create" {
+		u, err := url.Parse(r.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", errors.New("the URL must be an absolute http or https URL")
+		}
+		r.ParseForm()
+		if len(r.Form["events"]) == 0 {
+			return "", errors.New("select at least one event")
+		}
+
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			return "", err
+		}
+		hook := models.Webhook{
+			ID:            uuid.NewString(),
+			OwnerUsername: username,
+			URL:           u.String(),
+			Secret:        secret,
+			Events:        r.Form["events"],
+			Active:        true,
+			CreatedAt:     time.Now(),
+		}
+		return "Webhook added.", env.webhooks.Save(ctx, hook)
+	}
+
+	hook, err := env.webhooks.Get(ctx, r.FormValue("id"))
+	if err != nil || hook.OwnerUsername != username {
+		return "", errors.New("webhook not found")
+	}
+
+	switch r.FormValue("action") {
+	case "delete":
+		return "Webhook deleted.", env.webhooks.Delete(ctx, username, hook.ID)
+	case "toggle":
+		hook.Active = !hook.Active
+		if hook.Active {
+			return "Webhook enabled.", env.webhooks.Save(ctx, hook)
+		}
+		return "Webhook disabled.", env.webhooks.Save(ctx, hook)
+	case "ping":
+		_, err := env.events.Enqueue(ctx, hook, webhooks.Ping, map[string]string{"webhook_id": hook.ID})
+		return "Ping queued; refresh to see the delivery.", err
+	}
+	return "", errors.New("unknown action")
+}
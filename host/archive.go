@@ -0,0 +1,88 @@
+package host
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// ArchiveHost writes generated pages into a zip or tar.gz archive instead of publishing them,
+// so a site can be downloaded and hosted elsewhere. Close must be called to finish the archive
+type ArchiveHost struct {
+	zw      *zip.Writer
+	gw      *gzip.Writer
+	tw      *tar.Writer
+	modTime time.Time
+}
+
+// ArchiveFormats lists the formats accepted by NewArchiveHost
+var ArchiveFormats = []string{"zip", "tar.gz"}
+
+// NewArchiveHost returns a host writing an archive in format ("zip" or "tar.gz") to w,
+// which may be an in-memory buffer or a temporary file
+func NewArchiveHost(w io.Writer, format string) (*ArchiveHost, error) {
+	a := &ArchiveHost{modTime: time.Now()}
+	switch format {
+	case "zip":
+		a.zw = zip.NewWriter(w)
+	case "tar.gz":
+		a.gw = gzip.NewWriter(w)
+		a.tw = tar.NewWriter(a.gw)
+	default:
+		return nil, fmt.Errorf("archive: unknown format %q", format)
+	}
+	return a, nil
+}
+
+// text: body of the HTML file
+// slug: slug for the file
+// prefix: directory within the archive
+func (a *ArchiveHost) Save(text, slug, prefix string) error {
+	return a.add(path.Join(prefix, slug)+".html", []byte(text))
+}
+
+// data: contents of the asset
+// name: path of the asset relative to the prefix, including its extension
+// prefix: directory within the archive
+func (a *ArchiveHost) SaveAsset(data []byte, name, prefix string) error {
+	return a.add(path.Join(prefix, name), data)
+}
+
+func (a *ArchiveHost) add(name string, data []byte) error {
+	if a.zw != nil {
+		f, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: a.modTime})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: a.modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.tw.Write(data)
+	return err
+}
+
+// Close finishes the archive. It does not close the underlying writer
+func (a *ArchiveHost) Close() error {
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"path/filepath"
 	"strings"
 	"time"
@@ -41,3 +42,20 @@ func (g *GSHost) Save(text, slug, prefix string) error {
 	log.Println("finished write")
 	return nil
 }
+
+func (g *GSHost) SaveAsset(data []byte, name, prefix string) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Second)
+	defer cancel()
+
+	wc := g.client.Bucket(g.bucket).Object(filepath.Join(prefix, name)).NewWriter(ctx)
+	wc.ContentType = mime.TypeByExtension(filepath.Ext(name))
+	if _, err := wc.Write(data); err != nil {
+		return fmt.Errorf("Writer.Write: %v", err)
+	}
+
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("Writer.Close: %v", err)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 // to which generated static pages should be pushed
 type Host interface {
 	Save(text, slug, prefix string) error
+	SaveAsset(data []byte, name, prefix string) error
 }
 
 // LocalHost provides an interface to saving files locally to the application for static site service
@@ -42,3 +43,16 @@ func (lh *LocalHost) Save(text, slug, prefix string) error {
 	f.Close()
 	return nil
 }
+
+// data: contents of the asset
+// name: path of the asset relative to the prefix, including its extension
+// prefix: any subdirectory structure under the lh.path parent folder
+func (lh *LocalHost) SaveAsset(data []byte, name, prefix string) error {
+	path := filepath.Join(lh.path, prefix, name)
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,324 @@
+package importer
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// lineBreak marks a <br> until paragraph whitespace has been collapsed
+const lineBreak = "\x00br\x00"
+
+var (
+	blankLine  = regexp.MustCompile(`\n[ \t]*\n`)
+	whitespace = regexp.MustCompile(`\s+`)
+	youtubeURL = regexp.MustCompile(`youtube(?:-nocookie)?\.com/embed/([\w-]+)`)
+)
+
+// HTMLToMarkdown converts post HTML, such as WordPress content, to Markdown.
+// Text outside of block elements is split into paragraphs on blank lines the way WordPress does,
+// YouTube iframes become youtube shortcodes and figures with captions become figure shortcodes
+func HTMLToMarkdown(s string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(s), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return "", err
+	}
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	return strings.Join(blocks(body), "\n\n"), nil
+}
+
+// blocks converts the children of n into Markdown blocks
+func blocks(n *html.Node) []string {
+	var out []string
+	var para strings.Builder
+
+	flush := func() {
+		for _, p := range blankLine.Split(para.String(), -1) {
+			p = strings.TrimSpace(whitespace.ReplaceAllString(p, " "))
+			p = strings.ReplaceAll(p, " "+lineBreak+" ", lineBreak)
+			p = strings.Trim(strings.ReplaceAll(p, lineBreak, "  \n"), " \n")
+			if p != "" {
+				out = append(out, p)
+			}
+		}
+		para.Reset()
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if b, ok := block(c); ok {
+			flush()
+			out = append(out, b...)
+			continue
+		}
+		para.WriteString(inline(c))
+	}
+	flush()
+	return out
+}
+
+// block converts n if it is a block element
+func block(n *html.Node) ([]string, bool) {
+	if n.Type == html.CommentNode {
+		return nil, true
+	}
+	if n.Type != html.ElementNode {
+		return nil, false
+	}
+
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Aside, atom.Main:
+		return blocks(n), true
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		text := strings.TrimSpace(whitespace.ReplaceAllString(strings.ReplaceAll(children(n), lineBreak, " "), " "))
+		return []string{strings.Repeat("#", level) + " " + text}, true
+	case atom.Ul, atom.Ol:
+		return []string{list(n)}, true
+	case atom.Blockquote:
+		lines := strings.Split(strings.Join(blocks(n), "\n\n"), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimRight("> "+lines[i], " ")
+		}
+		return []string{strings.Join(lines, "\n")}, true
+	case atom.Pre:
+		return []string{codeBlock(n)}, true
+	case atom.Hr:
+		return []string{"---"}, true
+	case atom.Figure:
+		return figure(n), true
+	case atom.Iframe:
+		src := attr(n, "src")
+		if m := youtubeURL.FindStringSubmatch(src); m != nil {
+			return []string{fmt.Sprintf("{{< youtube %s >}}", m[1])}, true
+		}
+		if src == "" {
+			return nil, true
+		}
+		return []string{fmt.Sprintf("[%s](%s)", src, src)}, true
+	case atom.Table:
+		return []string{table(n)}, true
+	case atom.Script, atom.Style:
+		return nil, true
+	}
+	return nil, false
+}
+
+// inline converts n and its children to inline Markdown
+func inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return n.Data
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		return lineBreak
+	case atom.Strong, atom.B:
+		return wrap(children(n), "**")
+	case atom.Em, atom.I:
+		return wrap(children(n), "*")
+	case atom.Del, atom.S, atom.Strike:
+		return wrap(children(n), "~~")
+	case atom.Code:
+		return "`" + textContent(n) + "`"
+	case atom.A:
+		text, href := children(n), attr(n, "href")
+		if href == "" || strings.TrimSpace(text) == "" {
+			return text
+		}
+		return "[" + strings.TrimSpace(text) + "](" + escapeURL(href) + ")"
+	case atom.Img:
+		return "![" + attr(n, "alt") + "](" + escapeURL(attr(n, "src")) + ")"
+	case atom.Script, atom.Style:
+		return ""
+	}
+	return children(n)
+}
+
+func children(n *html.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if bl, ok := block(c); ok {
+			b.WriteString(" " + strings.Join(bl, " ") + " ")
+			continue
+		}
+		b.WriteString(inline(c))
+	}
+	return b.String()
+}
+
+// wrap surrounds text with a Markdown delimiter, keeping surrounding spaces outside of it
+func wrap(text, delim string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	return lead + delim + trimmed + delim + trail
+}
+
+func list(n *html.Node) string {
+	var items []string
+	i := 1
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			continue
+		}
+
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = fmt.Sprintf("%d. ", i)
+			i++
+		}
+		lines := strings.Split(strings.Join(blocks(c), "\n"), "\n")
+		for j := range lines {
+			if j == 0 {
+				lines[j] = marker + lines[j]
+			} else if lines[j] != "" {
+				lines[j] = strings.Repeat(" ", len(marker)) + lines[j]
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+func codeBlock(n *html.Node) string {
+	lang := ""
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Code {
+			for _, class := range strings.Fields(attr(c, "class")) {
+				if strings.HasPrefix(class, "language-") {
+					lang = strings.TrimPrefix(class, "language-")
+				}
+			}
+		}
+	}
+
+	code := strings.Trim(textContent(n), "\n")
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + code + "\n" + fence
+}
+
+// figure converts a figure containing an image to a figure shortcode so the caption is kept
+func figure(n *html.Node) []string {
+	var img, caption *html.Node
+	var walk func(*html.Node)
+	walk = func(c *html.Node) {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Img && img == nil {
+			img = c
+		}
+		if c.Type == html.ElementNode && c.DataAtom == atom.Figcaption {
+			caption = c
+		}
+		for cc := c.FirstChild; cc != nil; cc = cc.NextSibling {
+			walk(cc)
+		}
+	}
+	walk(n)
+
+	if img == nil {
+		return blocks(n)
+	}
+	text := ""
+	if caption != nil {
+		text = strings.TrimSpace(whitespace.ReplaceAllString(textContent(caption), " "))
+	}
+	if text == "" {
+		text = attr(img, "alt")
+	}
+	return []string{fmt.Sprintf(`{{< figure src="%s" caption="%s" >}}`,
+		escapeURL(attr(img, "src")), strings.ReplaceAll(text, `"`, "'"))}
+}
+
+func table(n *html.Node) string {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(c *html.Node) {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Tr {
+			var row []string
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					text := strings.TrimSpace(whitespace.ReplaceAllString(strings.ReplaceAll(children(cell), lineBreak, " "), " "))
+					row = append(row, strings.ReplaceAll(text, "|", `\|`))
+				}
+			}
+			rows = append(rows, row)
+			return
+		}
+		for cc := c.FirstChild; cc != nil; cc = cc.NextSibling {
+			walk(cc)
+		}
+	}
+	walk(n)
+
+	if len(rows) == 0 {
+		return ""
+	}
+	cols := 0
+	for _, r := range rows {
+		if len(r) > cols {
+			cols = len(r)
+		}
+	}
+
+	var b strings.Builder
+	for i, r := range rows {
+		for len(r) < cols {
+			r = append(r, "")
+		}
+		b.WriteString("| " + strings.Join(r, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|" + strings.Repeat(" --- |", cols) + "\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Br {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(textContent(c))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// escapeURL makes a URL safe to use as a Markdown link destination
+func escapeURL(s string) string {
+	s = strings.TrimSpace(s)
+	if u, err := url.Parse(s); err == nil {
+		s = u.String()
+	}
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(s)
+}
@@ -0,0 +1,116 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/frontmatter"
+	"github.com/tydar/mdbssg/models"
+)
+
+// Item is the result of importing one file
+type Item struct {
+	Path string
+	Post models.Post
+	// Media holds the images referenced by the post that were found in the imported tree
+	Media []models.Media
+	// Warnings describe problems that did not prevent the post from being imported
+	Warnings []string
+	// Skipped explains why the file was deliberately not imported
+	Skipped string
+	Err     error
+}
+
+// PostFromMarkdown parses a Markdown document with optional YAML or TOML front matter
+// (title, subtitle, author, date, slug, tags, draft, aliases) into a post owned by username.
+// A missing date defaults to today and a missing slug is built from the title and date
+func PostFromMarkdown(data []byte, username string) (models.Post, error) {
+	m, body, err := frontmatter.Parse(data)
+	if err != nil {
+		return models.Post{}, err
+	}
+
+	post := postFromMatter(m, body, username)
+	if post.Title == "" {
+		return models.Post{}, errors.New("front matter: title is required")
+	}
+
+	if _, ok := m["date"]; ok {
+		post.Pubdate, err = m.Time("date")
+		if err != nil {
+			return models.Post{}, err
+		}
+	} else {
+		post.Pubdate = time.Now().UTC().Truncate(24 * time.Hour)
+	}
+
+	if post.Slug == "" {
+		post.Slug = models.DefaultSlug(post.Title, post.Pubdate)
+	}
+	return post, checkSlug(post.Slug)
+}
+
+// checkSlug returns an error if slug cannot be used as a file name in the generated site
+func checkSlug(slug string) error {
+	if !models.ValidSlug(slug) {
+		return fmt.Errorf("invalid slug %q: it must be non-empty and must not contain /, \\, ? or #", slug)
+	}
+	return nil
+}
+
+// postFromMatter maps the front matter fields shared by every importer onto a post
+func postFromMatter(m frontmatter.Matter, body, username string) models.Post {
+	draft, _ := m.Bool("draft")
+	return models.Post{
+		OwnerUsername: username,
+		Title:         m.String("title"),
+		Subtitle:      m.String("subtitle"),
+		Author:        m.String("author"),
+		Slug:          m.String("slug"),
+		Tags:          m.Strings("tags"),
+		Draft:         draft,
+		Aliases:       m.Strings("aliases"),
+		Content:       strings.TrimSpace(body),
+	}
+}
+
+// Markdown imports every .md file in fsys, in path order.
+// Images referenced by relative paths are copied from fsys into the media store
+func Markdown(fsys fs.FS, username string) ([]Item, error) {
+	var items []Item
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isMarkdown(p) {
+			return nil
+		}
+
+		item := Item{Path: p}
+		data, err := fs.ReadFile(fsys, p)
+		if err == nil {
+			item.Post, err = PostFromMarkdown(data, username)
+		}
+		if err == nil {
+			collectMedia(&item, fsys, path.Dir(p), fsys, username)
+		}
+		item.Err = err
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func isMarkdown(p string) bool {
+	base := path.Base(p)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") {
+		return false
+	}
+
+	ext := strings.ToLower(path.Ext(p))
+	return ext == ".md" || ext == ".markdown"
+}
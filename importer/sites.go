@@ -0,0 +1,361 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/frontmatter"
+	"github.com/tydar/mdbssg/models"
+)
+
+// Formats lists the content layouts Import understands
+var Formats = []string{"markdown", "hugo", "jekyll", "wordpress"}
+
+// Import reads fsys with the importer for format
+func Import(format string, fsys fs.FS, username string) ([]Item, error) {
+	fsys = Root(fsys)
+	switch format {
+	case "markdown":
+		return Markdown(fsys, username)
+	case "hugo":
+		return Hugo(fsys, username)
+	case "jekyll":
+		return Jekyll(fsys, username)
+	case "wordpress":
+		return wxrFiles(fsys, username, HTTPFetch)
+	}
+	return nil, fmt.Errorf("import: unknown format %q", format)
+}
+
+// wxrFiles imports every WordPress export (.xml) file in fsys
+func wxrFiles(fsys fs.FS, username string, fetch FetchFunc) ([]Item, error) {
+	files, err := fs.Glob(fsys, "*.xml")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("import: no WordPress export (.xml) found")
+	}
+
+	var items []Item
+	for _, name := range files {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		fileItems, err := WXR(f, username, fetch)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		items = append(items, fileItems...)
+	}
+	return items, nil
+}
+
+// Root descends through directories that are the only entry of their parent,
+// so an archive of "myblog/content/..." imports the same as one of "content/..."
+func Root(fsys fs.FS) fs.FS {
+	for {
+		entries, err := fs.ReadDir(fsys, ".")
+		if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+			return fsys
+		}
+
+		sub, err := fs.Sub(fsys, entries[0].Name())
+		if err != nil {
+			return fsys
+		}
+		fsys = sub
+	}
+}
+
+// Hugo imports a Hugo site, or its content/ directory on its own. Each page keeps its
+// original URL (the url front matter, or the section path and slug) and any aliases as
+// redirects. Images are looked up next to the page for page bundles, or in static/
+func Hugo(fsys fs.FS, username string) ([]Item, error) {
+	content := fsys
+	if fi, err := fs.Stat(fsys, "content"); err == nil && fi.IsDir() {
+		content, _ = fs.Sub(fsys, "content")
+	}
+	static, _ := fs.Sub(fsys, "static")
+
+	var items []Item
+	err := fs.WalkDir(content, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isMarkdown(p) {
+			return nil
+		}
+
+		item := Item{Path: path.Join("content", p)}
+		data, err := fs.ReadFile(content, p)
+		if err == nil {
+			err = hugoPage(&item, data, p, username)
+		}
+		if err == nil {
+			collectMedia(&item, content, path.Dir(p), static, username)
+		}
+		item.Err = err
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func hugoPage(item *Item, data []byte, p, username string) error {
+	m, body, err := frontmatter.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	post := postFromMatter(m, body, username)
+	post.Tags = appendUnique(post.Tags, m.Strings("categories")...)
+	if post.Title == "" {
+		return fmt.Errorf("front matter: title is required")
+	}
+	if _, ok := m["date"]; ok {
+		post.Pubdate, err = m.Time("date")
+		if err != nil {
+			return err
+		}
+	} else {
+		post.Pubdate = time.Now().UTC().Truncate(24 * time.Hour)
+	}
+
+	// page bundles are named after their directory
+	dir, name := path.Split(strings.TrimSuffix(p, path.Ext(p)))
+	dir = strings.TrimSuffix(dir, "/")
+	if name == "index" {
+		dir, name = path.Split(dir)
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if post.Slug == "" {
+		post.Slug = name
+	}
+	if err := checkSlug(post.Slug); err != nil {
+		return err
+	}
+
+	url := m.String("url")
+	if url == "" {
+		url = "/" + path.Join(dir, post.Slug) + "/"
+	}
+	post.Aliases = appendUnique(post.Aliases, url)
+	post.Aliases = appendUnique(post.Aliases, m.Strings("aliases")...)
+
+	item.Post = post
+	return nil
+}
+
+// jekyllName matches post file names such as 2021-12-01-my-post.md
+var jekyllName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)\.(md|markdown)$`)
+
+// Jekyll imports the _posts/ directory of a Jekyll site. Dates and slugs come from the
+// YYYY-MM-DD-slug file names unless front matter sets them, and each post keeps its original
+// URL (the permalink front matter, or Jekyll's default /categories/year/month/day/slug.html)
+func Jekyll(fsys fs.FS, username string) ([]Item, error) {
+	posts := fsys
+	if fi, err := fs.Stat(fsys, "_posts"); err == nil && fi.IsDir() {
+		posts, _ = fs.Sub(fsys, "_posts")
+	}
+
+	var items []Item
+	err := fs.WalkDir(posts, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !jekyllName.MatchString(path.Base(p)) {
+			return nil
+		}
+
+		item := Item{Path: path.Join("_posts", p)}
+		data, err := fs.ReadFile(posts, p)
+		if err == nil {
+			err = jekyllPost(&item, data, path.Base(p), username)
+		}
+		if err == nil {
+			collectMedia(&item, fsys, path.Dir(path.Join("_posts", p)), fsys, username)
+		}
+		item.Err = err
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func jekyllPost(item *Item, data []byte, name, username string) error {
+	m, body, err := frontmatter.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	parts := jekyllName.FindStringSubmatch(name)
+	post := postFromMatter(m, body, username)
+	// Jekyll separates categories given as a string with spaces
+	categories := m.Strings("categories")
+	if c, ok := m["categories"].(string); ok {
+		categories = strings.Fields(c)
+	} else if len(categories) == 0 {
+		categories = strings.Fields(m.String("category"))
+	}
+	post.Tags = appendUnique(post.Tags, categories...)
+	if published, ok := m.Bool("published"); ok && !published {
+		post.Draft = true
+	}
+	if post.Title == "" {
+		post.Title = strings.Title(strings.ReplaceAll(parts[2], "-", " "))
+	}
+
+	if _, ok := m["date"]; ok {
+		post.Pubdate, err = m.Time("date")
+	} else {
+		post.Pubdate, err = time.Parse("2006-01-02", parts[1])
+	}
+	if err != nil {
+		return err
+	}
+
+	if post.Slug == "" {
+		post.Slug = parts[2]
+	}
+	if err := checkSlug(post.Slug); err != nil {
+		return err
+	}
+
+	url := m.String("permalink")
+	if url == "" {
+		url = "/" + path.Join(append(categories, post.Pubdate.Format("2006/01/02"), parts[2]+".html")...)
+	}
+	post.Aliases = appendUnique(post.Aliases, url)
+
+	item.Post = post
+	return nil
+}
+
+var (
+	markdownImage  = regexp.MustCompile(`(!\[[^\]]*\]\()([^)\s]+)`)
+	shortcodeImage = regexp.MustCompile(`(\{\{<\s*figure[^>]*\bsrc=")([^"]+)`)
+)
+
+// collectMedia copies the local images referenced by the post into item.Media and rewrites the
+// references to point at the site's media/ directory. Relative references are looked up in dir of
+// pages, absolute ones in static
+func collectMedia(item *Item, pages fs.FS, dir string, static fs.FS, username string) {
+	seen := make(map[string]bool)
+	rewrite := func(ref string) string {
+		if isRemote(ref) {
+			return ref
+		}
+
+		fsys, p := pages, path.Join(dir, ref)
+		if strings.HasPrefix(ref, "/") {
+			fsys, p = static, strings.TrimPrefix(ref, "/")
+		}
+		if fsys == nil {
+			item.Warnings = append(item.Warnings, "image not found: "+ref)
+			return ref
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			item.Warnings = append(item.Warnings, "image not found: "+ref)
+			return ref
+		}
+		if len(data) > models.MaxMediaSize {
+			item.Warnings = append(item.Warnings, "image too large: "+ref)
+			return ref
+		}
+
+		name := p
+		if !seen[name] {
+			seen[name] = true
+			item.Media = append(item.Media, models.Media{
+				OwnerUsername: username,
+				Name:          name,
+				ContentType:   contentType(name, data),
+				Data:          data,
+			})
+		}
+		return "media/" + name
+	}
+
+	replace := func(re *regexp.Regexp, s string) string {
+		return re.ReplaceAllStringFunc(s, func(match string) string {
+			m := re.FindStringSubmatch(match)
+			return m[1] + rewrite(m[2])
+		})
+	}
+	item.Post.Content = replace(shortcodeImage, replace(markdownImage, item.Post.Content))
+}
+
+func isRemote(ref string) bool {
+	return strings.Contains(ref, "://") || strings.HasPrefix(ref, "//") || strings.HasPrefix(ref, "data:") ||
+		strings.HasPrefix(ref, "#")
+}
+
+func contentType(name string, data []byte) string {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(data)
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found && v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// PostCreator stores imported posts
+type PostCreator interface {
+	Create(ctx context.Context, post models.Post) error
+}
+
+// MediaSaver stores the media of imported posts
+type MediaSaver interface {
+	Save(ctx context.Context, media models.Media) error
+}
+
+// Save creates each successfully read post and stores its media, recording any error on the item.
+// It returns the number of posts created
+func Save(ctx context.Context, items []Item, posts PostCreator, media MediaSaver) int {
+	created := 0
+	for i := range items {
+		if items[i].Err != nil || items[i].Skipped != "" {
+			continue
+		}
+
+		err := posts.Create(ctx, items[i].Post)
+		if err != nil {
+			items[i].Err = err
+			continue
+		}
+		created++
+
+		for _, m := range items[i].Media {
+			if err := media.Save(ctx, m); err != nil {
+				items[i].Warnings = append(items[i].Warnings, "saving "+m.Name+": "+err.Error())
+			}
+		}
+	}
+	return created
+}
@@ -0,0 +1,259 @@
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/safehttp"
+)
+
+// FetchFunc downloads the file at a URL
+type FetchFunc func(url string) ([]byte, error)
+
+// fetchClient downloads attachments. The URLs come from uploaded exports, so it only
+// connects to public addresses
+var fetchClient = safehttp.NewClient(30 * time.Second)
+
+// HTTPFetch downloads a file over HTTP or HTTPS, refusing files larger than the media store
+// accepts and URLs that point at the server's own network
+func HTTPFetch(u string) ([]byte, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := safehttp.CheckURL(parsed); err != nil {
+		return nil, err
+	}
+
+	resp, err := fetchClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, models.MaxMediaSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > models.MaxMediaSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", u, models.MaxMediaSize)
+	}
+	return data, nil
+}
+
+// wxr is the subset of a WordPress eXtended RSS export that is imported.
+// Elements are matched by local name because the wp: namespace changes between export versions
+type wxr struct {
+	Authors []wxrAuthor `xml:"channel>author"`
+	Items   []wxrItem   `xml:"channel>item"`
+}
+
+type wxrAuthor struct {
+	Login   string `xml:"author_login"`
+	Display string `xml:"author_display_name"`
+}
+
+type wxrItem struct {
+	Title         string        `xml:"title"`
+	Link          string        `xml:"link"`
+	Creator       string        `xml:"creator"`
+	Encoded       []wxrEncoded  `xml:"encoded"`
+	ID            string        `xml:"post_id"`
+	Parent        string        `xml:"post_parent"`
+	Date          string        `xml:"post_date"`
+	DateGMT       string        `xml:"post_date_gmt"`
+	Name          string        `xml:"post_name"`
+	Status        string        `xml:"status"`
+	Type          string        `xml:"post_type"`
+	AttachmentURL string        `xml:"attachment_url"`
+	Categories    []wxrCategory `xml:"category"`
+}
+
+// wxrEncoded is either content:encoded (the post body) or excerpt:encoded
+type wxrEncoded struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"`
+	Name   string `xml:",chardata"`
+}
+
+const contentNamespace = "http://purl.org/rss/1.0/modules/content/"
+
+// WXR imports the posts of a WordPress export file. Posts keep their author, publication date,
+// categories and tags, and their status (anything but published or scheduled becomes a draft).
+// Bodies are converted from HTML to Markdown and the permalink is kept as an alias.
+// Attachments belonging to or referenced by a post are downloaded with fetch into the media store;
+// with a nil fetch they are reported as warnings. Other item types are reported as skipped
+func WXR(r io.Reader, username string, fetch FetchFunc) ([]Item, error) {
+	var doc wxr
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("wordpress export: %v", err)
+	}
+
+	authors := make(map[string]string, len(doc.Authors))
+	for _, a := range doc.Authors {
+		authors[a.Login] = a.Display
+	}
+
+	var attachments []wxrItem
+	for _, it := range doc.Items {
+		if it.Type == "attachment" && it.AttachmentURL != "" {
+			attachments = append(attachments, it)
+		}
+	}
+
+	var items []Item
+	for _, it := range doc.Items {
+		item := Item{Path: fmt.Sprintf("%s %s: %s", it.Type, it.ID, it.Title)}
+
+		switch {
+		case it.Type == "attachment":
+			continue
+		case it.Type != "post":
+			item.Skipped = "unsupported post type " + it.Type
+		case it.Status == "trash" || it.Status == "auto-draft":
+			item.Skipped = "status " + it.Status
+		default:
+			item.Err = wxrPost(&item, it, authors, username)
+			if item.Err == nil {
+				wxrMedia(&item, it, attachments, username, fetch)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func wxrPost(item *Item, it wxrItem, authors map[string]string, username string) error {
+	var body, excerpt string
+	for _, e := range it.Encoded {
+		if e.XMLName.Space == contentNamespace {
+			body = e.Value
+		} else {
+			excerpt = e.Value
+		}
+	}
+
+	content, err := HTMLToMarkdown(body)
+	if err != nil {
+		return err
+	}
+
+	pubdate, err := wxrDate(it)
+	if err != nil {
+		return err
+	}
+
+	author := authors[it.Creator]
+	if author == "" {
+		author = it.Creator
+	}
+
+	var tags []string
+	for _, c := range it.Categories {
+		if c.Domain == "category" || c.Domain == "post_tag" {
+			tags = appendUnique(tags, strings.TrimSpace(c.Name))
+		}
+	}
+
+	title := strings.TrimSpace(it.Title)
+	if title == "" {
+		title = "Untitled " + it.ID
+	}
+
+	post := models.Post{
+		OwnerUsername: username,
+		Title:         title,
+		Subtitle:      strings.TrimSpace(whitespace.ReplaceAllString(excerpt, " ")),
+		Author:        author,
+		Content:       content,
+		Slug:          it.Name,
+		Pubdate:       pubdate,
+		Tags:          tags,
+		Draft:         it.Status != "publish" && it.Status != "future",
+	}
+	if post.Slug == "" {
+		post.Slug = models.DefaultSlug(post.Title, post.Pubdate)
+	}
+	if err := checkSlug(post.Slug); err != nil {
+		return err
+	}
+
+	// unpublished posts only have ?p=ID links, which cannot be served by a static site
+	if u, err := url.Parse(it.Link); err == nil && u.RawQuery == "" && u.Path != "" && u.Path != "/" {
+		post.Aliases = []string{u.Path}
+	}
+
+	item.Post = post
+	return nil
+}
+
+func wxrDate(it wxrItem) (time.Time, error) {
+	const layout = "2006-01-02 15:04:05"
+	if t, err := time.Parse(layout, it.DateGMT); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(layout, it.Date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("wordpress export: unrecognized date %q", it.Date)
+	}
+	return t, nil
+}
+
+// wxrMedia downloads the attachments whose parent is the post or whose URL appears in its body
+// and rewrites references to them to the site's media/ directory
+func wxrMedia(item *Item, it wxrItem, attachments []wxrItem, username string, fetch FetchFunc) {
+	for _, a := range attachments {
+		if a.Parent != it.ID && !strings.Contains(item.Post.Content, a.AttachmentURL) {
+			continue
+		}
+
+		if fetch == nil {
+			item.Warnings = append(item.Warnings, "attachment not downloaded: "+a.AttachmentURL)
+			continue
+		}
+		name := attachmentName(a.AttachmentURL)
+		if !models.ValidMediaName(name) {
+			item.Warnings = append(item.Warnings, "attachment: invalid file name: "+a.AttachmentURL)
+			continue
+		}
+		data, err := fetch(a.AttachmentURL)
+		if err != nil {
+			item.Warnings = append(item.Warnings, "attachment: "+err.Error())
+			continue
+		}
+		item.Media = append(item.Media, models.Media{
+			OwnerUsername: username,
+			Name:          name,
+			ContentType:   contentType(name, data),
+			Data:          data,
+		})
+		item.Post.Content = strings.ReplaceAll(item.Post.Content, a.AttachmentURL, "media/"+name)
+	}
+}
+
+// attachmentName keeps the year/month directories of files under wp-content/uploads
+func attachmentName(u string) string {
+	p := u
+	if parsed, err := url.Parse(u); err == nil {
+		p = parsed.Path
+	}
+	if i := strings.Index(p, "/wp-content/uploads/"); i != -1 {
+		return path.Join("wp", p[i+len("/wp-content/uploads/"):])
+	}
+	return path.Join("wp", path.Base(p))
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Templates renders messages from text templates. Each template file defines a
+// "subject" and a "body" template and is named by its file name without the extension
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// ParseTemplates parses the *.txt files in dir
+func ParseTemplates(dir string) (*Templates, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{templates: make(map[string]*template.Template)}
+	for _, f := range files {
+		parsed, err := template.ParseFiles(f)
+		if err != nil {
+			return nil, err
+		}
+		t.templates[strings.TrimSuffix(filepath.Base(f), ".txt")] = parsed
+	}
+	return t, nil
+}
+
+// Render returns the message made from template name and data, addressed to to
+func (t *Templates) Render(name, to string, data interface{}) (Message, error) {
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("mailer: no template named %q", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimSpace(body.String()) + "\n",
+	}, nil
+}
@@ -5,28 +5,35 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tydar/mdbssg/handlers"
 	"github.com/tydar/mdbssg/host"
+	"github.com/tydar/mdbssg/mailer"
 	"github.com/tydar/mdbssg/models"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/tydar/mdbssg/safehttp"
+	"github.com/tydar/mdbssg/shortcodes"
+	"github.com/tydar/mdbssg/webhooks"
 
 	"cloud.google.com/go/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	dbUrl, prs := os.LookupEnv("DATABASE_URL")
-	if !prs {
-		dbUrl = "mongodb://localhost:27017"
-	}
-
 	port, prs := os.LookupEnv("PORT")
 	if !prs {
 		port = "8080"
@@ -38,6 +45,20 @@ func main() {
 	}
 
 	_, prs = os.LookupEnv("HEROKU")
+	// the Heroku router passes the client address in X-Forwarded-For
+	trustProxy := prs || os.Getenv("TRUST_PROXY") != ""
+	safehttp.AllowPrivate = os.Getenv("ALLOW_PRIVATE_URLS") != ""
+	baseURL := baseURLFromEnv()
+	webAuthnOrigin := os.Getenv("WEBAUTHN_ORIGIN")
+	if baseURL == "" && webAuthnOrigin == "" {
+		log.Fatal("$BASE_URL, the address the site is reached at, must be set for passkeys, or $WEBAUTHN_ORIGIN")
+	} else if baseURL == "" {
+		log.Println("no $BASE_URL set, verification and password reset emails will not be sent")
+	}
+	durationFromEnv("SESSION_IDLE_TIMEOUT", &models.SessionIdleTimeout)
+	durationFromEnv("SESSION_LIFETIME", &models.SessionLifetime)
+	durationFromEnv("SESSION_REMEMBER_LIFETIME", &models.RememberLifetime)
+	passwords := passwordConfig()
 	if prs {
 		// we need to get our creds from the environment and write them to the disk so it works
 		creds := os.Getenv("GOOGLE_CREDENTIALS")
@@ -52,22 +73,53 @@ func main() {
 		f.Close()
 	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbUrl))
+	client, err := connect(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	um := models.NewUserModel(client, "mdbssg")
+	um := models.NewUserModel(client, "mdbssg", passwords)
 	pm := models.NewPostModel(client, "mdbssg")
+	sm := models.NewSiteModel(client, "mdbssg")
+	om := models.NewOverrideModel(client, "mdbssg")
+	mm := models.NewMediaModel(client, "mdbssg")
+	wm := models.NewWebhookModel(client, "mdbssg")
+	lm := models.NewLoginModel(client, "mdbssg")
+	am := models.NewAuditModel(client, "mdbssg")
+	cm := models.NewCeremonyModel(client, "mdbssg")
+	sessm := models.NewSessionModel(client, "mdbssg")
+	err = sessm.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dispatcher := webhooks.NewDispatcher(wm)
+	go dispatcher.Run(context.Background())
+
+	themeRegistry, err := loadThemes()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	t := map[string]*template.Template{"signin": template.Must(template.ParseFiles("templates/base.html", "templates/signin.html"))}
-	t["changepwd"] = template.Must(template.ParseFiles("templates/base.html", "templates/changepwd.html"))
+	t := map[string]*template.Template{"signin": template.Must(template.ParseFiles("templates/base.html", "templates/signin.html", "templates/passkeys.html"))}
+	t["changepwd"] = template.Must(template.ParseFiles("templates/base.html", "templates/changepwd.html", "templates/passkeys.html"))
+	t["signin_2fa"] = template.Must(template.ParseFiles("templates/base.html", "templates/signin_2fa.html", "templates/passkeys.html"))
+	t["twofactor"] = template.Must(template.ParseFiles("templates/base.html", "templates/twofactor.html"))
 	t["signup"] = template.Must(template.ParseFiles("templates/base.html", "templates/signup.html"))
 	t["view_post"] = template.Must(template.ParseFiles("templates/base.html", "templates/post.html"))
 	t["edit_post"] = template.Must(template.ParseFiles("templates/base.html", "templates/edit_post.html"))
-	t["gen_post"] = template.Must(template.ParseFiles("templates/base_gen.html", "templates/post.html"))
 	t["new_post"] = template.Must(template.ParseFiles("templates/base.html", "templates/new_post.html"))
 	t["list_posts"] = template.Must(template.ParseFiles("templates/base.html", "templates/posts.html"))
+	t["settings"] = template.Must(template.ParseFiles("templates/base.html", "templates/settings.html"))
+	t["list_templates"] = template.Must(template.ParseFiles("templates/base.html", "templates/templates.html"))
+	t["import"] = template.Must(template.ParseFiles("templates/base.html", "templates/import.html"))
+	t["backup"] = template.Must(template.ParseFiles("templates/base.html", "templates/backup.html"))
+	t["webhooks"] = template.Must(template.ParseFiles("templates/base.html", "templates/webhooks.html"))
+	t["edit_template"] = template.Must(template.ParseFiles("templates/base.html", "templates/edit_template.html"))
+	t["admin"] = template.Must(template.ParseFiles("templates/base.html", "templates/admin.html"))
+	t["forgot"] = template.Must(template.ParseFiles("templates/base.html", "templates/forgot.html"))
+	t["reset"] = template.Must(template.ParseFiles("templates/base.html", "templates/reset.html"))
+	t["error"] = template.Must(template.ParseFiles("templates/base.html", "templates/error.html"))
 
 	//theHost := host.NewLocalHost("static")
 	gsClient, err := storage.NewClient(context.Background())
@@ -76,24 +128,201 @@ func main() {
 	}
 
 	theHost := host.NewGSHost(bucket, gsClient)
-	env := handlers.NewEnv(um, pm, t, theHost)
+	var sso *handlers.OIDC
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		cfg := handlers.OIDCConfig{
+			Name:         os.Getenv("OIDC_NAME"),
+			Issuer:       issuer,
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Provision:    os.Getenv("OIDC_PROVISION") != "",
+		}
+		if cfg.RedirectURL == "" && baseURL != "" {
+			cfg.RedirectURL = baseURL + "/oidc/callback"
+		}
+		if domains := os.Getenv("OIDC_ALLOWED_DOMAINS"); domains != "" {
+			cfg.AllowedDomains = strings.Split(domains, ",")
+		}
+		sso, err = handlers.NewOIDC(ctx, cfg)
+		if err != nil {
+			log.Fatalf("setting up single sign-on with %s: %v (set $BASE_URL or $OIDC_REDIRECT_URL)", issuer, err)
+		}
+	}
+
+	mailTemplates, err := mailer.ParseTemplates("templates/email")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mail mailer.Mailer = mailer.Log{}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		if os.Getenv("MAIL_FROM") == "" {
+			log.Fatal("$MAIL_FROM must be set to send email through $SMTP_ADDR")
+		}
+		mail = mailer.NewSMTP(addr, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+	} else {
+		log.Println("no $SMTP_ADDR set, emails will be written to the log instead of sent")
+	}
+
+	// session cookies signed with a random key only last until a restart
+	var sessionKeys [][]byte
+	for _, k := range strings.Split(os.Getenv("SESSION_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			sessionKeys = append(sessionKeys, []byte(k))
+		}
+	}
+	if len(sessionKeys) == 0 {
+		log.Println("no $SESSION_KEYS set, using a random key: everyone will be signed out after a restart")
+		key, err := handlers.NewSessionKey()
+		if err != nil {
+			log.Fatalf("generating a session key: %v", err)
+		}
+		sessionKeys = [][]byte{key}
+	}
+
+	env := handlers.NewEnv(handlers.EnvConfig{
+		Users:              um,
+		Posts:              pm,
+		Sites:              sm,
+		Overrides:          om,
+		Media:              mm,
+		Webhooks:           wm,
+		Events:             dispatcher,
+		Logins:             lm,
+		Audit:              am,
+		Ceremonies:         cm,
+		Sessions:           sessm,
+		Mail:               mail,
+		MailTemplates:      mailTemplates,
+		Templates:          t,
+		Host:               theHost,
+		Themes:             themeRegistry,
+		Shortcodes:         shortcodes.NewRegistry(),
+		SessionKeys:        sessionKeys,
+		BaseURL:            baseURL,
+		WebAuthnOrigin:     webAuthnOrigin,
+		TrustProxyHeaders:  trustProxy,
+		SingleSignOn:       sso,
+		PasswordHashParams: passwords.HashParams,
+	})
 
-	http.HandleFunc("/", handlers.NewAuthMW(env.ViewPost, env).ServeHTTP)
+	http.HandleFunc("/", handlers.NewAuthMW(env.ViewPost, env).Scope(models.ScopeReadPosts).ServeHTTP)
 	http.HandleFunc("/signin/", env.SignIn)
+	http.HandleFunc("/signin/2fa/", env.SignInSecondFactor)
+	http.HandleFunc("/signin/passkey/", env.SignInPasskey)
 	http.HandleFunc("/changepwd/", handlers.NewAuthMW(env.ChangePassword, env).ServeHTTP)
+	http.HandleFunc("/tokens/", handlers.NewAuthMW(env.Tokens, env).ServeHTTP)
+	http.HandleFunc("/2fa/", handlers.NewAuthMW(env.TwoFactor, env).ServeHTTP)
+	http.HandleFunc("/passkeys/", handlers.NewAuthMW(env.Passkeys, env).ServeHTTP)
+	http.HandleFunc("/sessions/", handlers.NewAuthMW(env.Sessions, env).ServeHTTP)
 	http.HandleFunc("/signup/", env.SignUpHandler)
+	http.HandleFunc("/verify/", env.VerifyEmail)
+	http.HandleFunc("/email/", handlers.NewAuthMW(env.Email, env).ServeHTTP)
+	http.HandleFunc("/forgot/", env.ForgotPassword)
+	http.HandleFunc("/reset/", env.ResetPassword)
+	http.HandleFunc("/oidc/", env.OIDCSignIn)
+	http.HandleFunc("/identities/", handlers.NewAuthMW(env.Identities, env).ServeHTTP)
 	http.HandleFunc("/signout/", handlers.NewAuthMW(env.SignOut, env).ServeHTTP)
-	http.HandleFunc("/post/", handlers.NewAuthMW(env.ViewPost, env).ServeHTTP)
+	http.HandleFunc("/post/", handlers.NewAuthMW(env.ViewPost, env).Scope(models.ScopeReadPosts).ServeHTTP)
+	http.HandleFunc("/post/media/", handlers.NewAuthMW(env.Media, env).Scope(models.ScopeReadPosts).ServeHTTP)
 	http.HandleFunc("/edit/", handlers.NewAuthMW(env.EditPost, env).ServeHTTP)
 	http.HandleFunc("/save/", handlers.NewAuthMW(env.SavePost, env).ServeHTTP)
-	http.HandleFunc("/generate/", handlers.NewAuthMW(env.GeneratePosts, env).ServeHTTP)
+	http.HandleFunc("/generate/", handlers.NewAuthMW(env.GeneratePosts, env).Scope(models.ScopePublish).ServeHTTP)
+	http.HandleFunc("/download/", handlers.NewAuthMW(env.DownloadSite, env).Scope(models.ScopePublish).ServeHTTP)
 	http.HandleFunc("/new/", handlers.NewAuthMW(env.NewPost, env).ServeHTTP)
+	http.HandleFunc("/settings/", handlers.NewAuthMW(env.Settings, env).ServeHTTP)
+	http.HandleFunc("/templates/", handlers.NewAuthMW(env.Templates, env).ServeHTTP)
+	http.HandleFunc("/syntax.css", env.SyntaxCSS)
+	http.HandleFunc("/import/", handlers.NewAuthMW(env.Import, env).Scope(models.ScopeWritePosts).ServeHTTP)
+	http.HandleFunc("/backup/", handlers.NewAuthMW(env.Backup, env).ServeHTTP)
+	http.HandleFunc("/webhooks/", handlers.NewAuthMW(env.Webhooks, env).ServeHTTP)
+	http.HandleFunc("/admin/", handlers.NewAuthMW(env.Admin, env).ServeHTTP)
+
+	http.HandleFunc(handlers.MicropubPath, env.Micropub)
+	http.HandleFunc(handlers.MicropubMediaPath, env.MicropubMedia)
+	http.HandleFunc(handlers.XMLRPCPath, env.XMLRPC)
+	http.HandleFunc(handlers.APIPrefix+"/openapi.json", env.OpenAPI)
+	http.HandleFunc(handlers.APIPrefix+"/me", handlers.NewAPIAuthMW(env.APIMe, env).ServeHTTP)
+	http.HandleFunc(handlers.APIPrefix+"/posts", handlers.NewAPIAuthMW(env.APIPosts, env).ServeHTTP)
+	http.HandleFunc(handlers.APIPrefix+"/posts/", handlers.NewAPIAuthMW(env.APIPosts, env).ServeHTTP)
+	http.HandleFunc(handlers.APIPrefix+"/generate", handlers.NewAPIAuthMW(env.APIGenerate, env).ServeHTTP)
 
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	err = http.ListenAndServe(":"+port, nil)
+	// tokens stay valid across restarts only if the key is configured
+	csrfKey := []byte(os.Getenv("CSRF_KEY"))
+	if len(csrfKey) == 0 {
+		log.Println("no $CSRF_KEY set, using a random key: open forms will need reloading after a restart")
+		csrfKey, err = handlers.NewCSRFKey()
+		if err != nil {
+			log.Fatalf("generating a CSRF key: %v", err)
+		}
+	}
+
+	err = http.ListenAndServe(":"+port, handlers.NewCSRFMW(http.DefaultServeMux, env, csrfKey))
 	if err != nil {
 		panic(err)
 	}
 }
+
+// durationFromEnv sets *d from the environment variable name, such as "30m" or "720h", if it is set
+func durationFromEnv(name string, d *time.Duration) {
+	v, prs := os.LookupEnv(name)
+	if !prs {
+		return
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed <= 0 {
+		log.Fatalf("$%s must be a positive duration like 30m or 720h, got %q", name, v)
+	}
+	*d = parsed
+}
+
+// baseURLFromEnv returns $BASE_URL, the address the site is reached at, without a trailing slash
+func baseURLFromEnv() string {
+	v := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		log.Fatalf("$BASE_URL must be the site's address like https://blog.example.com, got %q", v)
+	}
+	return v
+}
+
+// uintFromEnv returns the environment variable name as a positive integer of at most max, or def if it is not set
+func uintFromEnv(name string, def, max uint64) uint64 {
+	v, prs := os.LookupEnv(name)
+	if !prs {
+		return def
+	}
+	parsed, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || parsed == 0 || parsed > max {
+		log.Fatalf("$%s must be a whole number from 1 to %d, got %q", name, max, v)
+	}
+	return parsed
+}
+
+// passwordConfig returns the argon2id parameters and the password policy, as set in the environment
+func passwordConfig() models.PasswordConfig {
+	cfg := models.DefaultPasswordConfig()
+	p, policy := &cfg.HashParams, &cfg.Policy
+	// memory is configured in MiB and stored in KiB
+	p.Memory = uint32(uintFromEnv("ARGON2_MEMORY", uint64(p.Memory/1024), 4096) * 1024)
+	p.Iterations = uint32(uintFromEnv("ARGON2_ITERATIONS", uint64(p.Iterations), 100))
+	p.Parallelism = uint8(uintFromEnv("ARGON2_PARALLELISM", uint64(p.Parallelism), 255))
+
+	policy.MinLength = int(uintFromEnv("PASSWORD_MIN_LENGTH", uint64(policy.MinLength), uint64(policy.MaxLength)))
+	policy.MinStrength = float64(uintFromEnv("PASSWORD_MIN_STRENGTH", uint64(policy.MinStrength), 1000))
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breached, err := models.LoadBreachedPasswords(path)
+		if err != nil {
+			log.Fatalf("loading breached passwords: %v", err)
+		}
+		policy.Breached = breached
+		log.Printf("loaded %d breached passwords from %s", len(breached), path)
+	}
+	return cfg
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// audit events
+const (
+	AuditAccountLocked   = "account.locked"
+	AuditIPLocked        = "ip.locked"
+	AuditUnlocked        = "login.unlocked"
+	AuditSessionsRevoked = "sessions.revoked"
+	AuditPasswordReset   = "password.reset"
+	AuditIdentityLinked  = "identity.linked"
+	AuditUserProvisioned = "user.provisioned"
+)
+
+// AuditModel implements an interface for access to the security audit log
+type AuditModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewAuditModel(client *mongo.Client, dbName string) *AuditModel {
+	return &AuditModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// AuditEntry is the model for documents in the audit_log collection. Username is the
+// account the event concerns and Actor the user who caused it, if any
+type AuditEntry struct {
+	Time     time.Time
+	Event    string
+	Username string `bson:",omitempty"`
+	IP       string `bson:",omitempty"`
+	Actor    string `bson:",omitempty"`
+	Detail   string `bson:",omitempty"`
+}
+
+// given an AuditEntry, add it to the log
+func (am *AuditModel) Record(ctx context.Context, entry AuditEntry) error {
+	log := am.client.Database(am.dbName).Collection("audit_log")
+
+	_, err := log.InsertOne(ctx, entry)
+	return err
+}
+
+// given a limit, return the most recent audit entries, newest first
+func (am *AuditModel) GetRecent(ctx context.Context, limit int) ([]AuditEntry, error) {
+	log := am.client.Database(am.dbName).Collection("audit_log")
+
+	var result []AuditEntry
+	opts := options.Find().SetSort(bson.M{"time": -1}).SetLimit(int64(limit))
+	cur, err := log.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	return result, nil
+}
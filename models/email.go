@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// lifetimes of the links sent by email
+const (
+	EmailVerificationLifetime = 48 * time.Hour
+	PasswordResetLifetime     = time.Hour
+)
+
+// EmailToken is a single-use link sent by email. Only the hash of its token is stored
+type EmailToken struct {
+	Hash      string
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// NormalizeEmail returns address trimmed and lower-cased, or an error if it is not a plain email address
+func NormalizeEmail(address string) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || parsed.Name != "" {
+		return "", errors.New("enter a valid email address")
+	}
+	return address, nil
+}
+
+// newEmailToken returns a random token and the EmailToken to store for it
+func newEmailToken(lifetime time.Duration) (string, EmailToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", EmailToken{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, EmailToken{Hash: hashToken(token), ExpiresAt: time.Now().Add(lifetime)}, nil
+}
+
+// checkEmailFree returns an error if an account other than username uses email
+func (u *UserModel) checkEmailFree(ctx context.Context, email, username string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	n, err := users.CountDocuments(ctx, bson.M{"email": email, "username": bson.M{"$ne": username}})
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return errors.New("email address already in use")
+	}
+	return nil
+}
+
+// given a username and an email address, change the user's address, which then needs verifying
+func (u *UserModel) SetEmail(ctx context.Context, username, email string) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	err = u.checkEmailFree(ctx, email, username)
+	if err != nil {
+		return err
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	_, err = users.UpdateOne(ctx, bson.M{"username": username}, bson.M{
+		"$set":   bson.M{"email": email, "email_verified": false},
+		"$unset": bson.M{"email_verification": "", "password_reset": ""},
+	})
+	return err
+}
+
+// given a username, start verifying the user's email address.
+// Returns the token for the link, replacing any sent before
+func (u *UserModel) BeginEmailVerification(ctx context.Context, username string) (string, error) {
+	token, et, err := newEmailToken(EmailVerificationLifetime)
+	if err != nil {
+		return "", err
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	_, err = users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"email_verification": et}})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// given a verification token, mark the email address it was sent to as verified and
+// return the user. Returns ErrTokenInvalid if the token is unknown, used or expired
+func (u *UserModel) VerifyEmail(ctx context.Context, token string) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var user User
+	err := users.FindOneAndUpdate(ctx,
+		bson.M{
+			"email_verification.hash":       hashToken(token),
+			"email_verification.expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"email_verified": true}, "$unset": bson.M{"email_verification": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrTokenInvalid
+	}
+	return user, err
+}
+
+// given a normalized email address, return the user who has confirmed it
+func (u *UserModel) GetByVerifiedEmail(ctx context.Context, email string) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var user User
+	err := users.FindOne(ctx, bson.M{"email": email, "email_verified": true}).Decode(&user)
+	return user, err
+}
+
+// given an email address, start a password reset for the account with that verified address.
+// Returns the user and the token for the link, or mongo.ErrNoDocuments if there is no such account
+func (u *UserModel) BeginPasswordReset(ctx context.Context, email string) (User, string, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return User{}, "", mongo.ErrNoDocuments
+	}
+	token, et, err := newEmailToken(PasswordResetLifetime)
+	if err != nil {
+		return User{}, "", err
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	var user User
+	err = users.FindOneAndUpdate(ctx,
+		bson.M{"email": email, "email_verified": true},
+		bson.M{"$set": bson.M{"password_reset": et}}).Decode(&user)
+	if err != nil {
+		return User{}, "", err
+	}
+	return user, token, nil
+}
+
+// given a reset token and a new password, check the password against the policy and set it, using up the token.
+// Returns ErrTokenInvalid if the token is unknown, used or expired
+func (u *UserModel) ResetPassword(ctx context.Context, token, password string) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+	filter := bson.M{
+		"password_reset.hash":       hashToken(token),
+		"password_reset.expires_at": bson.M{"$gt": time.Now()},
+	}
+
+	// the policy needs the username, so find the user before consuming the link
+	var user User
+	err := users.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrTokenInvalid
+	} else if err != nil {
+		return User{}, err
+	}
+	err = u.passwords.Policy.Check(user.Username, password)
+	if err != nil {
+		return User{}, err
+	}
+	hashed, err := u.passwords.HashParams.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = users.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"password": hashed}, "$unset": bson.M{"password_reset": ""}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrTokenInvalid
+	}
+	return user, err
+}
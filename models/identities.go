@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Identity links an account at an OpenID Connect provider, named by its issuer and
+// subject, to a user. Email is the address the provider gave when it was linked
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Email    string    `bson:",omitempty"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// ErrIdentityLinked is returned when linking an identity that belongs to another user
+var ErrIdentityLinked = errors.New("that single sign-on account is linked to another user")
+
+// usernameUnsafe matches the characters not used in provisioned usernames
+var usernameUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// given an issuer and subject, return the user the identity is linked to
+func (u *UserModel) GetByIdentity(ctx context.Context, issuer, subject string) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var user User
+	err := users.FindOne(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}).Decode(&user)
+	return user, err
+}
+
+// given a username and an Identity, link the identity to the user.
+// Returns ErrIdentityLinked if another user has it
+func (u *UserModel) LinkIdentity(ctx context.Context, username string, id Identity) error {
+	other, err := u.GetByIdentity(ctx, id.Issuer, id.Subject)
+	if err == nil && other.Username != username {
+		return ErrIdentityLinked
+	} else if err == nil {
+		return nil
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	id.LinkedAt = time.Now()
+	users := u.client.Database(u.dbName).Collection("users")
+	_, err = users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$push": bson.M{"identities": id}})
+	return err
+}
+
+// given a username, an issuer and a subject, unlink that identity from the user
+func (u *UserModel) UnlinkIdentity(ctx context.Context, username, issuer, subject string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	ur, err := users.UpdateOne(ctx, bson.M{"username": username},
+		bson.M{"$pull": bson.M{"identities": bson.M{"issuer": issuer, "subject": subject}}})
+	if err != nil {
+		return err
+	} else if ur.ModifiedCount == 0 {
+		return errors.New("single sign-on account not found")
+	}
+	return nil
+}
+
+// given the preferred username, display name and verified email address from a provider and the
+// Identity, create a user without a password who signs in through the provider. The username is
+// made safe and, if taken, numbered
+func (u *UserModel) ProvisionUser(ctx context.Context, preferred, display, email string, id Identity) (User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return User{}, err
+	}
+	err = u.checkEmailFree(ctx, email, "")
+	if err != nil {
+		return User{}, err
+	}
+
+	base := strings.Trim(usernameUnsafe.ReplaceAllString(strings.ToLower(preferred), "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+	username := base
+	for n := 2; ; n++ {
+		_, err := u.GetByUsername(ctx, username)
+		if err == mongo.ErrNoDocuments {
+			break
+		} else if err != nil {
+			return User{}, err
+		} else if n > 100 {
+			return User{}, errors.New("could not find a free username for " + base)
+		}
+		username = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	id.LinkedAt = time.Now()
+	user := User{
+		DisplayName:   display,
+		Username:      username,
+		CreatedAt:     time.Now(),
+		Email:         email,
+		EmailVerified: true,
+		Identities:    []Identity{id},
+	}
+	if user.DisplayName == "" {
+		user.DisplayName = username
+	}
+	return user, u.createUserFromModel(ctx, user)
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sign in throttling policy: after FreeLoginAttempts failures each further failure blocks
+// sign in for LoginDelay, doubling up to MaxLoginDelay. Reaching a lockout threshold blocks
+// sign in for LockoutDuration. Failures are forgotten LoginAttemptWindow after the last one
+const (
+	FreeLoginAttempts      = 3
+	LoginDelay             = time.Second
+	MaxLoginDelay          = time.Minute
+	AccountLockoutAttempts = 10
+	IPLockoutAttempts      = 50
+	LockoutDuration        = 15 * time.Minute
+	LoginAttemptWindow     = 24 * time.Hour
+)
+
+// password reset requests are limited the same way, counted per email address and per
+// client IP: reaching these limits blocks further requests for LockoutDuration
+const (
+	ResetAddressLimit = 5
+	ResetIPLimit      = 20
+)
+
+// LoginModel implements an interface for access to failed sign in attempts
+type LoginModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewLoginModel(client *mongo.Client, dbName string) *LoginModel {
+	return &LoginModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// LoginAttempts is the model for documents in the login_attempts collection: the recent
+// failed sign ins for one account (key "user:USERNAME") or one client IP (key "ip:ADDRESS"),
+// or the recent password reset requests for one email address or client IP
+type LoginAttempts struct {
+	Key          string
+	Failures     int
+	LastFailure  time.Time `bson:"last_failure"`
+	BlockedUntil time.Time `bson:"blocked_until"`
+	Locked       bool
+}
+
+// AccountKey returns the LoginAttempts key for username
+func AccountKey(username string) string {
+	return "user:" + username
+}
+
+// IPKey returns the LoginAttempts key for a client IP
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// ResetKey returns the LoginAttempts key counting password reset requests for an email address
+func ResetKey(email string) string {
+	return "reset:" + email
+}
+
+// ResetIPKey returns the LoginAttempts key counting password reset requests from a client IP
+func ResetIPKey(ip string) string {
+	return "reset-ip:" + ip
+}
+
+// loginBlock returns how long sign in is blocked after failures, and whether that is a lockout
+func loginBlock(failures, lockoutAt int) (time.Duration, bool) {
+	if failures >= lockoutAt {
+		return LockoutDuration, true
+	}
+	if failures <= FreeLoginAttempts {
+		return 0, false
+	}
+
+	d := LoginDelay
+	for i := FreeLoginAttempts + 1; i < failures && d < MaxLoginDelay; i++ {
+		d *= 2
+	}
+	if d > MaxLoginDelay {
+		d = MaxLoginDelay
+	}
+	return d, false
+}
+
+// given some keys, return the attempts recorded for them
+func (lm *LoginModel) GetAttempts(ctx context.Context, keys ...string) ([]LoginAttempts, error) {
+	attempts := lm.client.Database(lm.dbName).Collection("login_attempts")
+
+	var result []LoginAttempts
+	cur, err := attempts.Find(ctx, bson.M{"key": bson.M{"$in": keys}})
+	if err != nil {
+		return []LoginAttempts{}, err
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return []LoginAttempts{}, err
+	}
+	return result, nil
+}
+
+// RecordFailure counts a failed sign in for key at now and blocks further attempts according to
+// the policy above, locking key out once it has lockoutAt failures. The failure count is
+// incremented atomically so that concurrent attempts are all counted
+func (lm *LoginModel) RecordFailure(ctx context.Context, key string, lockoutAt int, now time.Time) (LoginAttempts, error) {
+	attempts := lm.client.Database(lm.dbName).Collection("login_attempts")
+
+	// start counting again if the last failure is old enough or a lockout has passed
+	_, err := attempts.UpdateOne(ctx,
+		bson.M{"key": key, "$or": bson.A{
+			bson.M{"last_failure": bson.M{"$lt": now.Add(-LoginAttemptWindow)}},
+			bson.M{"locked": true, "blocked_until": bson.M{"$lte": now}},
+		}},
+		bson.M{"$set": bson.M{"failures": 0, "locked": false}})
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+
+	var a LoginAttempts
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err = attempts.FindOneAndUpdate(ctx,
+		bson.M{"key": key},
+		bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"last_failure": now}},
+		opts).Decode(&a)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+
+	delay, locked := loginBlock(a.Failures, lockoutAt)
+	if delay == 0 {
+		return a, nil
+	}
+	a.BlockedUntil = now.Add(delay)
+	a.Locked = locked
+	_, err = attempts.UpdateOne(ctx,
+		bson.M{"key": key, "blocked_until": bson.M{"$not": bson.M{"$gt": a.BlockedUntil}}},
+		bson.M{"$set": bson.M{"blocked_until": a.BlockedUntil, "locked": a.Locked}})
+	return a, err
+}
+
+// given a key, forget its failed attempts after a successful sign in
+func (lm *LoginModel) ClearFailures(ctx context.Context, key string) error {
+	attempts := lm.client.Database(lm.dbName).Collection("login_attempts")
+
+	_, err := attempts.DeleteOne(ctx, bson.M{"key": key})
+	return err
+}
+
+// given a time, return the accounts and IPs that are locked out at that time
+func (lm *LoginModel) GetLocked(ctx context.Context, now time.Time) ([]LoginAttempts, error) {
+	attempts := lm.client.Database(lm.dbName).Collection("login_attempts")
+
+	var result []LoginAttempts
+	opts := options.Find().SetSort(bson.M{"last_failure": -1})
+	cur, err := attempts.Find(ctx, bson.M{"locked": true, "blocked_until": bson.M{"$gt": now}}, opts)
+	if err != nil {
+		return []LoginAttempts{}, err
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return []LoginAttempts{}, err
+	}
+	return result, nil
+}
+
+// given a key, lift its lockout and forget its failed attempts.
+// Returns mongo.ErrNoDocuments if nothing was recorded for key
+func (lm *LoginModel) Unlock(ctx context.Context, key string) error {
+	attempts := lm.client.Database(lm.dbName).Collection("login_attempts")
+
+	dr, err := attempts.DeleteOne(ctx, bson.M{"key": key})
+	if err != nil {
+		return err
+	} else if dr.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxMediaSize is the largest file the media store accepts, below the 16MB MongoDB document limit
+const MaxMediaSize = 15 << 20
+
+// MediaModel implements an interface for access to images and other files referenced by posts
+type MediaModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewMediaModel(client *mongo.Client, dbName string) *MediaModel {
+	return &MediaModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// Media is the model for documents in the media collection in the db.
+// Name is the path of the file below the site's media/ directory
+type Media struct {
+	OwnerUsername string `bson:"owner_username"`
+	Name          string
+	ContentType   string    `bson:"content_type"`
+	Data          []byte    `bson:"data"`
+	CreatedAt     time.Time `bson:"created_at"`
+}
+
+// ValidMediaName reports whether name is a path that stays below the site's media/ directory
+func ValidMediaName(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.Contains(name, "\\")
+}
+
+// given a Media struct, create or replace the file with the same owner and name
+func (mm *MediaModel) Save(ctx context.Context, media Media) error {
+	coll := mm.client.Database(mm.dbName).Collection("media")
+
+	if media.CreatedAt.IsZero() {
+		media.CreatedAt = time.Now()
+	}
+	opts := options.Replace().SetUpsert(true)
+	_, err := coll.ReplaceOne(ctx, bson.M{"owner_username": media.OwnerUsername, "name": media.Name}, media, opts)
+	return err
+}
+
+// given a username and name, return the file or mongo.ErrNoDocuments
+func (mm *MediaModel) Get(ctx context.Context, username, name string) (Media, error) {
+	coll := mm.client.Database(mm.dbName).Collection("media")
+
+	var media Media
+	err := coll.FindOne(ctx, bson.M{"owner_username": username, "name": name}).Decode(&media)
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// given a username, return every file that user has stored
+func (mm *MediaModel) GetByUsername(ctx context.Context, username string) ([]Media, error) {
+	coll := mm.client.Database(mm.dbName).Collection("media")
+
+	var media []Media
+	cur, err := coll.Find(ctx, bson.M{"owner_username": username})
+	if err != nil {
+		return []Media{}, err
+	}
+
+	err = cur.All(ctx, &media)
+	if err != nil {
+		return []Media{}, err
+	}
+	return media, nil
+}
+
+// given a username and name, remove the file
+func (mm *MediaModel) Delete(ctx context.Context, username, name string) error {
+	coll := mm.client.Database(mm.dbName).Collection("media")
+
+	_, err := coll.DeleteOne(ctx, bson.M{"owner_username": username, "name": name})
+	return err
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OverrideModel implements an interface for access to user-edited theme templates
+type OverrideModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewOverrideModel(client *mongo.Client, dbName string) *OverrideModel {
+	return &OverrideModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// TemplateOverride is the model for documents in the templates collection in the db.
+// Name is one of the overridable theme templates (post, index, header, footer)
+type TemplateOverride struct {
+	OwnerUsername string `bson:"owner_username"`
+	Name          string
+	Source        string
+	UpdatedAt     time.Time `bson:"updated_at"`
+}
+
+// given a username, return every template override that user has saved
+func (om *OverrideModel) GetByUsername(ctx context.Context, username string) ([]TemplateOverride, error) {
+	templates := om.client.Database(om.dbName).Collection("templates")
+
+	var overrides []TemplateOverride
+	cur, err := templates.Find(ctx, bson.M{"owner_username": username})
+	if err != nil {
+		return []TemplateOverride{}, err
+	}
+
+	err = cur.All(ctx, &overrides)
+	if err != nil {
+		return []TemplateOverride{}, err
+	}
+	return overrides, nil
+}
+
+// given a TemplateOverride, create or replace the override with the same owner and name
+func (om *OverrideModel) Save(ctx context.Context, override TemplateOverride) error {
+	templates := om.client.Database(om.dbName).Collection("templates")
+
+	override.UpdatedAt = time.Now()
+	opts := options.Replace().SetUpsert(true)
+	_, err := templates.ReplaceOne(ctx,
+		bson.M{"owner_username": override.OwnerUsername, "name": override.Name}, override, opts)
+	return err
+}
+
+// given a username and template name, remove the override so the theme's template is used again
+func (om *OverrideModel) Delete(ctx context.Context, username, name string) error {
+	templates := om.client.Database(om.dbName).Collection("templates")
+
+	_, err := templates.DeleteOne(ctx, bson.M{"owner_username": username, "name": name})
+	return err
+}
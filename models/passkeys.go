@@ -0,0 +1,229 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CeremonyLifetime is how long a browser has to answer a WebAuthn registration or sign in
+const CeremonyLifetime = 5 * time.Minute
+
+// WebAuthn ceremony kinds
+const (
+	CeremonyRegister     = "register"
+	CeremonyLogin        = "login"
+	CeremonySecondFactor = "second_factor"
+)
+
+// Passkey is a WebAuthn credential (a passkey or security key) stored on the user document
+type Passkey struct {
+	ID              string
+	Name            string
+	CredentialID    []byte `bson:"credential_id"`
+	PublicKey       []byte `bson:"public_key"`
+	AttestationType string `bson:"attestation_type"`
+	Transports      []string
+	AAGUID          []byte
+	SignCount       uint32    `bson:"sign_count"`
+	CreatedAt       time.Time `bson:"created_at"`
+	LastUsedAt      time.Time `bson:"last_used_at,omitempty"`
+}
+
+// NewPasskey returns the Passkey to store for a credential just registered
+func NewPasskey(name string, cred webauthn.Credential) Passkey {
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	return Passkey{
+		ID:              uuid.NewString(),
+		Name:            name,
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		Transports:      transports,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		CreatedAt:       time.Now(),
+	}
+}
+
+// WebAuthnUser adapts a User to the webauthn.User interface
+type WebAuthnUser struct {
+	User
+}
+
+func (wu WebAuthnUser) WebAuthnID() []byte {
+	return wu.User.WebAuthnID
+}
+
+func (wu WebAuthnUser) WebAuthnName() string {
+	return wu.Username
+}
+
+func (wu WebAuthnUser) WebAuthnDisplayName() string {
+	if wu.DisplayName != "" {
+		return wu.DisplayName
+	}
+	return wu.Username
+}
+
+func (wu WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (wu WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(wu.Passkeys))
+	for i, pk := range wu.Passkeys {
+		transports := make([]protocol.AuthenticatorTransport, len(pk.Transports))
+		for j, t := range pk.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+		creds[i] = webauthn.Credential{
+			ID:              pk.CredentialID,
+			PublicKey:       pk.PublicKey,
+			AttestationType: pk.AttestationType,
+			Transport:       transports,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    pk.AAGUID,
+				SignCount: pk.SignCount,
+			},
+		}
+	}
+	return creds
+}
+
+// NewWebAuthnID returns a random user handle. Handles are random rather than the
+// username so that authenticators do not learn anything about the account
+func NewWebAuthnID() ([]byte, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	return id, err
+}
+
+// given a username, the user's WebAuthn handle and a Passkey, store the passkey.
+// The handle is only set the first time
+func (u *UserModel) AddPasskey(ctx context.Context, username string, webauthnID []byte, pk Passkey) error {
+	pk.Name = strings.TrimSpace(pk.Name)
+	if pk.Name == "" {
+		return errors.New("passkey name is required")
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	ur, err := users.UpdateOne(ctx,
+		bson.M{"username": username, "$or": bson.A{
+			bson.M{"webauthn_id": bson.M{"$exists": false}},
+			bson.M{"webauthn_id": webauthnID},
+		}},
+		bson.M{"$push": bson.M{"passkeys": pk}, "$set": bson.M{"webauthn_id": webauthnID}})
+	if err != nil {
+		return err
+	} else if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// given a username and passkey ID, delete that passkey
+func (u *UserModel) RemovePasskey(ctx context.Context, username, id string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	ur, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$pull": bson.M{"passkeys": bson.M{"id": id}}})
+	if err != nil {
+		return err
+	} else if ur.ModifiedCount == 0 {
+		return errors.New("passkey not found")
+	}
+	return nil
+}
+
+// given a WebAuthn user handle, return the user it belongs to
+func (u *UserModel) GetByWebAuthnID(ctx context.Context, webauthnID []byte) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var user User
+	err := users.FindOne(ctx, bson.M{"webauthn_id": webauthnID}).Decode(&user)
+	return user, err
+}
+
+// given a username, a credential ID and the signature counter from a sign in with it,
+// record that the passkey was used
+func (u *UserModel) UpdatePasskeyUse(ctx context.Context, username string, credentialID []byte, signCount uint32) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	_, err := users.UpdateOne(ctx,
+		bson.M{"username": username, "passkeys.credential_id": credentialID},
+		bson.M{"$set": bson.M{
+			"passkeys.$.sign_count":   signCount,
+			"passkeys.$.last_used_at": time.Now(),
+		}})
+	return err
+}
+
+// CeremonyModel implements an interface for access to WebAuthn ceremonies in progress
+type CeremonyModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewCeremonyModel(client *mongo.Client, dbName string) *CeremonyModel {
+	return &CeremonyModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// Ceremony is the model for documents in the webauthn_ceremonies collection: the challenge
+// sent to a browser for a registration or sign in, found again by the hash of a cookie token.
+// Username is empty for passwordless sign ins, where the user is not known yet
+type Ceremony struct {
+	Hash      string
+	Kind      string
+	Username  string `bson:",omitempty"`
+	Session   webauthn.SessionData
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// given a Ceremony, store it and return the token the browser presents to finish it
+func (cm *CeremonyModel) Begin(ctx context.Context, c Ceremony) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	c.Hash = hashToken(token)
+	c.ExpiresAt = time.Now().Add(CeremonyLifetime)
+
+	ceremonies := cm.client.Database(cm.dbName).Collection("webauthn_ceremonies")
+	_, err := ceremonies.InsertOne(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	// clear out ceremonies that were never finished
+	_, err = ceremonies.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now()}})
+	return token, err
+}
+
+// given a token and the expected kind, remove and return the ceremony so that each
+// challenge can only be answered once. Returns ErrTokenInvalid if it is unknown or expired
+func (cm *CeremonyModel) Finish(ctx context.Context, token, kind string) (Ceremony, error) {
+	ceremonies := cm.client.Database(cm.dbName).Collection("webauthn_ceremonies")
+
+	var c Ceremony
+	err := ceremonies.FindOneAndDelete(ctx, bson.M{"hash": hashToken(token), "kind": kind}).Decode(&c)
+	if err == mongo.ErrNoDocuments || (err == nil && c.ExpiresAt.Before(time.Now())) {
+		return Ceremony{}, ErrTokenInvalid
+	}
+	return c, err
+}
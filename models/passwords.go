@@ -0,0 +1,128 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Argon2Params are the argon2id parameters new password hashes are made with.
+// Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params returns the parameters new hashes are made with unless others are configured
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// PasswordConfig is how a UserModel hashes passwords and which new passwords it allows.
+// Hashes made with other parameters than HashParams, and bcrypt hashes from before
+// argon2id was used, are replaced when their user next signs in
+type PasswordConfig struct {
+	HashParams Argon2Params
+	Policy     PasswordPolicy
+}
+
+// DefaultPasswordConfig returns the default hashing parameters and password policy
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{HashParams: DefaultArgon2Params(), Policy: DefaultPasswordPolicy()}
+}
+
+// argon2Prefix starts argon2id hashes, which are stored in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+const argon2Prefix = "$argon2id$"
+
+// Hash returns the argon2id hash of password made with p
+func (p Argon2Params) Hash(password string) ([]byte, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// decodeArgon2 returns the parameters, salt and key of an argon2id hash
+func decodeArgon2(hash []byte) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
+
+// given a User and a password, check if the password matches the user's argon2id or bcrypt hash
+func CheckPassword(user User, password string) bool {
+	if !bytes.HasPrefix(user.PasswordHashed, []byte(argon2Prefix)) {
+		return bcrypt.CompareHashAndPassword(user.PasswordHashed, []byte(password)) == nil
+	}
+
+	p, salt, key, err := decodeArgon2(user.PasswordHashed)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// NeedsRehash reports whether hash was made with bcrypt or with other parameters than p
+func (p Argon2Params) NeedsRehash(hash []byte) bool {
+	used, _, _, err := decodeArgon2(hash)
+	return err != nil || used != p
+}
+
+// given a User whose password was just checked and that password, replace the stored hash with
+// a new one made with the model's parameters. Nothing is changed if the password changed meanwhile
+func (u *UserModel) RehashPassword(ctx context.Context, user User, password string) error {
+	hashed, err := u.passwords.HashParams.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	_, err = users.UpdateOne(ctx,
+		bson.M{"username": user.Username, "password": user.PasswordHashed},
+		bson.M{"$set": bson.M{"password": hashed}})
+	return err
+}
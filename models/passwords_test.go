@@ -0,0 +1,73 @@
+package models
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapParams keeps the tests fast; only their equality with the hash's parameters matters
+var cheapParams = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestCheckPassword(t *testing.T) {
+	hashed, err := cheapParams.Hash("Quiet lantern 58 harbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Quiet lantern 58 harbor"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, hash := range map[string][]byte{"argon2id": hashed, "bcrypt": legacy} {
+		user := User{Username: "alice", PasswordHashed: hash}
+		if !CheckPassword(user, "Quiet lantern 58 harbor") {
+			t.Errorf("%s: the right password was refused", name)
+		}
+		if CheckPassword(user, "Quiet lantern 58 harbour") {
+			t.Errorf("%s: a wrong password was accepted", name)
+		}
+	}
+	if CheckPassword(User{Username: "alice"}, "") {
+		t.Error("a user without a password signed in with an empty one")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hashed, err := cheapParams.Hash("Quiet lantern 58 harbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Quiet lantern 58 harbor"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := cheapParams
+	stronger.Iterations++
+
+	tests := []struct {
+		name   string
+		params Argon2Params
+		hash   []byte
+		want   bool
+	}{
+		{"legacy bcrypt", cheapParams, legacy, true},
+		{"same parameters", cheapParams, hashed, false},
+		{"changed parameters", stronger, hashed, true},
+		{"not a hash", cheapParams, []byte("$argon2id$garbage"), true},
+	}
+	for _, tt := range tests {
+		if got := tt.params.NeedsRehash(tt.hash); got != tt.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the replacement hash is checked like any other and needs no further rehash
+	rehashed, err := stronger.Hash("Quiet lantern 58 harbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stronger.NeedsRehash(rehashed) || !CheckPassword(User{PasswordHashed: rehashed}, "Quiet lantern 58 harbor") {
+		t.Error("the new hash does not check out with the new parameters")
+	}
+}
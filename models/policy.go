@@ -0,0 +1,234 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is what new passwords are checked against when users are created
+// and passwords are changed or reset. Lengths count characters, not bytes
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength bounds the work of hashing very long passwords
+	MaxLength int
+	// MinStrength is the estimated number of bits of entropy a password needs
+	MinStrength float64
+	// Breached are passwords known from data breaches, which are refused whatever their strength
+	Breached BreachedPasswords
+}
+
+// DefaultPasswordPolicy returns the policy used unless another is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:   10,
+		MaxLength:   256,
+		MinStrength: 45,
+	}
+}
+
+// errors returned by PasswordPolicy.Check
+var (
+	ErrPasswordBreached = errors.New("this password has appeared in a data breach, please choose another")
+	ErrPasswordWeak     = errors.New("password is too easy to guess: avoid repeated characters and sequences like abc or qwerty, and use more characters or mix letters, digits and symbols")
+	ErrPasswordUsername = errors.New("password must not contain or resemble your username")
+)
+
+// Check returns an error describing why password is not allowed for username, or nil
+func (p PasswordPolicy) Check(username, password string) error {
+	if !utf8.ValidString(password) {
+		return errors.New("password must be valid UTF-8 text")
+	}
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+
+	if similarToUsername(username, password) {
+		return ErrPasswordUsername
+	}
+	if p.Breached.Contains(password) {
+		return ErrPasswordBreached
+	}
+	if PasswordStrength(password) < p.MinStrength {
+		return ErrPasswordWeak
+	}
+	return nil
+}
+
+// BreachedPasswords is a set of SHA-1 hashes of breached passwords
+type BreachedPasswords map[[sha1.Size]byte]struct{}
+
+// Contains reports whether password is in the set
+func (b BreachedPasswords) Contains(password string) bool {
+	_, ok := b[sha1.Sum([]byte(password))]
+	return ok
+}
+
+// LoadBreachedPasswords reads a list of breached passwords with one per line. Lines may be
+// plain passwords or SHA-1 hashes in hex optionally followed by ":count", the format of the
+// Have I Been Pwned downloads. Blank lines are skipped
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := BreachedPasswords{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		var sum [sha1.Size]byte
+		hash := line
+		if i := strings.IndexByte(line, ':'); i == sha1.Size*2 {
+			hash = line[:i]
+		}
+		if len(hash) == sha1.Size*2 {
+			if _, err := hex.Decode(sum[:], []byte(hash)); err == nil {
+				b[sum] = struct{}{}
+				continue
+			}
+		}
+		b[sha1.Sum([]byte(line))] = struct{}{}
+	}
+	return b, scanner.Err()
+}
+
+// sequences are runs of characters people type in order: the alphabet, digits and keyboard rows
+var sequences = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"01234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+// inSequence reports whether b comes right after or right before a in one of the sequences
+func inSequence(a, b rune) bool {
+	a, b = unicode.ToLower(a), unicode.ToLower(b)
+	for _, s := range sequences {
+		i := strings.IndexRune(s, a)
+		if i < 0 {
+			continue
+		}
+		if (i+1 < len(s) && rune(s[i+1]) == b) || (i > 0 && rune(s[i-1]) == b) {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordStrength estimates the bits of entropy in password from the kinds of characters
+// it uses. Characters that repeat an earlier one or continue a sequence only count one bit
+func PasswordStrength(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, c := range password {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, k := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if k.used {
+			pool += k.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	perChar := math.Log2(float64(pool))
+	bits := 0.0
+	seen := map[rune]int{}
+	var prev rune
+	for i, c := range password {
+		lc := unicode.ToLower(c)
+		if (i > 0 && inSequence(prev, c)) || seen[lc] >= 2 || (i > 0 && unicode.ToLower(prev) == lc) {
+			bits++
+		} else {
+			bits += perChar
+		}
+		seen[lc]++
+		prev = c
+	}
+	return bits
+}
+
+// similarToUsername reports whether password contains username, forwards or backwards,
+// is contained in it, or is only a few edits away from it. Case is ignored
+func similarToUsername(username, password string) bool {
+	u, p := strings.ToLower(username), strings.ToLower(password)
+	if utf8.RuneCountInString(u) < 3 {
+		return false
+	}
+	if strings.Contains(p, u) || strings.Contains(p, reverse(u)) || strings.Contains(u, p) {
+		return true
+	}
+	return levenshtein(u, p) <= utf8.RuneCountInString(p)/3
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// levenshtein returns the number of single character edits between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
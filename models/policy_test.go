@@ -0,0 +1,75 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+	policy.Breached = BreachedPasswords{sha1.Sum([]byte("Correct horse battery staple")): {}}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     string
+	}{
+		{"strong", "alice", "Quiet lantern 58 harbor", ""},
+		{"non-ASCII counts characters", "alice", "ünïcödé wörds 5ß", ""},
+		{"too short", "alice", "Qu!et 58", "password must be at least 10 characters"},
+		{"nine characters of two bytes", "alice", strings.Repeat("é", 9), "password must be at least 10 characters"},
+		{"too long", "alice", strings.Repeat("Quiet lantern 58 harbor ", 11), "password must be at most 256 characters"},
+		{"invalid UTF-8", "alice", "Quiet lantern 58 \xff", "password must be valid UTF-8 text"},
+		{"contains the username", "alice", "Alice is great 2024!", ErrPasswordUsername.Error()},
+		{"contains the username reversed", "alice", "ecila 58 harbor lantern", ErrPasswordUsername.Error()},
+		{"close to the username", "marguerite", "Marguerit3", ErrPasswordUsername.Error()},
+		{"short usernames are not compared", "al", "al quiet lantern 58", ""},
+		{"breached", "alice", "Correct horse battery staple", ErrPasswordBreached.Error()},
+		{"repeated characters", "alice", "aaaaaaaaaaaaaaaa", ErrPasswordWeak.Error()},
+		{"keyboard sequence", "alice", "qwertyuiop123456", ErrPasswordWeak.Error()},
+		{"digits only", "alice", "8675309142", ErrPasswordWeak.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.username, tt.password)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("Check(%q, %q) = %q, want %q", tt.username, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2hunter2"))
+	lines := []string{
+		"password123",
+		"",
+		strings.ToUpper(hex.EncodeToString(sum[:])) + ":4512\r",
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"password123", "hunter2hunter2"} {
+		if !b.Contains(p) {
+			t.Errorf("%q is not in the breached set", p)
+		}
+	}
+	if b.Contains("Quiet lantern 58 harbor") || len(b) != 2 {
+		t.Errorf("breached set has %d entries, want the 2 listed", len(b))
+	}
+}
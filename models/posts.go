@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -79,6 +81,20 @@ func (pm *PostModel) Update(ctx context.Context, post Post) error {
 	return nil
 }
 
+// given a slug, delete the matching post
+// returns mongo.ErrNoDocuments if there is no such post
+func (pm *PostModel) Delete(ctx context.Context, slug string) error {
+	posts := pm.client.Database(pm.dbName).Collection("posts")
+
+	dr, err := posts.DeleteOne(ctx, bson.M{"slug": slug})
+	if err != nil {
+		return err
+	} else if dr.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
 // given a username, return a list of posts that belong to that username
 func (pm *PostModel) GetByUsername(ctx context.Context, username string) ([]Post, error) {
 	posts := pm.client.Database(pm.dbName).Collection("posts")
@@ -105,6 +121,21 @@ type Post struct {
 	Content       string
 	Slug          string
 	Pubdate       time.Time
+	Tags          []string `bson:"tags,omitempty"`
+	Draft         bool
+	// Aliases are URL paths, relative to the site root, that redirect to this post
+	Aliases []string `bson:"aliases,omitempty"`
+}
+
+// DefaultSlug builds the slug used for a post that was not given one: title-pubdate
+func DefaultSlug(title string, pubdate time.Time) string {
+	return filepath.Clean(title + "-" + pubdate.Format("2006-01-02"))
+}
+
+// ValidSlug reports whether slug can be used as a file name in the generated site.
+// Hosts join the slug to the site's prefix, so it must not name another directory
+func ValidSlug(slug string) bool {
+	return slug != "" && slug != "." && slug != ".." && !strings.ContainsAny(slug, "/\\?#")
 }
 
 func NewPost(username, title, subtitle, author, content, slug string, pubdate time.Time) *Post {
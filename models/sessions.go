@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session lifetimes. A session ends after SessionIdleTimeout without being used or
+// SessionLifetime after signing in, whichever comes first. "Remember me" sessions
+// last RememberLifetime whether or not they are used
+var (
+	SessionIdleTimeout = 30 * time.Minute
+	SessionLifetime    = 12 * time.Hour
+	RememberLifetime   = 30 * 24 * time.Hour
+)
+
+// SessionModel implements an interface for access to the sessions of signed in browsers
+type SessionModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewSessionModel(client *mongo.Client, dbName string) *SessionModel {
+	return &SessionModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// Session is the model for documents in the sessions collection: a signed in browser, found by
+// ID and checked against the hash of its random token. Only the hash is stored; Token is set
+// only on the Session returned by Create.
+// ExpiresAt slides forward each time the session is used but never past AbsoluteExpiresAt,
+// and a TTL index deletes the document once it passes. ID names the session on the account
+// page, so that sessions can be revoked without showing their tokens
+type Session struct {
+	ID                string
+	Hash              string
+	Token             string `bson:"-"`
+	Username          string
+	Remember          bool      `bson:"remember,omitempty"`
+	UserAgent         string    `bson:"user_agent,omitempty"`
+	IP                string    `bson:"ip,omitempty"`
+	CreatedAt         time.Time `bson:"created_at"`
+	LastSeenAt        time.Time `bson:"last_seen_at"`
+	ExpiresAt         time.Time `bson:"expires_at"`
+	AbsoluteExpiresAt time.Time `bson:"absolute_expires_at"`
+}
+
+// HasToken reports whether token is the session's token
+func (s Session) HasToken(token string) bool {
+	return s.Hash == hashToken(token)
+}
+
+// EnsureIndexes creates the indexes sessions are looked up by, and the TTL index that
+// deletes them when they expire
+func (sm *SessionModel) EnsureIndexes(ctx context.Context) error {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+
+	_, err := sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "hash", Value: 1}}},
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// given a Session with the username and browser's details filled in, start the session.
+// Returns the stored Session with its token
+func (sm *SessionModel) Create(ctx context.Context, session Session) (Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	session.ID = uuid.NewString()
+	session.Token = base64.RawURLEncoding.EncodeToString(b)
+	session.Hash = hashToken(session.Token)
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.AbsoluteExpiresAt = now.Add(SessionLifetime)
+	idle := SessionIdleTimeout
+	if session.Remember {
+		session.AbsoluteExpiresAt = now.Add(RememberLifetime)
+		idle = RememberLifetime
+	}
+	session.ExpiresAt = now.Add(idle)
+	if session.ExpiresAt.After(session.AbsoluteExpiresAt) {
+		session.ExpiresAt = session.AbsoluteExpiresAt
+	}
+
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+	_, err := sessions.InsertOne(ctx, session)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// given a session ID and token, return the session if it has not expired and push back
+// its idle expiry, in a single update. Returns ErrTokenInvalid otherwise
+func (sm *SessionModel) Check(ctx context.Context, id, token string) (Session, error) {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+	now := time.Now()
+
+	// the TTL monitor only runs every minute, so expired sessions are filtered out here too
+	filter := bson.M{
+		"id":                  id,
+		"hash":                hashToken(token),
+		"expires_at":          bson.M{"$gt": now},
+		"absolute_expires_at": bson.M{"$gt": now},
+	}
+	idle := bson.M{"$cond": bson.A{"$remember", now.Add(RememberLifetime), now.Add(SessionIdleTimeout)}}
+	update := bson.A{bson.M{"$set": bson.M{
+		"last_seen_at": now,
+		"expires_at":   bson.M{"$min": bson.A{idle, "$absolute_expires_at"}},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var s Session
+	err := sessions.FindOneAndUpdate(ctx, filter, update, opts).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return Session{}, ErrTokenInvalid
+	}
+	return s, err
+}
+
+// given a token, end that session
+func (sm *SessionModel) Delete(ctx context.Context, token string) error {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+
+	_, err := sessions.DeleteOne(ctx, bson.M{"hash": hashToken(token)})
+	return err
+}
+
+// given a username, return the sessions that have not expired, most recently used first
+func (sm *SessionModel) GetByUsername(ctx context.Context, username string) ([]Session, error) {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+	now := time.Now()
+
+	opts := options.Find().SetSort(bson.M{"last_seen_at": -1})
+	cur, err := sessions.Find(ctx, bson.M{
+		"username":            username,
+		"expires_at":          bson.M{"$gt": now},
+		"absolute_expires_at": bson.M{"$gt": now},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Session
+	err = cur.All(ctx, &results)
+	return results, err
+}
+
+// given a username and a session ID, sign that session out
+func (sm *SessionModel) Revoke(ctx context.Context, username, id string) error {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+
+	dr, err := sessions.DeleteOne(ctx, bson.M{"username": username, "id": id})
+	if err != nil {
+		return err
+	} else if dr.DeletedCount == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// given a username and the token of a session to keep, sign out every other session.
+// An empty token signs out all of them
+func (sm *SessionModel) RevokeAll(ctx context.Context, username, keepToken string) error {
+	sessions := sm.client.Database(sm.dbName).Collection("sessions")
+
+	filter := bson.M{"username": username}
+	if keepToken != "" {
+		filter["hash"] = bson.M{"$ne": hashToken(keepToken)}
+	}
+	_, err := sessions.DeleteMany(ctx, filter)
+	return err
+}
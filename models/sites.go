@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SiteModel implements an interface for access to per-user site settings
+type SiteModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewSiteModel(client *mongo.Client, dbName string) *SiteModel {
+	return &SiteModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// Site is the model for documents in the sites collection in the db
+type Site struct {
+	OwnerUsername string `bson:"owner_username"`
+	Title         string
+	Theme         string
+	CodeStyle     string `bson:"code_style"`
+}
+
+// given a username, return the settings of that user's site
+// or mongo.ErrNoDocuments if they have never been saved
+func (sm *SiteModel) GetByUsername(ctx context.Context, username string) (Site, error) {
+	sites := sm.client.Database(sm.dbName).Collection("sites")
+
+	var site Site
+	err := sites.FindOne(ctx, bson.M{"owner_username": username}).Decode(&site)
+	if err != nil {
+		return Site{}, err
+	}
+	return site, nil
+}
+
+// given a Site struct, create or replace the settings for its owner
+func (sm *SiteModel) Save(ctx context.Context, site Site) error {
+	sites := sm.client.Database(sm.dbName).Collection("sites")
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := sites.ReplaceOne(ctx, bson.M{"owner_username": site.OwnerUsername}, site, opts)
+	return err
+}
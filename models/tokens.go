@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// scopes that can be granted to a personal API token
+const (
+	ScopeReadPosts  = "posts:read"
+	ScopeWritePosts = "posts:write"
+	ScopePublish    = "publish"
+)
+
+// Scopes lists every token scope with a short description for the account page
+var Scopes = []struct {
+	Name        string
+	Description string
+}{
+	{ScopeReadPosts, "Read posts"},
+	{ScopeWritePosts, "Create, edit and delete posts"},
+	{ScopePublish, "Generate and download the site"},
+}
+
+// TokenPrefix starts every personal API token so that leaked tokens are easy to recognize
+const TokenPrefix = "mdbssg_"
+
+// ErrTokenInvalid is returned when a bearer token is unknown or expired
+var ErrTokenInvalid = errors.New("invalid or expired token")
+
+// APIToken is a personal access token stored on the user document
+// only the SHA-256 hash of the token is kept; the token itself is shown once when created
+type APIToken struct {
+	ID         string
+	Name       string
+	Hash       string
+	Scopes     []string
+	CreatedAt  time.Time `bson:"created_at"`
+	ExpiresAt  time.Time `bson:"expires_at,omitempty"`
+	LastUsedAt time.Time `bson:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the token has an expiry in the past
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && t.ExpiresAt.Before(time.Now())
+}
+
+// HasScope reports whether the token was granted scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s.Name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// given a username, token name, scopes and optional expiry (zero for none), create a new token
+// returns the token, which cannot be recovered later, and its stored record
+func (u *UserModel) CreateToken(ctx context.Context, username, name string, scopes []string, expiresAt time.Time) (string, APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", APIToken{}, errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", APIToken{}, errors.New("select at least one scope")
+	}
+	for _, s := range scopes {
+		if !validScope(s) {
+			return "", APIToken{}, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIToken{}, err
+	}
+	token := TokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	record := APIToken{
+		ID:        uuid.NewString(),
+		Name:      name,
+		Hash:      hashToken(token),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	ur, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$push": bson.M{"tokens": record}})
+	if err != nil {
+		return "", APIToken{}, err
+	} else if ur.MatchedCount == 0 {
+		return "", APIToken{}, mongo.ErrNoDocuments
+	}
+	return token, record, nil
+}
+
+// given a username and token ID, delete that token
+func (u *UserModel) RevokeToken(ctx context.Context, username, id string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	ur, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$pull": bson.M{"tokens": bson.M{"id": id}}})
+	if err != nil {
+		return err
+	} else if ur.ModifiedCount == 0 {
+		return errors.New("token not found")
+	}
+	return nil
+}
+
+// given a bearer token, return the user it belongs to and the token record
+// and record the time it was used. Returns ErrTokenInvalid for unknown or expired tokens
+func (u *UserModel) GetByToken(ctx context.Context, token string) (User, APIToken, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+	hash := hashToken(token)
+
+	var user User
+	err := users.FindOne(ctx, bson.M{"tokens.hash": hash}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, APIToken{}, ErrTokenInvalid
+	} else if err != nil {
+		return User{}, APIToken{}, err
+	}
+
+	var record APIToken
+	for _, t := range user.Tokens {
+		if t.Hash == hash {
+			record = t
+		}
+	}
+	if record.Expired() {
+		return User{}, APIToken{}, ErrTokenInvalid
+	}
+
+	record.LastUsedAt = time.Now()
+	_, err = users.UpdateOne(ctx,
+		bson.M{"username": user.Username, "tokens.id": record.ID},
+		bson.M{"$set": bson.M{"tokens.$.last_used_at": record.LastUsedAt}})
+	if err != nil {
+		log.Printf("updating last_used_at for token %s: %v", record.ID, err)
+	}
+	return user, record, nil
+}
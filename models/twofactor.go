@@ -0,0 +1,224 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TOTPIssuer names the site in authenticator apps
+const TOTPIssuer = "MDBSSG"
+
+// RecoveryCodeCount is the number of single-use recovery codes issued when 2FA is enabled
+const RecoveryCodeCount = 10
+
+// MFAChallengeLifetime is how long a user has to enter their second factor after their password
+const MFAChallengeLifetime = 5 * time.Minute
+
+// ErrCodeInvalid is returned when a TOTP or recovery code is wrong or has already been used
+var ErrCodeInvalid = errors.New("invalid or already used code")
+
+// TwoFactor holds a user's TOTP settings. Pending is the secret shown during enrollment,
+// which becomes Secret once a code from it has been confirmed. Only SHA-256 hashes of
+// recovery codes are stored. LastCounter is the time step of the last accepted code,
+// so that each code is accepted only once
+type TwoFactor struct {
+	Secret        string    `bson:"secret,omitempty"`
+	Pending       string    `bson:"pending,omitempty"`
+	RecoveryCodes []string  `bson:"recovery_codes,omitempty"`
+	LastCounter   int64     `bson:"last_counter,omitempty"`
+	EnabledAt     time.Time `bson:"enabled_at,omitempty"`
+}
+
+// Enabled reports whether signing in needs a second factor
+func (tf TwoFactor) Enabled() bool {
+	return tf.Secret != ""
+}
+
+// MFAChallenge is a sign in waiting for its second factor. Only the hash of its token is stored.
+// Remember carries the "remember me" choice through to the session
+type MFAChallenge struct {
+	Hash      string
+	ExpiresAt time.Time `bson:"expires_at"`
+	Remember  bool      `bson:"remember,omitempty"`
+}
+
+// NewTOTPKey returns a new TOTP secret for username, which can be shown as a QR code
+func NewTOTPKey(username string) (*otp.Key, error) {
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      TOTPIssuer,
+		AccountName: username,
+	})
+}
+
+// TOTPKey returns the key for a stored secret, for showing it again as a QR code
+func TOTPKey(username, secret string) (*otp.Key, error) {
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTPIssuer + ":" + username,
+		RawQuery: url.Values{"secret": {secret}, "issuer": {TOTPIssuer}}.Encode(),
+	}
+	return otp.NewKeyFromURL(u.String())
+}
+
+// totpCounter returns the time step at which code is valid for secret, allowing one
+// step of clock drift either way, or false if it is not valid around now
+func totpCounter(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	opts := totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*30) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, opts)
+		if err == nil && expected == code {
+			return t.Unix() / 30, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns RecoveryCodeCount random codes formatted as xxxxx-xxxxx, and their hashes
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// given a username and a TOTP secret, store the secret as pending until it is confirmed with EnableTOTP
+func (u *UserModel) BeginTOTP(ctx context.Context, username, secret string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	_, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"two_factor.pending": secret}})
+	return err
+}
+
+// given a User with a pending secret, a code from that secret and the hashes of new recovery codes,
+// turn on two-factor authentication. Returns ErrCodeInvalid if the code does not match
+func (u *UserModel) EnableTOTP(ctx context.Context, user User, code string, recoveryHashes []string) error {
+	counter, ok := totpCounter(user.TwoFactor.Pending, code, time.Now())
+	if user.TwoFactor.Pending == "" || !ok {
+		return ErrCodeInvalid
+	}
+
+	users := u.client.Database(u.dbName).Collection("users")
+	_, err := users.UpdateOne(ctx,
+		bson.M{"username": user.Username, "two_factor.pending": user.TwoFactor.Pending},
+		bson.M{"$set": bson.M{"two_factor": TwoFactor{
+			Secret:        user.TwoFactor.Pending,
+			RecoveryCodes: recoveryHashes,
+			LastCounter:   counter,
+			EnabledAt:     time.Now(),
+		}}})
+	return err
+}
+
+// given a username, turn off two-factor authentication and forget the secret and recovery codes
+func (u *UserModel) DisableTOTP(ctx context.Context, username string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	_, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$unset": bson.M{"two_factor": ""}})
+	return err
+}
+
+// given a username and the hashes of new recovery codes, replace the user's recovery codes
+func (u *UserModel) SetRecoveryCodes(ctx context.Context, username string, recoveryHashes []string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	_, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"two_factor.recovery_codes": recoveryHashes}})
+	return err
+}
+
+// CheckSecondFactor accepts a current TOTP code or an unused recovery code for user.
+// Each is accepted only once: the code's time step or the recovery code is consumed atomically.
+// Returns ErrCodeInvalid otherwise
+func (u *UserModel) CheckSecondFactor(ctx context.Context, user User, code string) error {
+	if !user.TwoFactor.Enabled() {
+		return ErrCodeInvalid
+	}
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var ur *mongo.UpdateResult
+	var err error
+	if counter, ok := totpCounter(user.TwoFactor.Secret, code, time.Now()); ok {
+		ur, err = users.UpdateOne(ctx,
+			bson.M{"username": user.Username, "two_factor.last_counter": bson.M{"$not": bson.M{"$gte": counter}}},
+			bson.M{"$set": bson.M{"two_factor.last_counter": counter}})
+	} else {
+		hash := hashRecoveryCode(code)
+		ur, err = users.UpdateOne(ctx,
+			bson.M{"username": user.Username, "two_factor.recovery_codes": hash},
+			bson.M{"$pull": bson.M{"two_factor.recovery_codes": hash}})
+	}
+	if err != nil {
+		return err
+	} else if ur.ModifiedCount == 0 {
+		return ErrCodeInvalid
+	}
+	return nil
+}
+
+// given a username and whether to remember the browser, start a sign in that waits for the
+// second factor. Returns the challenge token, which is only stored hashed
+func (u *UserModel) BeginMFAChallenge(ctx context.Context, username string, remember bool) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	users := u.client.Database(u.dbName).Collection("users")
+	challenge := MFAChallenge{Hash: hashToken(token), ExpiresAt: time.Now().Add(MFAChallengeLifetime), Remember: remember}
+	_, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"mfa_challenge": challenge}})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// given a challenge token, return the user whose sign in is waiting for a second factor.
+// Returns ErrTokenInvalid for unknown or expired challenges
+func (u *UserModel) GetByMFAChallenge(ctx context.Context, token string) (User, error) {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	var user User
+	err := users.FindOne(ctx, bson.M{
+		"mfa_challenge.hash":       hashToken(token),
+		"mfa_challenge.expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrTokenInvalid
+	}
+	return user, err
+}
+
+// given a username, end the sign in waiting for a second factor
+func (u *UserModel) EndMFAChallenge(ctx context.Context, username string) error {
+	users := u.client.Database(u.dbName).Collection("users")
+
+	_, err := users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$unset": bson.M{"mfa_challenge": ""}})
+	return err
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookModel implements an interface for access to webhooks and their queued deliveries
+type WebhookModel struct {
+	client *mongo.Client
+	dbName string
+}
+
+func NewWebhookModel(client *mongo.Client, dbName string) *WebhookModel {
+	return &WebhookModel{
+		client: client,
+		dbName: dbName,
+	}
+}
+
+// Webhook is the model for documents in the webhooks collection in the db.
+// Events lists the event names the URL is notified of
+type Webhook struct {
+	ID            string
+	OwnerUsername string `bson:"owner_username"`
+	URL           string
+	Secret        string
+	Events        []string
+	Active        bool
+	CreatedAt     time.Time `bson:"created_at"`
+}
+
+// Subscribed reports whether the webhook is notified of event
+func (wh Webhook) Subscribed(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is the model for documents in the webhook_deliveries collection: one event
+// sent to one webhook, retried until it succeeds or runs out of attempts
+type Delivery struct {
+	ID            string
+	WebhookID     string `bson:"webhook_id"`
+	OwnerUsername string `bson:"owner_username"`
+	URL           string
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int
+	ResponseCode  int       `bson:"response_code"`
+	Error         string    `bson:"error,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	NextAttemptAt time.Time `bson:"next_attempt_at"`
+	CompletedAt   time.Time `bson:"completed_at,omitempty"`
+}
+
+// given a username, return that user's webhooks
+func (wm *WebhookModel) GetByUsername(ctx context.Context, username string) ([]Webhook, error) {
+	hooks := wm.client.Database(wm.dbName).Collection("webhooks")
+
+	var result []Webhook
+	cur, err := hooks.Find(ctx, bson.M{"owner_username": username}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return []Webhook{}, err
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return []Webhook{}, err
+	}
+	return result, nil
+}
+
+// given a webhook ID, return the webhook
+func (wm *WebhookModel) Get(ctx context.Context, id string) (Webhook, error) {
+	hooks := wm.client.Database(wm.dbName).Collection("webhooks")
+
+	var hook Webhook
+	err := hooks.FindOne(ctx, bson.M{"id": id}).Decode(&hook)
+	return hook, err
+}
+
+// given a Webhook, create or replace the webhook with the same ID
+func (wm *WebhookModel) Save(ctx context.Context, hook Webhook) error {
+	hooks := wm.client.Database(wm.dbName).Collection("webhooks")
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := hooks.ReplaceOne(ctx, bson.M{"id": hook.ID}, hook, opts)
+	return err
+}
+
+// given a username and webhook ID, delete the webhook and its delivery log
+func (wm *WebhookModel) Delete(ctx context.Context, username, id string) error {
+	db := wm.client.Database(wm.dbName)
+
+	dr, err := db.Collection("webhooks").DeleteOne(ctx, bson.M{"owner_username": username, "id": id})
+	if err != nil {
+		return err
+	} else if dr.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	_, err = db.Collection("webhook_deliveries").DeleteMany(ctx, bson.M{"webhook_id": id})
+	return err
+}
+
+// given a Delivery, add it to the queue
+func (wm *WebhookModel) CreateDelivery(ctx context.Context, d Delivery) error {
+	deliveries := wm.client.Database(wm.dbName).Collection("webhook_deliveries")
+
+	_, err := deliveries.InsertOne(ctx, d)
+	return err
+}
+
+// given a Delivery, replace the stored delivery with the same ID
+func (wm *WebhookModel) UpdateDelivery(ctx context.Context, d Delivery) error {
+	deliveries := wm.client.Database(wm.dbName).Collection("webhook_deliveries")
+
+	_, err := deliveries.ReplaceOne(ctx, bson.M{"id": d.ID}, d)
+	return err
+}
+
+// ClaimDelivery atomically takes the oldest pending delivery that is due at now and
+// pushes its next attempt back by lease, so that no other worker sends it meanwhile.
+// Returns mongo.ErrNoDocuments when nothing is due
+func (wm *WebhookModel) ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration) (Delivery, error) {
+	deliveries := wm.client.Database(wm.dbName).Collection("webhook_deliveries")
+
+	var d Delivery
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"next_attempt_at": 1}).
+		SetReturnDocument(options.After)
+	err := deliveries.FindOneAndUpdate(ctx,
+		bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}},
+		opts).Decode(&d)
+	return d, err
+}
+
+// given a username, return the most recent deliveries to that user's webhooks, newest first
+func (wm *WebhookModel) GetDeliveries(ctx context.Context, username string, limit int) ([]Delivery, error) {
+	deliveries := wm.client.Database(wm.dbName).Collection("webhook_deliveries")
+
+	var result []Delivery
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(limit))
+	cur, err := deliveries.Find(ctx, bson.M{"owner_username": username}, opts)
+	if err != nil {
+		return []Delivery{}, err
+	}
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return []Delivery{}, err
+	}
+	return result, nil
+}
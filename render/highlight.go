@@ -0,0 +1,191 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// DefaultCodeStyle is the highlighting style used when a site has not chosen one
+const DefaultCodeStyle = "github"
+
+// CodeStyles returns the names of the available highlighting styles
+func CodeStyles() []string {
+	return styles.Names()
+}
+
+// WriteCodeCSS writes the stylesheet for the named highlighting style.
+// Unknown names fall back to the default style
+func WriteCodeCSS(w io.Writer, style string) error {
+	s := styles.Get(style)
+	if s == styles.Fallback {
+		s = styles.Get(DefaultCodeStyle)
+	}
+	return chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(w, s)
+}
+
+// codeOptions are read from the attributes following the language in a fence info string, e.g.
+// ```go {linenos=true hl_lines="2 4-5" linenostart=10}
+type codeOptions struct {
+	lineNumbers bool
+	lineStart   int
+	highlight   [][2]int
+}
+
+// codeBlockRenderer renders fenced code blocks with chroma using CSS classes,
+// so the colors come from the stylesheet published with the site
+type codeBlockRenderer struct{}
+
+func (r *codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func (r *codeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+
+	var code strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		code.Write(seg.Value(source))
+	}
+
+	lang, opts := "", codeOptions{lineStart: 1}
+	if n.Info != nil {
+		lang, opts = parseInfo(string(n.Info.Segment.Value(source)))
+	}
+
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	} else {
+		lexer = lexers.Analyse(code.String())
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	it, err := lexer.Tokenise(nil, code.String())
+	if err != nil {
+		return ast.WalkStop, err
+	}
+
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(opts.lineNumbers),
+		chromahtml.LineNumbersInTable(opts.lineNumbers),
+		chromahtml.BaseLineNumber(opts.lineStart),
+		chromahtml.HighlightLines(opts.highlight),
+	)
+	err = formatter.Format(w, styles.Get(DefaultCodeStyle), it)
+	if err != nil {
+		return ast.WalkStop, err
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// parseInfo splits a fence info string into the language and the options in braces
+func parseInfo(info string) (string, codeOptions) {
+	opts := codeOptions{lineStart: 1}
+
+	info = strings.TrimSpace(info)
+	attrs := ""
+	if i := strings.Index(info, "{"); i != -1 {
+		attrs = strings.TrimSuffix(strings.TrimSpace(info[i+1:]), "}")
+		info = strings.TrimSpace(info[:i])
+	}
+
+	lang := ""
+	if fields := strings.Fields(info); len(fields) > 0 {
+		lang = fields[0]
+	}
+
+	for _, attr := range splitAttrs(attrs) {
+		eq := strings.Index(attr, "=")
+		if eq == -1 {
+			continue
+		}
+		key, value := strings.TrimSpace(attr[:eq]), strings.Trim(strings.TrimSpace(attr[eq+1:]), `"'`)
+
+		switch key {
+		case "linenos":
+			opts.lineNumbers = value != "false"
+		case "linenostart":
+			if n, err := strconv.Atoi(value); err == nil {
+				opts.lineStart = n
+			}
+		case "hl_lines":
+			opts.highlight = parseLineRanges(value)
+		}
+	}
+
+	// chroma highlights lines by their displayed number
+	for i := range opts.highlight {
+		opts.highlight[i][0] += opts.lineStart - 1
+		opts.highlight[i][1] += opts.lineStart - 1
+	}
+	return lang, opts
+}
+
+// splitAttrs splits attributes on spaces and commas outside of quotes and brackets
+func splitAttrs(s string) []string {
+	var attrs []string
+	var cur strings.Builder
+	var quote rune
+	depth := 0
+
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0 && (c == ' ' || c == ','):
+			if cur.Len() > 0 {
+				attrs = append(attrs, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+		cur.WriteRune(c)
+	}
+	if cur.Len() > 0 {
+		attrs = append(attrs, cur.String())
+	}
+	return attrs
+}
+
+// parseLineRanges parses line numbers such as "2 4-5" or [2,"4-5"] into inclusive ranges
+func parseLineRanges(s string) [][2]int {
+	s = strings.NewReplacer("[", " ", "]", " ", ",", " ", `"`, " ").Replace(s)
+
+	var ranges [][2]int
+	for _, f := range strings.Fields(s) {
+		var from, to int
+		if _, err := fmt.Sscanf(f, "%d-%d", &from, &to); err == nil {
+			ranges = append(ranges, [2]int{from, to})
+		} else if n, err := strconv.Atoi(f); err == nil {
+			ranges = append(ranges, [2]int{n, n})
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,191 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/tydar/mdbssg/shortcodes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// WordsPerMinute is the reading speed used to estimate reading time
+const WordsPerMinute = 200
+
+// Renderer turns post content into HTML: shortcodes are expanded first,
+// then the remaining content is rendered as Markdown with fenced code blocks highlighted
+// and headings given stable anchor IDs
+type Renderer struct {
+	shortcodes *shortcodes.Registry
+	md         goldmark.Markdown
+}
+
+// Result is rendered post content
+type Result struct {
+	HTML template.HTML
+	// TOC is a nested list of links to the headings of the content
+	TOC      template.HTML
+	Headings []Heading
+	// WordCount counts the words of the text and code of the content, excluding shortcodes
+	WordCount int
+	// ReadingTime is the estimated reading time in minutes
+	ReadingTime int
+}
+
+// Heading is a heading of the rendered content
+type Heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// New returns a Renderer that expands the shortcodes in sc.
+// Raw HTML in the Markdown source is not passed through; embeds go through shortcodes
+func New(sc *shortcodes.Registry) *Renderer {
+	return &Renderer{
+		shortcodes: sc,
+		md: goldmark.New(
+			goldmark.WithExtensions(extension.GFM),
+			goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+			goldmark.WithRendererOptions(renderer.WithNodeRenderers(
+				util.Prioritized(&codeBlockRenderer{}, 100),
+				util.Prioritized(&headingRenderer{}, 100),
+			)),
+		),
+	}
+}
+
+// Render renders post content
+func (r *Renderer) Render(content string) (Result, error) {
+	return r.render(content)
+}
+
+// inner renders the content of paired shortcodes
+func (r *Renderer) inner(content string) (template.HTML, error) {
+	res, err := r.render(content)
+	return res.HTML, err
+}
+
+func (r *Renderer) render(content string) (Result, error) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	src, expansions, err := r.shortcodes.Expand(content, r.inner)
+	if err != nil {
+		return Result{}, err
+	}
+
+	source := []byte(src)
+	doc := r.md.Parser().Parse(text.NewReader(source))
+
+	buf := new(bytes.Buffer)
+	if err := r.md.Renderer().Render(buf, source, doc); err != nil {
+		return Result{}, err
+	}
+
+	headings := collectHeadings(doc, source)
+	words := countWords(doc, source)
+	return Result{
+		HTML:        template.HTML(shortcodes.Restore(buf.String(), expansions)),
+		TOC:         tableOfContents(headings),
+		Headings:    headings,
+		WordCount:   words,
+		ReadingTime: readingTime(words),
+	}, nil
+}
+
+func collectHeadings(doc ast.Node, source []byte) []Heading {
+	var headings []Heading
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		h, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+
+		id, _ := h.AttributeString("id")
+		idBytes, _ := id.([]byte)
+		headings = append(headings, Heading{
+			Level: h.Level,
+			ID:    string(idBytes),
+			Text:  string(h.Text(source)),
+		})
+		return ast.WalkSkipChildren, nil
+	})
+	return headings
+}
+
+// tableOfContents nests headings by level into <ul> lists.
+// A heading more than one level deeper than its parent is nested only one level
+func tableOfContents(headings []Heading) template.HTML {
+	if len(headings) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	var levels []int
+	for _, h := range headings {
+		switch {
+		case len(levels) == 0 || h.Level > levels[len(levels)-1]:
+			b.WriteString("<ul>")
+			levels = append(levels, h.Level)
+		default:
+			for len(levels) > 1 && h.Level < levels[len(levels)-1] && h.Level <= levels[len(levels)-2] {
+				b.WriteString("</li></ul>")
+				levels = levels[:len(levels)-1]
+			}
+			b.WriteString("</li>")
+		}
+		fmt.Fprintf(&b, `<li><a href="#%s">%s</a>`, template.HTMLEscapeString(h.ID), template.HTMLEscapeString(h.Text))
+	}
+	for range levels {
+		b.WriteString("</li></ul>")
+	}
+	return template.HTML(b.String())
+}
+
+func countWords(doc ast.Node, source []byte) int {
+	words := 0
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch node := n.(type) {
+		case *ast.Text:
+			words += countFields(string(node.Segment.Value(source)))
+		case *ast.FencedCodeBlock, *ast.CodeBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				seg := lines.At(i)
+				words += countFields(string(seg.Value(source)))
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return words
+}
+
+func countFields(s string) int {
+	count := 0
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "MDBSSGSHORTCODE") {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func readingTime(words int) int {
+	if words == 0 {
+		return 0
+	}
+	return (words + WordsPerMinute - 1) / WordsPerMinute
+}
@@ -0,0 +1,111 @@
+// Package safehttp makes HTTP requests to URLs supplied by users. Requests only reach public
+// addresses, so such URLs cannot be used to read services on the server's own network
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a request would connect to an address that is not public
+var ErrBlockedAddress = errors.New("address not allowed")
+
+// AllowPrivate lets requests reach any address. It is meant for trying webhooks and imports
+// against services running on the same machine during development
+var AllowPrivate bool
+
+// MaxRedirects is the number of redirects a client follows
+const MaxRedirects = 5
+
+// blockedNets are non-public ranges not covered by the net.IP methods used in Blocked
+var blockedNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),
+	mustCIDR("100.64.0.0/10"), // carrier-grade NAT, also used for some cloud metadata services
+	mustCIDR("192.0.0.0/24"),
+	mustCIDR("198.18.0.0/15"),
+	mustCIDR("240.0.0.0/4"),
+	mustCIDR("64:ff9b::/96"), // NAT64 can reach any IPv4 address
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Blocked reports whether requests may not connect to ip: loopback, private, link-local
+// (which includes the 169.254.169.254 metadata endpoint), unspecified, multicast and
+// other reserved addresses
+func Blocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// control refuses connections to blocked addresses. It runs after the host name is resolved,
+// for every connection including those made for redirects, so a name that resolves to a
+// public address when checked and a private one when used cannot get through
+func control(network, address string, c syscall.RawConn) error {
+	if AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || Blocked(ip) {
+		return fmt.Errorf("connecting to %s: %w", host, ErrBlockedAddress)
+	}
+	return nil
+}
+
+// CheckURL returns an error unless u is an absolute http or https URL
+func CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: only http and https URLs are allowed", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%s: URL has no host", u.Redacted())
+	}
+	return nil
+}
+
+// NewClient returns a client that only connects to public addresses over http or https,
+// following at most MaxRedirects redirects. Proxy settings from the environment are ignored
+// because the proxy, not the client, would then choose the address
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: control}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", MaxRedirects)
+			}
+			return CheckURL(req.URL)
+		},
+	}
+}
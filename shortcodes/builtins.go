@@ -0,0 +1,32 @@
+package shortcodes
+
+type builtin struct {
+	name   string
+	params []string
+	source string
+}
+
+var builtins = []builtin{
+	{
+		name:   "youtube",
+		params: []string{"id"},
+		source: `<div class="shortcode-youtube"><iframe src="https://www.youtube-nocookie.com/embed/{{ .Get "id" }}" ` +
+			`width="560" height="315" frameborder="0" allowfullscreen ` +
+			`allow="accelerometer; clipboard-write; encrypted-media; gyroscope; picture-in-picture"></iframe></div>`,
+	},
+	{
+		name:   "figure",
+		params: []string{"src", "caption"},
+		source: `<figure class="shortcode-figure"><img src="{{ .Get "src" }}" alt="{{ .Get "caption" }}">` +
+			`{{ with .Get "caption" }}<figcaption>{{ . }}</figcaption>{{ end }}</figure>`,
+	},
+	{
+		name:   "gist",
+		params: []string{"user", "id"},
+		source: `<script src="https://gist.github.com/{{ .Get "user" }}/{{ .Get "id" }}.js"></script>`,
+	},
+	{
+		name:   "note",
+		source: `<aside class="shortcode-note">{{ .Inner }}</aside>`,
+	},
+}
@@ -0,0 +1,427 @@
+package shortcodes
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// Shortcode is a named snippet that can be embedded in post content as
+// {{< name arg key="value" >}} or, when it wraps content, {{< name >}}...{{< /name >}}
+type Shortcode struct {
+	Name string
+	// Params names the positional arguments so templates can look them up with .Get "name"
+	Params   []string
+	Template *template.Template
+}
+
+// Call is the data a shortcode template is executed with
+type Call struct {
+	Name   string
+	Args   []string
+	Params map[string]string
+	// Inner is the rendered content between the opening and closing tags of a paired shortcode
+	Inner template.HTML
+
+	names []string
+}
+
+// Get returns a named argument, or a positional argument by index or by the name
+// the shortcode gives that position. Missing arguments return an empty string
+func (c Call) Get(key interface{}) string {
+	switch k := key.(type) {
+	case int:
+		if k >= 0 && k < len(c.Args) {
+			return c.Args[k]
+		}
+	case string:
+		if v, ok := c.Params[k]; ok {
+			return v
+		}
+		for i, name := range c.names {
+			if name == k && i < len(c.Args) {
+				return c.Args[i]
+			}
+		}
+	}
+	return ""
+}
+
+// InnerFunc renders the content wrapped by a paired shortcode
+type InnerFunc func(src string) (template.HTML, error)
+
+// Registry holds the shortcodes available when rendering post content
+type Registry struct {
+	codes map[string]*Shortcode
+}
+
+// NewRegistry returns a registry containing the built-in shortcodes
+func NewRegistry() *Registry {
+	r := &Registry{codes: make(map[string]*Shortcode)}
+	for _, b := range builtins {
+		r.Register(&Shortcode{
+			Name:     b.name,
+			Params:   b.params,
+			Template: template.Must(template.New(b.name).Parse(b.source)),
+		})
+	}
+	return r
+}
+
+// Register adds sc to the registry, replacing any shortcode with the same name
+func (r *Registry) Register(sc *Shortcode) {
+	r.codes[sc.Name] = sc
+}
+
+// Get returns the named shortcode, or false if it is not registered
+func (r *Registry) Get(name string) (*Shortcode, bool) {
+	sc, ok := r.codes[name]
+	return sc, ok
+}
+
+// With returns a copy of the registry with shortcodes parsed from sources, keyed by name.
+// A source replacing a registered shortcode keeps that shortcode's positional parameter names
+func (r *Registry) With(sources map[string]string) (*Registry, error) {
+	c := &Registry{codes: make(map[string]*Shortcode, len(r.codes)+len(sources))}
+	for name, sc := range r.codes {
+		c.codes[name] = sc
+	}
+
+	for name, src := range sources {
+		tmpl, err := template.New(name).Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("shortcode %s: %v", name, err)
+		}
+
+		sc := &Shortcode{Name: name, Template: tmpl}
+		if existing, ok := r.codes[name]; ok {
+			sc.Params = existing.Params
+		}
+		c.codes[name] = sc
+	}
+	return c, nil
+}
+
+// Placeholder returns the text Expand puts in place of the i-th shortcode.
+// It is plain alphanumeric text so Markdown rendering passes it through untouched
+func Placeholder(i int) string {
+	return "MDBSSGSHORTCODE" + strconv.Itoa(i) + "END"
+}
+
+// Expand replaces every shortcode in src with a placeholder and executes it,
+// returning the rewritten source and the HTML for each placeholder in order.
+// inner is used to render the content of paired shortcodes. Tags in code spans and
+// fenced code blocks, tags of unknown shortcodes and malformed tags, such as a {{< with
+// no >}} or an argument with an unbalanced quote, are left as they are
+func (r *Registry) Expand(src string, inner InnerFunc) (string, []template.HTML, error) {
+	var out strings.Builder
+	var expansions []template.HTML
+	code := codeRanges(src)
+
+	i := 0
+	for {
+		start, end, t := nextTag(src, i, code)
+		if start == -1 {
+			break
+		}
+
+		sc, ok := r.codes[t.name]
+		if !ok || t.closing {
+			// a closing tag here belongs to an unknown shortcode or has no opening tag
+			out.WriteString(src[i:end])
+			i = end
+			continue
+		}
+
+		call := Call{Name: t.name, Args: t.args, Params: t.params, names: sc.Params}
+
+		next := end
+		innerEnd, closeEnd := findClose(src, end, t.name, code)
+		if innerEnd != -1 {
+			var err error
+			call.Inner, err = inner(src[end:innerEnd])
+			if err != nil {
+				return "", nil, err
+			}
+			next = closeEnd
+		}
+
+		buf := new(bytes.Buffer)
+		if err := sc.Template.Execute(buf, call); err != nil {
+			return "", nil, fmt.Errorf("shortcode %s: %v", t.name, err)
+		}
+
+		out.WriteString(src[i:start])
+		out.WriteString(Placeholder(len(expansions)))
+		expansions = append(expansions, template.HTML(buf.String()))
+		i = next
+	}
+
+	out.WriteString(src[i:])
+	return out.String(), expansions, nil
+}
+
+// Restore replaces the placeholders left by Expand in rendered HTML with the shortcode output.
+// A placeholder that Markdown wrapped in its own paragraph is replaced along with the <p> tags
+func Restore(html string, expansions []template.HTML) string {
+	for i := len(expansions) - 1; i >= 0; i-- {
+		ph := Placeholder(i)
+		html = strings.ReplaceAll(html, "<p>"+ph+"</p>", string(expansions[i]))
+		html = strings.ReplaceAll(html, ph, string(expansions[i]))
+	}
+	return html
+}
+
+type tag struct {
+	name    string
+	closing bool
+	args    []string
+	params  map[string]string
+}
+
+// nextTag finds the first well-formed shortcode tag in src at or after offset i that is not
+// in code. It returns the start and end offsets of the whole tag, or -1 if there are no more tags.
+// A {{< that does not start a well-formed tag is skipped as text
+func nextTag(src string, i int, code [][2]int) (int, int, tag) {
+	for {
+		idx := strings.Index(src[i:], "{{<")
+		if idx == -1 {
+			return -1, -1, tag{}
+		}
+		start := i + idx
+		i = start + len("{{<")
+		if c, ok := inCode(start, code); ok {
+			i = c[1]
+			continue
+		}
+
+		idx = strings.Index(src[start:], ">}}")
+		if idx == -1 {
+			// nothing after this can be terminated either
+			return -1, -1, tag{}
+		}
+		end := start + idx + len(">}}")
+		inside := src[start+len("{{<") : end-len(">}}")]
+		if strings.Contains(inside, "{{<") {
+			// this one was never closed, but a later tag may be well-formed
+			continue
+		}
+		if t, err := parseTag(inside); err == nil {
+			return start, end, t
+		}
+	}
+}
+
+// inCode returns the code range containing offset pos, if there is one
+func inCode(pos int, code [][2]int) ([2]int, bool) {
+	for _, c := range code {
+		if pos >= c[0] && pos < c[1] {
+			return c, true
+		}
+	}
+	return [2]int{}, false
+}
+
+// findClose looks for the tag closing a shortcode named name opened just before offset i,
+// allowing nested shortcodes of the same name. It returns the start and end offsets of the
+// closing tag, or -1 if the shortcode is not paired
+func findClose(src string, i int, name string, code [][2]int) (int, int) {
+	depth := 1
+	for {
+		start, end, t := nextTag(src, i, code)
+		if start == -1 {
+			return -1, -1
+		}
+
+		if t.name == name {
+			if t.closing {
+				depth--
+			} else {
+				depth++
+			}
+		}
+		if depth == 0 {
+			return start, end
+		}
+		i = end
+	}
+}
+
+// codeRanges returns the start and end offsets of the fenced code blocks and code spans in src,
+// where shortcode tags are shown rather than expanded. Indented code blocks are not recognised
+func codeRanges(src string) [][2]int {
+	var ranges [][2]int
+	text := 0
+	for pos := 0; pos < len(src); {
+		lineEnd := endOfLine(src, pos)
+		fence := openingFence(src[pos:lineEnd])
+		if fence == "" {
+			pos = lineEnd
+			continue
+		}
+
+		ranges = append(ranges, codeSpans(src, text, pos)...)
+		// an unclosed fence runs to the end of the document
+		end := len(src)
+		for p := lineEnd; p < len(src); {
+			le := endOfLine(src, p)
+			if closesFence(src[p:le], fence) {
+				end = le
+				break
+			}
+			p = le
+		}
+		ranges = append(ranges, [2]int{pos, end})
+		pos, text = end, end
+	}
+	return append(ranges, codeSpans(src, text, len(src))...)
+}
+
+// endOfLine returns the offset just past the newline ending the line that starts at pos
+func endOfLine(src string, pos int) int {
+	if idx := strings.IndexByte(src[pos:], '\n'); idx != -1 {
+		return pos + idx + 1
+	}
+	return len(src)
+}
+
+// openingFence returns the fence (three or more backticks or tildes) that line opens a
+// fenced code block with, or "" if it does not open one
+func openingFence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == trimmed[0] {
+		n++
+	}
+	if n < 3 || (trimmed[0] == '`' && strings.Contains(trimmed[n:], "`")) {
+		return ""
+	}
+	return trimmed[:n]
+}
+
+// closesFence reports whether line closes a fenced code block opened with fence
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return false
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == fence[0] {
+		n++
+	}
+	return n >= len(fence) && strings.TrimSpace(trimmed[n:]) == ""
+}
+
+// codeSpans returns the code spans between offsets from and to of src: a run of backticks
+// up to the next run of the same length
+func codeSpans(src string, from, to int) [][2]int {
+	var spans [][2]int
+	run := func(i int) int {
+		n := 0
+		for i+n < to && src[i+n] == '`' {
+			n++
+		}
+		return n
+	}
+
+	for i := from; i < to; {
+		if src[i] == '\\' {
+			i += 2
+			continue
+		}
+		if src[i] != '`' {
+			i++
+			continue
+		}
+		n := run(i)
+		end := -1
+		for j := i + n; j < to; {
+			if src[j] != '`' {
+				j++
+				continue
+			}
+			m := run(j)
+			if m == n {
+				end = j + m
+				break
+			}
+			j += m
+		}
+		if end == -1 {
+			// an unmatched run is literal backticks
+			i += n
+			continue
+		}
+		spans = append(spans, [2]int{i, end})
+		i = end
+	}
+	return spans
+}
+
+// parseTag splits the inside of a tag into its name and arguments.
+// Arguments are separated by spaces and may be double quoted; key=value arguments are named
+func parseTag(s string) (tag, error) {
+	fields, err := splitFields(s)
+	if err != nil {
+		return tag{}, err
+	}
+	if len(fields) == 0 {
+		return tag{}, fmt.Errorf("shortcode: empty tag")
+	}
+
+	t := tag{name: fields[0], params: make(map[string]string)}
+	if strings.HasPrefix(t.name, "/") {
+		t.closing = true
+		t.name = t.name[1:]
+	}
+
+	for _, f := range fields[1:] {
+		if eq := strings.Index(f, "="); eq > 0 {
+			t.params[f[:eq]] = unquote(f[eq+1:])
+			continue
+		}
+		t.args = append(t.args, unquote(f))
+	}
+	return t, nil
+}
+
+func splitFields(s string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	inQuote := false
+
+	for _, c := range s {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			cur.WriteRune(c)
+		case !inQuote && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if cur.Len() > 0 {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(c)
+		}
+	}
+
+	if inQuote {
+		return nil, fmt.Errorf("shortcode: unterminated quote in %q", strings.TrimSpace(s))
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
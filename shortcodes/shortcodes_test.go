@@ -0,0 +1,88 @@
+package shortcodes
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+// expand runs Expand on src with inner content left as it is and restores the output
+func expand(t *testing.T, r *Registry, src string) string {
+	t.Helper()
+	out, expansions, err := r.Expand(src, func(src string) (template.HTML, error) {
+		return template.HTML(strings.TrimSpace(src)), nil
+	})
+	if err != nil {
+		t.Fatalf("Expand(%q): %v", src, err)
+	}
+	return Restore(out, expansions)
+}
+
+func TestExpand(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&Shortcode{
+		Name:     "args",
+		Params:   []string{"first"},
+		Template: template.Must(template.New("args").Parse(`[{{ .Get "first" }}|{{ .Get 1 }}|{{ .Get "key" }}|{{ .Inner }}]`)),
+	})
+
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"positional", `{{< args a b >}}`, `[a|b||]`},
+		{"quoted and named", `{{< args "a b" key="c d" >}}`, `[a b||c d|]`},
+		{"no spaces", `{{<args a>}}`, `[a|||]`},
+		{"paired", `x {{< args a >}}inner{{< /args >}} y`, `x [a|||inner] y`},
+		{"nested", `{{< args 1 >}}{{< args 2 >}}in{{< /args >}}{{< /args >}}`, `[1|||{{< args 2 >}}in{{< /args >}}]`},
+		{"built-in", `{{< youtube abc >}}`, `<div class="shortcode-youtube"><iframe src="https://www.youtube-nocookie.com/embed/abc" ` +
+			`width="560" height="315" frameborder="0" allowfullscreen ` +
+			`allow="accelerometer; clipboard-write; encrypted-media; gyroscope; picture-in-picture"></iframe></div>`},
+		{"escaped arguments", `{{< args "<b>" >}}`, `[&lt;b&gt;|||]`},
+		{"unknown", `{{< nope a >}}`, `{{< nope a >}}`},
+		{"closing without opening", `{{< /args >}}`, `{{< /args >}}`},
+		{"code span", "`{{< args a >}}` {{< args b >}}", "`{{< args a >}}` [b|||]"},
+		{"fenced code", "```\n{{< args a >}}\n```\n{{< args b >}}", "```\n{{< args a >}}\n```\n[b|||]"},
+
+		// malformed tags are text
+		{"unterminated", `a {{< args b`, `a {{< args b`},
+		{"unterminated before a tag", `a {{< b {{< args c >}}`, `a {{< b [c|||]`},
+		{"unbalanced quote", `{{< args "a >}} then {{< args b >}}`, `{{< args "a >}} then [b|||]`},
+		{"empty", `{{< >}} {{<>}}`, `{{< >}} {{<>}}`},
+		{"stray close", `a >}} {{< args b >}}`, `a >}} [b|||]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expand(t, r, tt.src); got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplateError(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&Shortcode{Name: "broken", Template: template.Must(template.New("broken").Parse(`{{ .Missing }}`))})
+	if _, _, err := r.Expand(`{{< broken >}}`, nil); err == nil {
+		t.Error("a shortcode whose template fails expanded without an error")
+	}
+}
+
+func TestWith(t *testing.T) {
+	r := NewRegistry()
+	c, err := r.With(map[string]string{"youtube": `<a href="https://youtu.be/{{ .Get "id" }}">video</a>`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expand(t, c, `{{< youtube abc >}}`), `<a href="https://youtu.be/abc">video</a>`; got != want {
+		t.Errorf("overridden shortcode = %q, want %q", got, want)
+	}
+	if got := expand(t, r, `{{< youtube abc >}}`); !strings.Contains(got, "youtube-nocookie") {
+		t.Errorf("the original registry changed: %q", got)
+	}
+
+	if _, err := r.With(map[string]string{"bad": `{{ .Get`}); err == nil {
+		t.Error("a shortcode that does not parse was accepted")
+	}
+}
@@ -0,0 +1,327 @@
+package themes
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultTheme is the name of the theme compiled into the binary
+const DefaultTheme = "default"
+
+//go:embed default
+var defaultFS embed.FS
+
+// Meta is the content of a theme's theme.json file
+type Meta struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Version     string `json:"version"`
+}
+
+// Theme is a self-contained set of layouts, partials and static assets.
+// layouts/base.html defines the "base" template, each other file in layouts/ is a page
+// (post, index, ...) and every file in partials/ is available to all pages.
+type Theme struct {
+	Meta      Meta
+	fsys      fs.FS
+	templates map[string]*template.Template
+}
+
+// NewTheme reads theme.json from the root of fsys and parses every page layout
+func NewTheme(fsys fs.FS) (*Theme, error) {
+	data, err := fs.ReadFile(fsys, "theme.json")
+	if err != nil {
+		return nil, fmt.Errorf("theme: %v", err)
+	}
+
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("theme.json: %v", err)
+	}
+	if meta.Name == "" {
+		return nil, errors.New("theme.json: name is required")
+	}
+
+	t := &Theme{
+		Meta:      meta,
+		fsys:      fsys,
+		templates: make(map[string]*template.Template),
+	}
+
+	pages, err := fs.Glob(fsys, "layouts/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pages {
+		name := strings.TrimSuffix(path.Base(p), ".html")
+		if name == "base" {
+			continue
+		}
+
+		tmpl, err := t.parse(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("theme %s: %v", meta.Name, err)
+		}
+		t.templates[name] = tmpl
+	}
+
+	if _, ok := t.templates["post"]; !ok {
+		return nil, fmt.Errorf("theme %s: missing layouts/post.html", meta.Name)
+	}
+	if _, ok := t.templates["index"]; !ok {
+		return nil, fmt.Errorf("theme %s: missing layouts/index.html", meta.Name)
+	}
+	return t, nil
+}
+
+// parse builds the template set for a page: base layout, every partial and the page layout.
+// overrides maps a file path within the theme to source that replaces the file's contents
+func (t *Theme) parse(page string, overrides map[string]string) (*template.Template, error) {
+	files := []string{"layouts/base.html"}
+	partials, err := fs.Glob(t.fsys, "partials/*.html")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, partials...)
+	for _, file := range Overridable {
+		_, ok := overrides[file]
+		if ok && strings.HasPrefix(file, "partials/") && !contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	files = append(files, "layouts/"+page+".html")
+
+	var tmpl *template.Template
+	for _, file := range files {
+		src, ok := overrides[file]
+		if !ok {
+			data, err := fs.ReadFile(t.fsys, file)
+			if err != nil {
+				return nil, err
+			}
+			src = string(data)
+		}
+
+		name := path.Base(file)
+		if tmpl == nil {
+			tmpl = template.New(name)
+		} else {
+			tmpl = tmpl.New(name)
+		}
+		if _, err := tmpl.Parse(src); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Overridable maps the name of each template users may override to its file within a theme
+var Overridable = map[string]string{
+	"post":   "layouts/post.html",
+	"index":  "layouts/index.html",
+	"header": "partials/header.html",
+	"footer": "partials/footer.html",
+}
+
+// Source returns the theme's own source of an overridable template
+func (t *Theme) Source(name string) (string, error) {
+	file, ok := Overridable[name]
+	if !ok {
+		return "", fmt.Errorf("theme: %s is not an overridable template", name)
+	}
+
+	data, err := fs.ReadFile(t.fsys, file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// Override returns a copy of the theme with the named templates replaced by the given sources.
+// The returned error is a *TemplateError when one of the sources fails to parse
+func (t *Theme) Override(overrides map[string]string) (*Theme, error) {
+	files := make(map[string]string, len(overrides))
+	for name, src := range overrides {
+		file, ok := Overridable[name]
+		if !ok {
+			return nil, fmt.Errorf("theme: %s is not an overridable template", name)
+		}
+		files[file] = src
+	}
+
+	o := &Theme{
+		Meta:      t.Meta,
+		fsys:      t.fsys,
+		templates: make(map[string]*template.Template, len(t.templates)),
+	}
+	for page := range t.templates {
+		tmpl, err := t.parse(page, files)
+		if err != nil {
+			return nil, newTemplateError(err)
+		}
+		o.templates[page] = tmpl
+	}
+	return o, nil
+}
+
+// TemplateError is a template parse or execution error split into the file and line it refers to
+type TemplateError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line == 0 {
+		return e.File + ": " + e.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// matches errors from text/template and html/template such as
+// "template: post.html:12: unexpected EOF" or "template: post.html:3:5: executing ..."
+var templateErrorRE = regexp.MustCompile(`^(?:html/)?template: ?([^:]+):(\d+)(?::\d+)?: (.*)$`)
+
+func newTemplateError(err error) error {
+	m := templateErrorRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(m[2])
+	return &TemplateError{File: m[1], Line: line, Message: m[3]}
+}
+
+// Render executes the "base" template of the given page with data.
+// Execution errors that point into a template are returned as a *TemplateError
+func (t *Theme) Render(w io.Writer, page string, data interface{}) error {
+	tmpl, ok := t.templates[page]
+	if !ok {
+		return fmt.Errorf("theme %s: no layout for page %s", t.Meta.Name, page)
+	}
+
+	err := tmpl.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		return newTemplateError(err)
+	}
+	return nil
+}
+
+// Static returns the theme's static assets, or nil if the theme has none
+func (t *Theme) Static() fs.FS {
+	if _, err := fs.Stat(t.fsys, "static"); err != nil {
+		return nil
+	}
+
+	sub, err := fs.Sub(t.fsys, "static")
+	if err != nil {
+		return nil
+	}
+	return sub
+}
+
+// ShortcodeSources returns the source of each shortcode template the theme supplies
+// in shortcodes/*.html, keyed by shortcode name
+func (t *Theme) ShortcodeSources() (map[string]string, error) {
+	files, err := fs.Glob(t.fsys, "shortcodes/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		data, err := fs.ReadFile(t.fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		sources[strings.TrimSuffix(path.Base(file), ".html")] = string(data)
+	}
+	return sources, nil
+}
+
+// Registry holds every theme available to the application, keyed by name
+type Registry struct {
+	themes map[string]*Theme
+}
+
+// NewRegistry returns a registry that already contains the embedded default theme
+func NewRegistry() (*Registry, error) {
+	r := &Registry{themes: make(map[string]*Theme)}
+
+	sub, err := fs.Sub(defaultFS, DefaultTheme)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Load(sub); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load parses the theme rooted at fsys and adds it to the registry,
+// replacing any theme already registered under the same name
+func (r *Registry) Load(fsys fs.FS) error {
+	t, err := NewTheme(fsys)
+	if err != nil {
+		return err
+	}
+	r.themes[t.Meta.Name] = t
+	return nil
+}
+
+// LoadDir loads each subdirectory of dir as a theme
+func (r *Registry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := r.Load(os.DirFS(filepath.Join(dir, e.Name()))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the named theme, or false if it is not registered
+func (r *Registry) Get(name string) (*Theme, bool) {
+	t, ok := r.themes[name]
+	return t, ok
+}
+
+// List returns the metadata of every registered theme sorted by name
+func (r *Registry) List() []Meta {
+	metas := make([]Meta, 0, len(r.themes))
+	for _, t := range r.themes {
+		metas = append(metas, t.Meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Name < metas[j].Name })
+	return metas
+}
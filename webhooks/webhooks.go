@@ -0,0 +1,275 @@
+// Package webhooks queues signed JSON notifications of content and publish events
+// and delivers them to user-registered URLs, retrying failures with exponential backoff
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tydar/mdbssg/models"
+	"github.com/tydar/mdbssg/safehttp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// event names
+const (
+	PostCreated       = "post.created"
+	PostUpdated       = "post.updated"
+	PostDeleted       = "post.deleted"
+	GenerateStarted   = "generate.started"
+	GenerateSucceeded = "generate.succeeded"
+	GenerateFailed    = "generate.failed"
+	Ping              = "ping"
+)
+
+// Events lists the events a webhook can subscribe to
+var Events = []string{PostCreated, PostUpdated, PostDeleted, GenerateStarted, GenerateSucceeded, GenerateFailed}
+
+// headers sent with every delivery. SignatureHeader is "sha256=" followed by the hex
+// HMAC-SHA256 of the request body keyed with the webhook's secret
+const (
+	EventHeader     = "X-Mdbssg-Event"
+	DeliveryHeader  = "X-Mdbssg-Delivery"
+	SignatureHeader = "X-Mdbssg-Signature"
+)
+
+// retry policy: attempt n (from 1) that fails is retried after BaseDelay * 2^(n-1),
+// at most MaxDelay, until MaxAttempts have been made
+const (
+	MaxAttempts = 8
+	BaseDelay   = 30 * time.Second
+	MaxDelay    = 6 * time.Hour
+)
+
+// Store describes the persistence the dispatcher needs; it is implemented by models.WebhookModel
+type Store interface {
+	GetByUsername(ctx context.Context, username string) ([]models.Webhook, error)
+	Get(ctx context.Context, id string) (models.Webhook, error)
+	CreateDelivery(ctx context.Context, d models.Delivery) error
+	UpdateDelivery(ctx context.Context, d models.Delivery) error
+	ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.Delivery, error)
+}
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Username  string      `json:"username"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher queues events for a user's webhooks and sends them from Run
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+	wake   chan struct{}
+	// PollInterval is how often Run checks for deliveries that are due for a retry
+	PollInterval time.Duration
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		store:        store,
+		client:       safehttp.NewClient(10 * time.Second),
+		wake:         make(chan struct{}, 1),
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// NewSecret returns a random secret for signing a webhook's deliveries
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the SignatureHeader value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the SignatureHeader value for body;
+// receivers written in Go can use it to authenticate deliveries
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Backoff returns the delay before retrying after the given number of failed attempts
+func Backoff(attempts int) time.Duration {
+	d := BaseDelay
+	for i := 1; i < attempts && d < MaxDelay; i++ {
+		d *= 2
+	}
+	if d > MaxDelay {
+		d = MaxDelay
+	}
+	return d
+}
+
+// Emit queues event for every active webhook of username subscribed to it. Errors are
+// logged rather than returned so that a notification problem never fails the action itself
+func (d *Dispatcher) Emit(ctx context.Context, username, event string, data interface{}) {
+	hooks, err := d.store.GetByUsername(ctx, username)
+	if err != nil {
+		log.Printf("webhooks: listing webhooks for %s: %v", username, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if hook.Active && hook.Subscribed(event) {
+			if _, err := d.Enqueue(ctx, hook, event, data); err != nil {
+				log.Printf("webhooks: queueing %s for %s: %v", event, hook.URL, err)
+			}
+		}
+	}
+}
+
+// Enqueue queues event for hook regardless of its subscriptions, as used for test pings
+func (d *Dispatcher) Enqueue(ctx context.Context, hook models.Webhook, event string, data interface{}) (models.Delivery, error) {
+	now := time.Now()
+	payload := Payload{
+		ID:        uuid.NewString(),
+		Event:     event,
+		Username:  hook.OwnerUsername,
+		CreatedAt: now,
+		Data:      data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return models.Delivery{}, err
+	}
+
+	delivery := models.Delivery{
+		ID:            payload.ID,
+		WebhookID:     hook.ID,
+		OwnerUsername: hook.OwnerUsername,
+		URL:           hook.URL,
+		Event:         event,
+		Payload:       string(body),
+		Status:        models.DeliveryPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if err := d.store.CreateDelivery(ctx, delivery); err != nil {
+		return models.Delivery{}, err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return delivery, nil
+}
+
+// Run sends due deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// deliverDue sends every delivery that is currently due
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		delivery, err := d.store.ClaimDelivery(ctx, time.Now(), time.Minute)
+		if err == mongo.ErrNoDocuments {
+			return
+		} else if err != nil {
+			log.Printf("webhooks: claiming delivery: %v", err)
+			return
+		}
+
+		d.attempt(ctx, &delivery)
+		if err := d.store.UpdateDelivery(ctx, delivery); err != nil {
+			log.Printf("webhooks: recording delivery %s: %v", delivery.ID, err)
+		}
+	}
+}
+
+// attempt sends delivery once and updates its status, response and next attempt
+func (d *Dispatcher) attempt(ctx context.Context, delivery *models.Delivery) {
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+
+	hook, err := d.store.Get(ctx, delivery.WebhookID)
+	if err != nil {
+		delivery.Status = models.DeliveryFailed
+		delivery.Error = "webhook no longer exists"
+		delivery.CompletedAt = time.Now()
+		return
+	}
+
+	err = d.send(ctx, hook, delivery)
+	if err == nil {
+		delivery.Status = models.DeliverySucceeded
+		delivery.CompletedAt = time.Now()
+		return
+	}
+
+	delivery.Error = err.Error()
+	if delivery.Attempts >= MaxAttempts {
+		delivery.Status = models.DeliveryFailed
+		delivery.CompletedAt = time.Now()
+		return
+	}
+	delivery.NextAttemptAt = time.Now().Add(Backoff(delivery.Attempts))
+}
+
+// send POSTs the payload, treating any 2xx response as success. The start of the response
+// body is kept in the delivery log, so deliveries only go to public addresses; otherwise
+// a webhook could be used to read services on the server's own network
+func (d *Dispatcher) send(ctx context.Context, hook models.Webhook, delivery *models.Delivery) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := safehttp.CheckURL(req.URL); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mdbssg-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	delivery.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,257 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tydar/mdbssg/models"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memStore is an in-memory Store
+type memStore struct {
+	mu         sync.Mutex
+	hooks      []models.Webhook
+	deliveries []models.Delivery
+}
+
+func (s *memStore) GetByUsername(ctx context.Context, username string) ([]models.Webhook, error) {
+	var hooks []models.Webhook
+	for _, h := range s.hooks {
+		if h.OwnerUsername == username {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks, nil
+}
+
+func (s *memStore) Get(ctx context.Context, id string) (models.Webhook, error) {
+	for _, h := range s.hooks {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return models.Webhook{}, mongo.ErrNoDocuments
+}
+
+func (s *memStore) CreateDelivery(ctx context.Context, d models.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, d)
+	return nil
+}
+
+func (s *memStore) UpdateDelivery(ctx context.Context, d models.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.deliveries {
+		if s.deliveries[i].ID == d.ID {
+			s.deliveries[i] = d
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (s *memStore) ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration) (models.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.deliveries {
+		if d.Status == models.DeliveryPending && !d.NextAttemptAt.After(now) {
+			s.deliveries[i].NextAttemptAt = now.Add(lease)
+			return s.deliveries[i], nil
+		}
+	}
+	return models.Delivery{}, mongo.ErrNoDocuments
+}
+
+// makeDue lets the pending deliveries be retried straight away
+func (s *memStore) makeDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.deliveries {
+		s.deliveries[i].NextAttemptAt = time.Now().Add(-time.Second)
+	}
+}
+
+func (s *memStore) delivery(t *testing.T) models.Delivery {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(s.deliveries))
+	}
+	return s.deliveries[0]
+}
+
+// newTestDispatcher returns a dispatcher with one webhook for alice pointing at url.
+// It uses a plain client because test receivers listen on loopback addresses
+func newTestDispatcher(url string) (*Dispatcher, *memStore) {
+	store := &memStore{hooks: []models.Webhook{{
+		ID:            "hook1",
+		OwnerUsername: "alice",
+		URL:           url,
+		Secret:        "s3cret",
+		Events:        []string{PostCreated},
+		Active:        true,
+	}}}
+	d := NewDispatcher(store)
+	d.client = &http.Client{Timeout: 5 * time.Second}
+	return d, store
+}
+
+func TestDeliverySignature(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Header, body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d, store := newTestDispatcher(srv.URL)
+	ctx := context.Background()
+	d.Emit(ctx, "alice", PostCreated, map[string]string{"slug": "hello"})
+	d.Emit(ctx, "alice", PostDeleted, nil) // not subscribed
+	d.deliverDue(ctx)
+
+	r := <-got
+	if sig := r.header.Get(SignatureHeader); !Verify("s3cret", r.body, sig) {
+		t.Errorf("signature %q does not verify for body %s", sig, r.body)
+	}
+	if Verify("other", r.body, r.header.Get(SignatureHeader)) {
+		t.Error("signature verifies with the wrong secret")
+	}
+	if e := r.header.Get(EventHeader); e != PostCreated {
+		t.Errorf("event header = %q, want %q", e, PostCreated)
+	}
+	if !strings.Contains(string(r.body), `"slug":"hello"`) {
+		t.Errorf("body %s does not contain the event data", r.body)
+	}
+
+	delivery := store.delivery(t)
+	if r.header.Get(DeliveryHeader) != delivery.ID {
+		t.Errorf("delivery header = %q, want %q", r.header.Get(DeliveryHeader), delivery.ID)
+	}
+	if delivery.Status != models.DeliverySucceeded || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusNoContent {
+		t.Errorf("delivery = %+v, want one successful attempt", delivery)
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	var mu sync.Mutex
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	d, store := newTestDispatcher(srv.URL)
+	ctx := context.Background()
+	d.Emit(ctx, "alice", PostCreated, nil)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		start := time.Now()
+		d.deliverDue(ctx)
+		delivery := store.delivery(t)
+		if delivery.Status != models.DeliveryPending || delivery.Attempts != attempt {
+			t.Fatalf("after attempt %d: delivery = %+v, want pending", attempt, delivery)
+		}
+		if !strings.Contains(delivery.Error, "503") || !strings.Contains(delivery.Error, "try later") {
+			t.Errorf("after attempt %d: error = %q, want the response status and body", attempt, delivery.Error)
+		}
+		wait := delivery.NextAttemptAt.Sub(start)
+		if want := Backoff(attempt); wait < want || wait > want+time.Second {
+			t.Errorf("after attempt %d: retried in %v, want %v", attempt, wait, want)
+		}
+
+		// nothing is sent again before the backoff has passed
+		d.deliverDue(ctx)
+		if store.delivery(t).Attempts != attempt {
+			t.Fatalf("delivery retried before its backoff")
+		}
+		store.makeDue()
+	}
+
+	d.deliverDue(ctx)
+	if delivery := store.delivery(t); delivery.Status != models.DeliverySucceeded || delivery.Attempts != 3 {
+		t.Errorf("delivery = %+v, want success on the third attempt", delivery)
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	d, store := newTestDispatcher(srv.URL)
+	ctx := context.Background()
+	d.Emit(ctx, "alice", PostCreated, nil)
+	for i := 0; i < MaxAttempts; i++ {
+		d.deliverDue(ctx)
+		store.makeDue()
+	}
+
+	delivery := store.delivery(t)
+	if delivery.Status != models.DeliveryFailed || delivery.Attempts != MaxAttempts || delivery.CompletedAt.IsZero() {
+		t.Errorf("delivery = %+v, want failed after %d attempts", delivery, MaxAttempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{10, 4*time.Hour + 16*time.Minute},
+		{11, MaxDelay},
+		{50, MaxDelay},
+	} {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryToPrivateAddress(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	store := &memStore{hooks: []models.Webhook{{ID: "hook1", OwnerUsername: "alice", URL: srv.URL, Events: Events, Active: true}}}
+	d := NewDispatcher(store)
+	ctx := context.Background()
+	d.Emit(ctx, "alice", PostCreated, nil)
+	d.deliverDue(ctx)
+
+	if called {
+		t.Error("delivery reached a loopback address")
+	}
+	if delivery := store.delivery(t); !strings.Contains(delivery.Error, "address not allowed") {
+		t.Errorf("error = %q, want the address to be refused", delivery.Error)
+	}
+}
@@ -0,0 +1,362 @@
+// Package xmlrpc decodes XML-RPC method calls and encodes their responses
+// (http://xmlrpc.com/spec.md), as used by the MetaWeblog and Blogger APIs.
+//
+// Values decode to string, int, bool, float64, time.Time, []byte (base64),
+// []interface{} (array), map[string]interface{} (struct) or nil
+package xmlrpc
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault is an XML-RPC fault response. Handlers return it as an error to choose the fault code
+type Fault struct {
+	Code   int
+	String string
+}
+
+func (f Fault) Error() string {
+	return fmt.Sprintf("xmlrpc fault %d: %s", f.Code, f.String)
+}
+
+// Params are the decoded parameters of a method call
+type Params []interface{}
+
+func (p Params) get(i int) (interface{}, error) {
+	if i >= len(p) {
+		return nil, Fault{Code: 400, String: fmt.Sprintf("missing parameter %d", i+1)}
+	}
+	return p[i], nil
+}
+
+// String returns parameter i, which must be a string or int
+func (p Params) String(i int) (string, error) {
+	v, err := p.get(i)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", Fault{Code: 400, String: fmt.Sprintf("parameter %d must be a string", i+1)}
+}
+
+// Int returns parameter i, which must be an int or a string holding one
+func (p Params) Int(i int) (int, error) {
+	v, err := p.get(i)
+	if err != nil {
+		return 0, err
+	}
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n, nil
+		}
+	}
+	return 0, Fault{Code: 400, String: fmt.Sprintf("parameter %d must be an int", i+1)}
+}
+
+// Bool returns parameter i, or def if the call has no such parameter
+func (p Params) Bool(i int, def bool) (bool, error) {
+	if i >= len(p) {
+		return def, nil
+	}
+	switch v := p[i].(type) {
+	case bool:
+		return v, nil
+	case int:
+		return v != 0, nil
+	}
+	return false, Fault{Code: 400, String: fmt.Sprintf("parameter %d must be a boolean", i+1)}
+}
+
+// Struct returns parameter i, which must be a struct
+func (p Params) Struct(i int) (map[string]interface{}, error) {
+	v, err := p.get(i)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return nil, Fault{Code: 400, String: fmt.Sprintf("parameter %d must be a struct", i+1)}
+}
+
+// DecodeCall reads a methodCall document
+func DecodeCall(r io.Reader) (string, Params, error) {
+	d := xml.NewDecoder(r)
+	var method string
+	var params Params
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "methodName":
+			if err := d.DecodeElement(&method, &start); err != nil {
+				return "", nil, err
+			}
+			method = strings.TrimSpace(method)
+		case "value":
+			v, err := decodeValue(d)
+			if err != nil {
+				return "", nil, err
+			}
+			params = append(params, v)
+		}
+	}
+
+	if method == "" {
+		return "", nil, errors.New("xmlrpc: missing methodName")
+	}
+	return method, params, nil
+}
+
+// decodeValue decodes the contents of a <value> element whose start tag was just read.
+// A value without a type element is a string
+func decodeValue(d *xml.Decoder) (interface{}, error) {
+	var text strings.Builder
+	var result interface{}
+	typed := false
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			typed = true
+			if result, err = decodeTyped(d, t); err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			if !typed {
+				return text.String(), nil
+			}
+			return result, nil
+		}
+	}
+}
+
+func decodeTyped(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "array":
+		return decodeArray(d)
+	case "struct":
+		return decodeStruct(d)
+	case "nil":
+		return nil, d.Skip()
+	}
+
+	var s string
+	if err := d.DecodeElement(&s, &start); err != nil {
+		return nil, err
+	}
+	switch start.Name.Local {
+	case "string":
+		return s, nil
+	case "i4", "i8", "int":
+		return strconv.Atoi(strings.TrimSpace(s))
+	case "boolean":
+		return strings.TrimSpace(s) == "1", nil
+	case "double":
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	case "dateTime.iso8601":
+		return parseTime(strings.TrimSpace(s))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	}
+	return nil, fmt.Errorf("xmlrpc: unknown type %s", start.Name.Local)
+}
+
+func decodeArray(d *xml.Decoder) ([]interface{}, error) {
+	values := []interface{}{}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "value" {
+				v, err := decodeValue(d)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "array" {
+				return values, nil
+			}
+		}
+	}
+}
+
+func decodeStruct(d *xml.Decoder) (map[string]interface{}, error) {
+	members := map[string]interface{}{}
+	name := ""
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "name":
+				if err := d.DecodeElement(&name, &t); err != nil {
+					return nil, err
+				}
+				name = strings.TrimSpace(name)
+			case "value":
+				v, err := decodeValue(d)
+				if err != nil {
+					return nil, err
+				}
+				members[name] = v
+			}
+		case xml.EndElement:
+			if t.Name.Local == "struct" {
+				return members, nil
+			}
+		}
+	}
+}
+
+// timeLayouts are the dateTime.iso8601 forms sent by common clients
+var timeLayouts = []string{
+	"20060102T15:04:05",
+	"20060102T15:04:05Z",
+	"20060102T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("xmlrpc: invalid dateTime %q", s)
+}
+
+// EncodeResponse writes a methodResponse holding v
+func EncodeResponse(w io.Writer, v interface{}) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<methodResponse><params><param>")
+	if err := encodeValue(&b, v); err != nil {
+		return err
+	}
+	b.WriteString("</param></params></methodResponse>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// EncodeFault writes a fault methodResponse
+func EncodeFault(w io.Writer, f Fault) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<methodResponse><fault>")
+	encodeValue(&b, map[string]interface{}{"faultCode": f.Code, "faultString": f.String})
+	b.WriteString("</fault></methodResponse>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func encodeValue(b *strings.Builder, v interface{}) error {
+	b.WriteString("<value>")
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("<nil/>")
+	case string:
+		b.WriteString("<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case int:
+		fmt.Fprintf(b, "<int>%d</int>", v)
+	case bool:
+		if v {
+			b.WriteString("<boolean>1</boolean>")
+		} else {
+			b.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(b, "<double>%s</double>", strconv.FormatFloat(v, 'f', -1, 64))
+	case time.Time:
+		fmt.Fprintf(b, "<dateTime.iso8601>%s</dateTime.iso8601>", v.UTC().Format("20060102T15:04:05"))
+	case []byte:
+		fmt.Fprintf(b, "<base64>%s</base64>", base64.StdEncoding.EncodeToString(v))
+	case []string:
+		b.WriteString("<array><data>")
+		for _, s := range v {
+			encodeValue(b, s)
+		}
+		b.WriteString("</data></array>")
+	case []interface{}:
+		b.WriteString("<array><data>")
+		for _, e := range v {
+			if err := encodeValue(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteString("</data></array>")
+	case []map[string]interface{}:
+		b.WriteString("<array><data>")
+		for _, e := range v {
+			if err := encodeValue(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteString("</data></array>")
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		b.WriteString("<struct>")
+		for _, name := range names {
+			b.WriteString("<member><name>")
+			xml.EscapeText(b, []byte(name))
+			b.WriteString("</name>")
+			if err := encodeValue(b, v[name]); err != nil {
+				return err
+			}
+			b.WriteString("</member>")
+		}
+		b.WriteString("</struct>")
+	default:
+		return fmt.Errorf("xmlrpc: cannot encode %T", v)
+	}
+	b.WriteString("</value>")
+	return nil
+}